@@ -0,0 +1,303 @@
+package azuredns
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	dns "github.com/searchspring.com/spf-flatten/dns"
+	"github.com/searchspring.com/spf-flatten/oauth"
+	"github.com/searchspring.com/spf-flatten/provider"
+)
+
+const (
+	DefaultEndpoint          = "https://management.azure.com"
+	DefaultAuthorityEndpoint = "https://login.microsoftonline.com"
+	APIVersion               = "2018-05-01"
+)
+
+type AzureDNSUpdater struct {
+	UpdateDomain   string
+	SubscriptionID string
+	ResourceGroup  string
+	// ZoneName is looked up from UpdateDomain among the zones in ResourceGroup when empty
+	ZoneName string
+	// Service principal client credentials
+	TenantID     string
+	ClientID     string
+	ClientSecret string
+	// Naming picks out the leaf records of the domain, the default _spfN when empty
+	Naming dns.Naming
+	DryRun bool
+	// Logger gets what was published, or with DryRun would have been, nothing is logged when nil
+	Logger *slog.Logger
+	// Endpoint and AuthorityEndpoint override the Resource Manager and Entra ID URLs, IE for a local stand-in
+	Endpoint          string
+	AuthorityEndpoint string
+	HTTPClient        *http.Client
+	tokens            *oauth.TokenSource
+}
+
+var _ provider.Publisher = &AzureDNSUpdater{}
+
+type txtRecord struct {
+	Value []string `json:"value"`
+}
+
+type recordSetProperties struct {
+	TTL        int64       `json:"TTL"`
+	Fqdn       string      `json:"fqdn,omitempty"`
+	TXTRecords []txtRecord `json:"TXTRecords"`
+}
+
+type recordSet struct {
+	Name       string              `json:"name,omitempty"`
+	Properties recordSetProperties `json:"properties"`
+}
+
+type apiError struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func New(s AzureDNSUpdater) (AzureDNSUpdater, error) {
+	if s.TenantID == "" || s.ClientID == "" || s.ClientSecret == "" {
+		return s, fmt.Errorf("Azure tenant id, client id and client secret must all be configured")
+	}
+	if s.SubscriptionID == "" || s.ResourceGroup == "" {
+		return s, fmt.Errorf("Azure subscription id and resource group must be configured")
+	}
+	if s.Endpoint == "" {
+		s.Endpoint = DefaultEndpoint
+	}
+	if s.AuthorityEndpoint == "" {
+		s.AuthorityEndpoint = DefaultAuthorityEndpoint
+	}
+	if s.HTTPClient == nil {
+		s.HTTPClient = http.DefaultClient
+	}
+	// Tokens are for the Resource Manager being talked to, whose audience differs in sovereign clouds
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {s.ClientID},
+		"client_secret": {s.ClientSecret},
+		"scope":         {strings.TrimSuffix(s.Endpoint, "/") + "/.default"},
+	}
+	s.tokens = &oauth.TokenSource{
+		URL:    fmt.Sprintf("%s/%s/oauth2/v2.0/token", strings.TrimSuffix(s.AuthorityEndpoint, "/"), s.TenantID),
+		Form:   func(now time.Time) (url.Values, error) { return form, nil },
+		Client: s.HTTPClient,
+	}
+	return s, nil
+}
+
+// ResolveZone picks the zone in ResourceGroup with the most specific name containing UpdateDomain
+func (s *AzureDNSUpdater) ResolveZone(ctx context.Context) error {
+	if s.ZoneName != "" {
+		return nil
+	}
+	domain := strings.TrimSuffix(provider.Fqdn(s.UpdateDomain), ".")
+	path := fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Network/dnsZones", s.SubscriptionID, s.ResourceGroup)
+	best := ""
+	err := s.pages(ctx, path, func(raw json.RawMessage) error {
+		var zones []struct {
+			Name string `json:"name"`
+		}
+		err := json.Unmarshal(raw, &zones)
+		if err != nil {
+			return err
+		}
+		for _, zone := range zones {
+			name := strings.ToLower(zone.Name)
+			if (domain == name || strings.HasSuffix(domain, "."+name)) && len(name) > len(best) {
+				best = name
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if best == "" {
+		return fmt.Errorf("no Azure DNS zone found for %v in resource group %v", s.UpdateDomain, s.ResourceGroup)
+	}
+	s.ZoneName = best
+	return nil
+}
+
+// ListRecords returns the TXT record sets of domain and its _spfN leaves
+func (s *AzureDNSUpdater) ListRecords(ctx context.Context, domain string) ([]provider.Record, error) {
+	err := s.ResolveZone(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var records []provider.Record
+	err = s.pages(ctx, s.zonePath()+"/TXT", func(raw json.RawMessage) error {
+		var recordSets []recordSet
+		err := json.Unmarshal(raw, &recordSets)
+		if err != nil {
+			return err
+		}
+		for _, rs := range recordSets {
+			record := s.toRecord(rs)
+			if record.Name == provider.Fqdn(domain) || s.Naming.IsLeaf(record.Name, domain) {
+				records = append(records, record)
+			}
+		}
+		return nil
+	})
+	return records, err
+}
+
+// Apply replaces each TXT record set with a PUT, the plan has already carried over any non-SPF values
+func (s *AzureDNSUpdater) Apply(ctx context.Context, changes provider.ChangeSet) error {
+	err := s.ResolveZone(ctx)
+	if err != nil {
+		return err
+	}
+	for _, change := range changes {
+		rs := recordSet{Properties: recordSetProperties{TTL: change.Record.TTL}}
+		for _, value := range change.Record.Values {
+			rs.Properties.TXTRecords = append(rs.Properties.TXTRecords, txtRecord{Value: dns.SplitTXT(value)})
+		}
+		if s.DryRun {
+			s.logger().Info("DryRun TXT record not updated", "domain", s.UpdateDomain, "record", change.Record.Name, "values", change.Record.Values, "ttl", change.Record.TTL)
+			continue
+		}
+		err = s.do(ctx, http.MethodPut, s.recordSetPath(change.Record.Name), rs, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteRecords removes the TXT record sets
+func (s *AzureDNSUpdater) DeleteRecords(ctx context.Context, records []provider.Record) error {
+	err := s.ResolveZone(ctx)
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		if s.DryRun {
+			s.logger().Info("DryRun TXT record not deleted", "domain", s.UpdateDomain, "record", record.Name)
+			continue
+		}
+		err = s.do(ctx, http.MethodDelete, s.recordSetPath(record.Name), nil, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *AzureDNSUpdater) zonePath() string {
+	return fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Network/dnsZones/%s", s.SubscriptionID, s.ResourceGroup, s.ZoneName)
+}
+
+// recordSetPath addresses a TXT record set by its name relative to the zone, the apex being @
+func (s *AzureDNSUpdater) recordSetPath(name string) string {
+	zone := provider.Fqdn(s.ZoneName)
+	relative := "@"
+	if name = provider.Fqdn(name); name != zone {
+		relative = strings.TrimSuffix(name, "."+zone)
+	}
+	return s.zonePath() + "/TXT/" + url.PathEscape(relative)
+}
+
+func (s *AzureDNSUpdater) toRecord(rs recordSet) provider.Record {
+	name := rs.Properties.Fqdn
+	if name == "" {
+		name = rs.Name + "." + s.ZoneName
+		if rs.Name == "@" {
+			name = s.ZoneName
+		}
+	}
+	record := provider.Record{Name: provider.Fqdn(name), TTL: rs.Properties.TTL}
+	for _, txt := range rs.Properties.TXTRecords {
+		record.Values = append(record.Values, strings.Join(txt.Value, ""))
+	}
+	return record
+}
+
+// pages follows nextLink through a list result, handing each page's value array to fn
+func (s *AzureDNSUpdater) pages(ctx context.Context, path string, fn func(json.RawMessage) error) error {
+	next := s.url(path)
+	for next != "" {
+		var page struct {
+			Value    json.RawMessage `json:"value"`
+			NextLink string          `json:"nextLink"`
+		}
+		err := s.doURL(ctx, http.MethodGet, next, nil, &page)
+		if err != nil {
+			return err
+		}
+		err = fn(page.Value)
+		if err != nil {
+			return err
+		}
+		next = page.NextLink
+	}
+	return nil
+}
+
+func (s *AzureDNSUpdater) url(path string) string {
+	return strings.TrimSuffix(s.Endpoint, "/") + path + "?api-version=" + APIVersion
+}
+
+func (s *AzureDNSUpdater) do(ctx context.Context, method string, path string, body interface{}, out interface{}) error {
+	return s.doURL(ctx, method, s.url(path), body, out)
+}
+
+// doURL sends an authenticated request to Resource Manager and decodes the response into out
+func (s *AzureDNSUpdater) doURL(ctx context.Context, method string, target string, body interface{}, out interface{}) error {
+	if s.tokens == nil {
+		return fmt.Errorf("AzureDNSUpdater must be created with New")
+	}
+	token, err := s.tokens.Token(ctx)
+	if err != nil {
+		return err
+	}
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var apiErr apiError
+		_ = json.NewDecoder(resp.Body).Decode(&apiErr)
+		return fmt.Errorf("azuredns %v %v: %v: %v %v", method, target, resp.Status, apiErr.Error.Code, apiErr.Error.Message)
+	}
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (s *AzureDNSUpdater) logger() *slog.Logger {
+	return dns.LoggerOrDiscard(s.Logger)
+}
@@ -0,0 +1,233 @@
+package azuredns
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	dns "github.com/searchspring.com/spf-flatten/dns"
+	"github.com/searchspring.com/spf-flatten/provider"
+	"github.com/searchspring.com/spf-flatten/provider/providertest"
+	"github.com/stretchr/testify/require"
+)
+
+// FakeAzureDNS is a local stand-in for the Entra ID token endpoint and the Azure DNS record set API
+type FakeAzureDNS struct {
+	Tenant string
+	// Scope is what the last token was requested for
+	Scope    string
+	Zones    []string
+	PageSize int
+	mu       sync.Mutex
+	sets     map[string]recordSet
+	server   *httptest.Server
+}
+
+const zonesPath = "/subscriptions/sub/resourceGroups/dns/providers/Microsoft.Network/dnsZones"
+
+func NewFakeAzureDNS(t *testing.T, zones ...string) *FakeAzureDNS {
+	fake := &FakeAzureDNS{Tenant: "tenant", Zones: zones, PageSize: 2, sets: map[string]recordSet{}}
+	fake.server = httptest.NewServer(fake)
+	t.Cleanup(fake.server.Close)
+	return fake
+}
+
+func (s *FakeAzureDNS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.URL.Path == "/"+s.Tenant+"/oauth2/v2.0/token" {
+		_ = r.ParseForm()
+		s.Scope = r.Form.Get("scope")
+		if r.Form.Get("grant_type") != "client_credentials" || r.Form.Get("client_secret") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client", "error_description": "Invalid client secret provided."})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "fake-access-token", "expires_in": 3599})
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer fake-access-token" || r.URL.Query().Get("api-version") != APIVersion {
+		writeError(w, http.StatusUnauthorized, "AuthenticationFailed", "Authentication failed.")
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, zonesPath)
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case path == "":
+		var zones []map[string]string
+		for _, zone := range s.Zones {
+			zones = append(zones, map[string]string{"name": zone})
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"value": zones})
+	case len(parts) == 2 && parts[1] == "TXT":
+		s.list(w, r, parts[0])
+	case len(parts) == 3 && r.Method == http.MethodPut:
+		var rs recordSet
+		_ = json.NewDecoder(r.Body).Decode(&rs)
+		rs.Name = parts[2]
+		rs.Properties.Fqdn = fqdn(parts[2], parts[0])
+		s.sets[parts[0]+"/"+parts[2]] = rs
+		_ = json.NewEncoder(w).Encode(rs)
+	case len(parts) == 3 && r.Method == http.MethodDelete:
+		delete(s.sets, parts[0]+"/"+parts[2])
+		w.WriteHeader(http.StatusOK)
+	default:
+		writeError(w, http.StatusNotFound, "NotFound", "Not found")
+	}
+}
+
+func (s *FakeAzureDNS) list(w http.ResponseWriter, r *http.Request, zone string) {
+	var keys []string
+	for key := range s.sets {
+		if strings.HasPrefix(key, zone+"/") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	start := 0
+	fmt.Sscan(r.URL.Query().Get("$skipToken"), &start)
+	page := map[string]interface{}{}
+	sets := []recordSet{}
+	for i := start; i < len(keys) && i < start+s.PageSize; i++ {
+		sets = append(sets, s.sets[keys[i]])
+	}
+	page["value"] = sets
+	if start+s.PageSize < len(keys) {
+		page["nextLink"] = fmt.Sprintf("%s%s?api-version=%s&$skipToken=%d", s.server.URL, r.URL.Path, APIVersion, start+s.PageSize)
+	}
+	_ = json.NewEncoder(w).Encode(page)
+}
+
+func (s *FakeAzureDNS) Seed(records ...provider.Record) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, record := range records {
+		zone := s.Zones[0]
+		relative := strings.TrimSuffix(strings.TrimSuffix(record.Name, "."), "."+zone)
+		if relative == zone {
+			relative = "@"
+		}
+		rs := recordSet{Name: relative, Properties: recordSetProperties{TTL: record.TTL, Fqdn: record.Name}}
+		for _, value := range record.Values {
+			rs.Properties.TXTRecords = append(rs.Properties.TXTRecords, txtRecord{Value: dns.SplitTXT(value)})
+		}
+		s.sets[zone+"/"+relative] = rs
+	}
+}
+
+func (s *FakeAzureDNS) Records() []provider.Record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var records []provider.Record
+	for _, rs := range s.sets {
+		record := provider.Record{Name: rs.Properties.Fqdn, TTL: rs.Properties.TTL}
+		for _, txt := range rs.Properties.TXTRecords {
+			for _, chunk := range txt.Value {
+				if len(chunk) > dns.MaxTXTStringLength {
+					panic("TXT string longer than 255 bytes")
+				}
+			}
+			record.Values = append(record.Values, strings.Join(txt.Value, ""))
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func fqdn(relative string, zone string) string {
+	if relative == "@" {
+		return zone + "."
+	}
+	return relative + "." + zone + "."
+}
+
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"error": map[string]string{"code": code, "message": message}})
+}
+
+func newTestUpdater(t *testing.T, fake *FakeAzureDNS) AzureDNSUpdater {
+	updater, err := New(AzureDNSUpdater{
+		UpdateDomain:      providertest.Domain,
+		SubscriptionID:    "sub",
+		ResourceGroup:     "dns",
+		TenantID:          "tenant",
+		ClientID:          "client",
+		ClientSecret:      "secret",
+		Endpoint:          fake.server.URL,
+		AuthorityEndpoint: fake.server.URL,
+	})
+	require.Nil(t, err)
+	return updater
+}
+
+func TestPublisherConformance(t *testing.T) {
+	providertest.Run(t, func(t *testing.T) providertest.Harness {
+		fake := NewFakeAzureDNS(t, "example.com")
+		updater := newTestUpdater(t, fake)
+		return providertest.Harness{Publisher: &updater, Seed: fake.Seed, Records: fake.Records}
+	})
+}
+
+func TestNew(t *testing.T) {
+	_, err := New(AzureDNSUpdater{SubscriptionID: "sub", ResourceGroup: "dns"})
+	require.EqualError(t, err, "Azure tenant id, client id and client secret must all be configured")
+	_, err = New(AzureDNSUpdater{TenantID: "tenant", ClientID: "client", ClientSecret: "secret"})
+	require.EqualError(t, err, "Azure subscription id and resource group must be configured")
+
+	updater, err := New(AzureDNSUpdater{SubscriptionID: "sub", ResourceGroup: "dns", TenantID: "tenant", ClientID: "client", ClientSecret: "secret"})
+	require.Nil(t, err)
+	require.Equal(t, DefaultEndpoint, updater.Endpoint)
+	require.Equal(t, "https://login.microsoftonline.com/tenant/oauth2/v2.0/token", updater.tokens.URL)
+}
+
+func TestSovereignCloudScope(t *testing.T) {
+	fake := NewFakeAzureDNS(t, "example.com")
+	updater := newTestUpdater(t, fake)
+	_, err := updater.ListRecords(context.TODO(), "example.com")
+	require.Nil(t, err)
+	// Tokens are requested for the Resource Manager talked to, not the public cloud's
+	require.Equal(t, fake.server.URL+"/.default", fake.Scope)
+}
+
+func TestResolveZone(t *testing.T) {
+	fake := NewFakeAzureDNS(t, "example.com", "mail.example.com", "example.org")
+	updater := newTestUpdater(t, fake)
+	updater.UpdateDomain = "news.mail.example.com."
+	err := updater.ResolveZone(context.TODO())
+	require.Nil(t, err)
+	require.Equal(t, "mail.example.com", updater.ZoneName)
+
+	updater.ZoneName = ""
+	updater.UpdateDomain = "badexample.com"
+	err = updater.ResolveZone(context.TODO())
+	require.EqualError(t, err, "no Azure DNS zone found for badexample.com in resource group dns")
+}
+
+func TestRecordSetPath(t *testing.T) {
+	updater := AzureDNSUpdater{SubscriptionID: "sub", ResourceGroup: "dns", ZoneName: "example.com"}
+	require.Equal(t, zonesPath+"/example.com/TXT/@", updater.recordSetPath("example.com."))
+	require.Equal(t, zonesPath+"/example.com/TXT/_spf1.mail", updater.recordSetPath("_spf1.mail.example.com"))
+}
+
+func TestBadClientSecret(t *testing.T) {
+	fake := NewFakeAzureDNS(t, "example.com")
+	updater, err := New(AzureDNSUpdater{
+		SubscriptionID:    "sub",
+		ResourceGroup:     "dns",
+		TenantID:          "tenant",
+		ClientID:          "client",
+		ClientSecret:      "wrong",
+		Endpoint:          fake.server.URL,
+		AuthorityEndpoint: fake.server.URL,
+	})
+	require.Nil(t, err)
+	_, err = updater.ListRecords(context.TODO(), "example.com")
+	require.ErrorContains(t, err, "invalid_client Invalid client secret provided.")
+}
@@ -0,0 +1,110 @@
+package clouddns
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/searchspring.com/spf-flatten/oauth"
+)
+
+// Scope needed to read and change Cloud DNS records
+const Scope = "https://www.googleapis.com/auth/ndev.clouddns.readwrite"
+
+const DefaultTokenURL = "https://oauth2.googleapis.com/token"
+
+// ServiceAccount is the subset of a service-account JSON key file used to authenticate
+type ServiceAccount struct {
+	Type         string `json:"type"`
+	ProjectID    string `json:"project_id"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	ClientEmail  string `json:"client_email"`
+	TokenURI     string `json:"token_uri"`
+}
+
+func parseServiceAccount(credentials []byte) (ServiceAccount, *rsa.PrivateKey, error) {
+	var account ServiceAccount
+	err := json.Unmarshal(credentials, &account)
+	if err != nil {
+		return account, nil, fmt.Errorf("parsing service account credentials: %v", err)
+	}
+	if account.Type != "service_account" {
+		return account, nil, fmt.Errorf("credentials are of type %q, expected service_account", account.Type)
+	}
+	block, _ := pem.Decode([]byte(account.PrivateKey))
+	if block == nil {
+		return account, nil, fmt.Errorf("no PEM private key in service account credentials")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return account, nil, fmt.Errorf("parsing service account private key: %v", err)
+		}
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return account, nil, fmt.Errorf("service account private key is not RSA")
+	}
+	if account.TokenURI == "" {
+		account.TokenURI = DefaultTokenURL
+	}
+	return account, key, nil
+}
+
+// tokenSource exchanges a JWT signed with the service account's key for an access token
+func tokenSource(account ServiceAccount, key *rsa.PrivateKey, client *http.Client) *oauth.TokenSource {
+	return &oauth.TokenSource{
+		URL: account.TokenURI,
+		Form: func(now time.Time) (url.Values, error) {
+			assertion, err := signedAssertion(account, key, now)
+			if err != nil {
+				return nil, err
+			}
+			return url.Values{
+				"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+				"assertion":  {assertion},
+			}, nil
+		},
+		Client: client,
+	}
+}
+
+// assertion builds the RS256 signed JWT https://developers.google.com/identity/protocols/oauth2/service-account#authorizingrequests
+func signedAssertion(account ServiceAccount, key *rsa.PrivateKey, now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+		"kid": account.PrivateKeyID,
+	})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   account.ClientEmail,
+		"scope": Scope,
+		"aud":   account.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
@@ -0,0 +1,282 @@
+package clouddns
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	dns "github.com/searchspring.com/spf-flatten/dns"
+	"github.com/searchspring.com/spf-flatten/oauth"
+	"github.com/searchspring.com/spf-flatten/provider"
+)
+
+const DefaultEndpoint = "https://dns.googleapis.com/dns/v1"
+
+type CloudDNSUpdater struct {
+	UpdateDomain string
+	// Project defaults to the project of the service account
+	Project string
+	// ManagedZone is the zone name, not its DNS name, and is looked up from UpdateDomain when empty
+	ManagedZone string
+	// Service-account JSON key, either inline or read from CredentialsFile
+	CredentialsJSON []byte
+	CredentialsFile string
+	// Naming picks out the leaf records of the domain, the default _spfN when empty
+	Naming dns.Naming
+	DryRun bool
+	// Logger gets what was published, or with DryRun would have been, nothing is logged when nil
+	Logger *slog.Logger
+	// Endpoint overrides the Cloud DNS API base URL, IE for a local fake server
+	Endpoint   string
+	HTTPClient *http.Client
+	tokens     *oauth.TokenSource
+}
+
+var _ provider.BatchPublisher = &CloudDNSUpdater{}
+
+type resourceRecordSet struct {
+	Kind    string   `json:"kind,omitempty"`
+	Name    string   `json:"name"`
+	Type    string   `json:"type"`
+	TTL     int64    `json:"ttl"`
+	Rrdatas []string `json:"rrdatas"`
+}
+
+type change struct {
+	Kind      string              `json:"kind,omitempty"`
+	ID        string              `json:"id,omitempty"`
+	Status    string              `json:"status,omitempty"`
+	Additions []resourceRecordSet `json:"additions,omitempty"`
+	Deletions []resourceRecordSet `json:"deletions,omitempty"`
+}
+
+type managedZone struct {
+	Name    string `json:"name"`
+	DNSName string `json:"dnsName"`
+}
+
+type apiError struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func New(s CloudDNSUpdater) (CloudDNSUpdater, error) {
+	credentials := s.CredentialsJSON
+	if len(credentials) == 0 && s.CredentialsFile != "" {
+		var err error
+		credentials, err = os.ReadFile(s.CredentialsFile)
+		if err != nil {
+			return s, err
+		}
+	}
+	if len(credentials) == 0 {
+		return s, fmt.Errorf("no Google Cloud service account credentials configured")
+	}
+	account, key, err := parseServiceAccount(credentials)
+	if err != nil {
+		return s, err
+	}
+	if s.Project == "" {
+		s.Project = account.ProjectID
+	}
+	if s.Endpoint == "" {
+		s.Endpoint = DefaultEndpoint
+	}
+	if s.HTTPClient == nil {
+		s.HTTPClient = http.DefaultClient
+	}
+	s.tokens = tokenSource(account, key, s.HTTPClient)
+	return s, nil
+}
+
+// ResolveZone finds the managed zone with the most specific DNS name containing UpdateDomain
+func (s *CloudDNSUpdater) ResolveZone(ctx context.Context) error {
+	if s.ManagedZone != "" {
+		return nil
+	}
+	labels := strings.Split(strings.TrimSuffix(provider.Fqdn(s.UpdateDomain), "."), ".")
+	for i := range labels {
+		candidate := strings.Join(labels[i:], ".") + "."
+		var zones struct {
+			ManagedZones []managedZone `json:"managedZones"`
+		}
+		path := fmt.Sprintf("/projects/%s/managedZones?%s", s.Project, url.Values{"dnsName": {candidate}}.Encode())
+		err := s.do(ctx, http.MethodGet, path, nil, &zones)
+		if err != nil {
+			return err
+		}
+		if len(zones.ManagedZones) > 1 {
+			return fmt.Errorf("found %d managed zones for %v, set the managed zone explicitly", len(zones.ManagedZones), candidate)
+		}
+		if len(zones.ManagedZones) == 1 {
+			s.ManagedZone = zones.ManagedZones[0].Name
+			return nil
+		}
+	}
+	return fmt.Errorf("no Cloud DNS managed zone found for %v in project %v", s.UpdateDomain, s.Project)
+}
+
+// ListRecords returns the TXT record sets of domain and its _spfN leaves
+func (s *CloudDNSUpdater) ListRecords(ctx context.Context, domain string) ([]provider.Record, error) {
+	existing, err := s.listTXT(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var records []provider.Record
+	for name, rrset := range existing {
+		if name == provider.Fqdn(domain) || s.Naming.IsLeaf(name, domain) {
+			records = append(records, toRecord(rrset))
+		}
+	}
+	return records, nil
+}
+
+func (s *CloudDNSUpdater) Apply(ctx context.Context, changes provider.ChangeSet) error {
+	return s.ApplyBatch(ctx, changes, nil)
+}
+
+func (s *CloudDNSUpdater) DeleteRecords(ctx context.Context, records []provider.Record) error {
+	return s.ApplyBatch(ctx, nil, records)
+}
+
+// ApplyBatch submits every addition and deletion as one change, which Cloud DNS applies atomically
+func (s *CloudDNSUpdater) ApplyBatch(ctx context.Context, changes provider.ChangeSet, stale []provider.Record) error {
+	existing, err := s.listTXT(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Replacing a record set means deleting exactly what is there and adding the new one
+	var batch change
+	for _, c := range changes {
+		name := provider.Fqdn(c.Record.Name)
+		if current, ok := existing[name]; ok {
+			batch.Deletions = append(batch.Deletions, current)
+		}
+		rrset := resourceRecordSet{Kind: "dns#resourceRecordSet", Name: name, Type: "TXT", TTL: c.Record.TTL}
+		for _, value := range c.Record.Values {
+			rrset.Rrdatas = append(rrset.Rrdatas, dns.QuoteTXT(value))
+		}
+		batch.Additions = append(batch.Additions, rrset)
+	}
+	for _, record := range stale {
+		if current, ok := existing[provider.Fqdn(record.Name)]; ok {
+			batch.Deletions = append(batch.Deletions, current)
+		}
+	}
+	if len(batch.Additions) == 0 && len(batch.Deletions) == 0 {
+		return nil
+	}
+
+	batch.Kind = "dns#change"
+	if s.DryRun {
+		s.logger().Info("DryRun TXT records not updated", "domain", s.UpdateDomain, "change", fmt.Sprintf("%+v", batch))
+		return nil
+	}
+	var result change
+	err = s.do(ctx, http.MethodPost, s.zonePath()+"/changes", batch, &result)
+	if err != nil {
+		return err
+	}
+	s.logger().Info("TXT records submitted", "domain", s.UpdateDomain, "change", result.ID, "status", result.Status)
+	return nil
+}
+
+// listTXT pages through the record sets of the zone, keeping the TXT ones keyed by name
+func (s *CloudDNSUpdater) listTXT(ctx context.Context) (map[string]resourceRecordSet, error) {
+	err := s.ResolveZone(ctx)
+	if err != nil {
+		return nil, err
+	}
+	records := make(map[string]resourceRecordSet)
+	pageToken := ""
+	for {
+		// Cloud DNS only filters by type together with an exact name, so filter here instead
+		query := url.Values{}
+		if pageToken != "" {
+			query.Set("pageToken", pageToken)
+		}
+		var page struct {
+			Rrsets        []resourceRecordSet `json:"rrsets"`
+			NextPageToken string              `json:"nextPageToken"`
+		}
+		err = s.do(ctx, http.MethodGet, s.zonePath()+"/rrsets?"+query.Encode(), nil, &page)
+		if err != nil {
+			return nil, err
+		}
+		for _, rrset := range page.Rrsets {
+			if rrset.Type == "TXT" {
+				records[provider.Fqdn(rrset.Name)] = rrset
+			}
+		}
+		if page.NextPageToken == "" {
+			return records, nil
+		}
+		pageToken = page.NextPageToken
+	}
+}
+
+func (s *CloudDNSUpdater) zonePath() string {
+	return fmt.Sprintf("/projects/%s/managedZones/%s", s.Project, s.ManagedZone)
+}
+
+// do sends an authenticated request to the API and decodes the response into out
+func (s *CloudDNSUpdater) do(ctx context.Context, method string, path string, body interface{}, out interface{}) error {
+	if s.tokens == nil {
+		return fmt.Errorf("CloudDNSUpdater must be created with New")
+	}
+	token, err := s.tokens.Token(ctx)
+	if err != nil {
+		return err
+	}
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(s.Endpoint, "/")+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var apiErr apiError
+		_ = json.NewDecoder(resp.Body).Decode(&apiErr)
+		return fmt.Errorf("clouddns %v %v: %v: %v", method, path, resp.Status, apiErr.Error.Message)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func toRecord(rrset resourceRecordSet) provider.Record {
+	record := provider.Record{Name: provider.Fqdn(rrset.Name), TTL: rrset.TTL}
+	for _, value := range rrset.Rrdatas {
+		record.Values = append(record.Values, dns.UnquoteTXT(value))
+	}
+	return record
+}
+
+func (s *CloudDNSUpdater) logger() *slog.Logger {
+	return dns.LoggerOrDiscard(s.Logger)
+}
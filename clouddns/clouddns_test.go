@@ -0,0 +1,284 @@
+package clouddns
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	dns "github.com/searchspring.com/spf-flatten/dns"
+	"github.com/searchspring.com/spf-flatten/provider"
+	"github.com/searchspring.com/spf-flatten/provider/providertest"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	testKey     *rsa.PrivateKey
+	testKeyOnce sync.Once
+)
+
+func serviceAccountKey(t *testing.T) *rsa.PrivateKey {
+	testKeyOnce.Do(func() {
+		var err error
+		testKey, err = rsa.GenerateKey(rand.Reader, 2048)
+		require.Nil(t, err)
+	})
+	return testKey
+}
+
+// FakeCloudDNS is a local stand-in for the OAuth token endpoint and the Cloud DNS v1 API
+type FakeCloudDNS struct {
+	Key      *rsa.PublicKey
+	Project  string
+	Zones    []managedZone
+	PageSize int
+	Changes  []change
+	mu       sync.Mutex
+	rrsets   map[string]resourceRecordSet
+}
+
+func NewFakeCloudDNS(key *rsa.PublicKey, project string, zones ...managedZone) *FakeCloudDNS {
+	return &FakeCloudDNS{Key: key, Project: project, Zones: zones, PageSize: 2, rrsets: map[string]resourceRecordSet{}}
+}
+
+func (s *FakeCloudDNS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.URL.Path == "/token" {
+		s.token(w, r)
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer fake-access-token" {
+		writeError(w, http.StatusUnauthorized, "Request had invalid authentication credentials.")
+		return
+	}
+	prefix := fmt.Sprintf("/projects/%s/managedZones", s.Project)
+	path, found := strings.CutPrefix(r.URL.Path, prefix)
+	if !found {
+		writeError(w, http.StatusNotFound, "The requested project was not found.")
+		return
+	}
+	switch {
+	case path == "":
+		zones := []managedZone{}
+		for _, zone := range s.Zones {
+			if zone.DNSName == r.URL.Query().Get("dnsName") {
+				zones = append(zones, zone)
+			}
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"managedZones": zones})
+	case strings.HasSuffix(path, "/rrsets"):
+		s.list(w, r)
+	case strings.HasSuffix(path, "/changes") && r.Method == http.MethodPost:
+		var c change
+		_ = json.NewDecoder(r.Body).Decode(&c)
+		s.change(w, c)
+	default:
+		writeError(w, http.StatusNotFound, "Not found")
+	}
+}
+
+func (s *FakeCloudDNS) token(w http.ResponseWriter, r *http.Request) {
+	_ = r.ParseForm()
+	parts := strings.Split(r.Form.Get("assertion"), ".")
+	if r.Form.Get("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" || len(parts) != 3 {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	if rsa.VerifyPKCS1v15(s.Key, crypto.SHA256, digest[:], signature) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant", "error_description": "Invalid JWT Signature."})
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "fake-access-token", "expires_in": 3600, "token_type": "Bearer"})
+}
+
+func (s *FakeCloudDNS) list(w http.ResponseWriter, r *http.Request) {
+	var names []string
+	for name := range s.rrsets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	start := 0
+	if token := r.URL.Query().Get("pageToken"); token != "" {
+		fmt.Sscan(token, &start)
+	}
+	page := map[string]interface{}{"rrsets": []resourceRecordSet{}}
+	rrsets := []resourceRecordSet{}
+	for i := start; i < len(names) && i < start+s.PageSize; i++ {
+		rrsets = append(rrsets, s.rrsets[names[i]])
+	}
+	page["rrsets"] = rrsets
+	if start+s.PageSize < len(names) {
+		page["nextPageToken"] = fmt.Sprint(start + s.PageSize)
+	}
+	_ = json.NewEncoder(w).Encode(page)
+}
+
+// change applies deletions then additions atomically, rejecting the whole change if any part does not fit
+func (s *FakeCloudDNS) change(w http.ResponseWriter, c change) {
+	for _, deletion := range c.Deletions {
+		if !reflect.DeepEqual(s.rrsets[deletion.Name], deletion) {
+			writeError(w, http.StatusPreconditionFailed, fmt.Sprintf("Precondition not met for 'entity.change.deletions[%v]'", deletion.Name))
+			return
+		}
+	}
+	deleted := map[string]bool{}
+	for _, deletion := range c.Deletions {
+		deleted[deletion.Name] = true
+	}
+	for _, addition := range c.Additions {
+		if _, ok := s.rrsets[addition.Name]; ok && !deleted[addition.Name] {
+			writeError(w, http.StatusConflict, fmt.Sprintf("The resource 'entity.change.additions[%v]' already exists", addition.Name))
+			return
+		}
+	}
+	for _, deletion := range c.Deletions {
+		delete(s.rrsets, deletion.Name)
+	}
+	for _, addition := range c.Additions {
+		s.rrsets[addition.Name] = addition
+	}
+	s.Changes = append(s.Changes, c)
+	c.ID = fmt.Sprint(len(s.Changes))
+	c.Status = "done"
+	_ = json.NewEncoder(w).Encode(c)
+}
+
+func (s *FakeCloudDNS) Seed(records ...provider.Record) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, record := range records {
+		rrset := resourceRecordSet{Kind: "dns#resourceRecordSet", Name: record.Name, Type: "TXT", TTL: record.TTL}
+		for _, value := range record.Values {
+			rrset.Rrdatas = append(rrset.Rrdatas, dns.QuoteTXT(value))
+		}
+		s.rrsets[record.Name] = rrset
+	}
+}
+
+func (s *FakeCloudDNS) Records() []provider.Record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var records []provider.Record
+	for _, rrset := range s.rrsets {
+		if rrset.Type == "TXT" {
+			records = append(records, toRecord(rrset))
+		}
+	}
+	return records
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"error": map[string]interface{}{"code": status, "message": message}})
+}
+
+func credentialsJSON(t *testing.T, key *rsa.PrivateKey, tokenURI string) []byte {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.Nil(t, err)
+	credentials, err := json.Marshal(ServiceAccount{
+		Type:         "service_account",
+		ProjectID:    "spf-project",
+		PrivateKeyID: "key1",
+		PrivateKey:   string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		ClientEmail:  "spf-flatten@spf-project.iam.gserviceaccount.com",
+		TokenURI:     tokenURI,
+	})
+	require.Nil(t, err)
+	return credentials
+}
+
+func newTestUpdater(t *testing.T, fake *FakeCloudDNS) CloudDNSUpdater {
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	updater, err := New(CloudDNSUpdater{
+		UpdateDomain:    providertest.Domain,
+		CredentialsJSON: credentialsJSON(t, serviceAccountKey(t), server.URL+"/token"),
+		Endpoint:        server.URL,
+	})
+	require.Nil(t, err)
+	return updater
+}
+
+func TestPublisherConformance(t *testing.T) {
+	providertest.Run(t, func(t *testing.T) providertest.Harness {
+		fake := NewFakeCloudDNS(&serviceAccountKey(t).PublicKey, "spf-project", managedZone{Name: "example-com", DNSName: "example.com."})
+		updater := newTestUpdater(t, fake)
+		return providertest.Harness{Publisher: &updater, Seed: fake.Seed, Records: fake.Records}
+	})
+}
+
+func TestPublishIsOneChange(t *testing.T) {
+	fake := NewFakeCloudDNS(&serviceAccountKey(t).PublicKey, "spf-project", managedZone{Name: "example-com", DNSName: "example.com."})
+	fake.Seed(
+		provider.Record{Name: "example.com.", TTL: 300, Values: []string{"v=spf1 include:_spf1.example.com include:_spf2.example.com ~all"}},
+		provider.Record{Name: "_spf1.example.com.", TTL: 300, Values: []string{"v=spf1 ip4:192.0.2.1 ~all"}},
+		provider.Record{Name: "_spf2.example.com.", TTL: 300, Values: []string{"v=spf1 ip4:192.0.2.2 ~all"}},
+	)
+	updater := newTestUpdater(t, fake)
+	_, err := provider.Publish(context.TODO(), &updater, "example.com", map[string]string{
+		"example.com":       "v=spf1 include:_spf1.example.com ~all",
+		"_spf1.example.com": "v=spf1 ip4:192.0.2.3 ~all",
+	}, provider.PlanOptions{})
+	require.Nil(t, err)
+	require.Len(t, fake.Changes, 1)
+	require.Len(t, fake.Changes[0].Additions, 2)
+	require.Len(t, fake.Changes[0].Deletions, 3)
+}
+
+func TestNew(t *testing.T) {
+	_, err := New(CloudDNSUpdater{UpdateDomain: "example.com"})
+	require.EqualError(t, err, "no Google Cloud service account credentials configured")
+
+	_, err = New(CloudDNSUpdater{CredentialsJSON: []byte(`{"type": "authorized_user"}`)})
+	require.EqualError(t, err, `credentials are of type "authorized_user", expected service_account`)
+
+	updater, err := New(CloudDNSUpdater{CredentialsJSON: credentialsJSON(t, serviceAccountKey(t), "")})
+	require.Nil(t, err)
+	require.Equal(t, "spf-project", updater.Project)
+	require.Equal(t, DefaultEndpoint, updater.Endpoint)
+	require.Equal(t, DefaultTokenURL, updater.tokens.URL)
+}
+
+func TestResolveZone(t *testing.T) {
+	fake := NewFakeCloudDNS(&serviceAccountKey(t).PublicKey, "spf-project",
+		managedZone{Name: "example-com", DNSName: "example.com."},
+		managedZone{Name: "mail-example-com", DNSName: "mail.example.com."},
+	)
+	updater := newTestUpdater(t, fake)
+	updater.UpdateDomain = "news.mail.example.com"
+	err := updater.ResolveZone(context.TODO())
+	require.Nil(t, err)
+	require.Equal(t, "mail-example-com", updater.ManagedZone)
+
+	updater.ManagedZone = ""
+	updater.UpdateDomain = "example.org"
+	err = updater.ResolveZone(context.TODO())
+	require.EqualError(t, err, "no Cloud DNS managed zone found for example.org in project spf-project")
+}
+
+func TestTokenExchangeFailure(t *testing.T) {
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	fake := NewFakeCloudDNS(&other.PublicKey, "spf-project", managedZone{Name: "example-com", DNSName: "example.com."})
+	updater := newTestUpdater(t, fake)
+	_, err = updater.ListRecords(context.TODO(), "example.com")
+	require.ErrorContains(t, err, "Invalid JWT Signature.")
+}
@@ -0,0 +1,323 @@
+package cloudflare
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	dns "github.com/searchspring.com/spf-flatten/dns"
+	"github.com/searchspring.com/spf-flatten/provider"
+)
+
+const DefaultEndpoint = "https://api.cloudflare.com/client/v4"
+
+// Cloudflare caps per_page for DNS records at 5000, 100 keeps responses small
+const DefaultPerPage = 100
+
+type CloudflareUpdater struct {
+	UpdateDomain string
+	// ZoneID is looked up from UpdateDomain when empty
+	ZoneID   string
+	APIToken string
+	// Naming picks out the leaf records of the domain, the default _spfN when empty
+	Naming dns.Naming
+	DryRun bool
+	// Logger gets what was published, or with DryRun would have been, nothing is logged when nil
+	Logger *slog.Logger
+	// Endpoint overrides the Cloudflare v4 API base URL, IE for a local stand-in
+	Endpoint   string
+	PerPage    int
+	HTTPClient *http.Client
+}
+
+var _ provider.Publisher = &CloudflareUpdater{}
+
+// dnsRecord is a single DNS record as the API represents it, each TXT value is its own record
+type dnsRecord struct {
+	ID      string `json:"id,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	TTL     int64  `json:"ttl"`
+}
+
+type zone struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type apiError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type response struct {
+	Success    bool            `json:"success"`
+	Errors     []apiError      `json:"errors"`
+	Result     json.RawMessage `json:"result"`
+	ResultInfo *struct {
+		Page       int `json:"page"`
+		TotalPages int `json:"total_pages"`
+	} `json:"result_info"`
+}
+
+func New(s CloudflareUpdater) (CloudflareUpdater, error) {
+	if s.APIToken == "" {
+		return s, fmt.Errorf("no Cloudflare API token configured")
+	}
+	if s.Endpoint == "" {
+		s.Endpoint = DefaultEndpoint
+	}
+	if s.PerPage == 0 {
+		s.PerPage = DefaultPerPage
+	}
+	if s.HTTPClient == nil {
+		s.HTTPClient = http.DefaultClient
+	}
+	return s, nil
+}
+
+// ResolveZone finds the most specific zone containing UpdateDomain when ZoneID is not set
+func (s *CloudflareUpdater) ResolveZone(ctx context.Context) error {
+	if s.ZoneID != "" {
+		return nil
+	}
+	labels := strings.Split(strings.TrimSuffix(provider.Fqdn(s.UpdateDomain), "."), ".")
+	for i := range labels {
+		candidate := strings.Join(labels[i:], ".")
+		var zones []zone
+		_, err := s.do(ctx, http.MethodGet, "/zones?"+url.Values{"name": {candidate}}.Encode(), nil, &zones)
+		if err != nil {
+			return err
+		}
+		if len(zones) > 0 {
+			s.ZoneID = zones[0].ID
+			return nil
+		}
+	}
+	return fmt.Errorf("no Cloudflare zone found for %v", s.UpdateDomain)
+}
+
+// ListRecords returns the TXT record sets of domain and its _spfN leaves
+func (s *CloudflareUpdater) ListRecords(ctx context.Context, domain string) ([]provider.Record, error) {
+	records, err := s.listTXT(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]*provider.Record)
+	var names []string
+	for _, rec := range records {
+		name := provider.Fqdn(rec.Name)
+		if name != provider.Fqdn(domain) && !s.Naming.IsLeaf(name, domain) {
+			continue
+		}
+		if byName[name] == nil {
+			byName[name] = &provider.Record{Name: name, TTL: rec.TTL}
+			names = append(names, name)
+		}
+		byName[name].Values = append(byName[name].Values, dns.UnquoteTXT(rec.Content))
+	}
+	recordSets := make([]provider.Record, 0, len(names))
+	for _, name := range names {
+		recordSets = append(recordSets, *byName[name])
+	}
+	return recordSets, nil
+}
+
+// Apply makes the TXT records at each name match the change, reusing existing records where it can
+func (s *CloudflareUpdater) Apply(ctx context.Context, changes provider.ChangeSet) error {
+	for _, change := range changes {
+		name := strings.TrimSuffix(provider.Fqdn(change.Record.Name), ".")
+		existing, err := s.listTXT(ctx, name)
+		if err != nil {
+			return err
+		}
+
+		// Values that already exist only need their TTL checked
+		var missing []string
+		for _, value := range change.Record.Values {
+			i := indexOfContent(existing, value)
+			if i < 0 {
+				missing = append(missing, value)
+				continue
+			}
+			if existing[i].TTL != change.Record.TTL {
+				err = s.writeRecord(ctx, existing[i].ID, name, value, change.Record.TTL)
+				if err != nil {
+					return err
+				}
+			}
+			existing = append(existing[:i], existing[i+1:]...)
+		}
+
+		// Left over records are rewritten with the missing values before anything new is created
+		for _, value := range missing {
+			id := ""
+			if len(existing) > 0 {
+				id = existing[0].ID
+				existing = existing[1:]
+			}
+			err = s.writeRecord(ctx, id, name, value, change.Record.TTL)
+			if err != nil {
+				return err
+			}
+		}
+		for _, rec := range existing {
+			err = s.deleteRecord(ctx, rec.ID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// DeleteRecords removes every TXT record at the given names
+func (s *CloudflareUpdater) DeleteRecords(ctx context.Context, records []provider.Record) error {
+	for _, record := range records {
+		existing, err := s.listTXT(ctx, strings.TrimSuffix(provider.Fqdn(record.Name), "."))
+		if err != nil {
+			return err
+		}
+		for _, rec := range existing {
+			err = s.deleteRecord(ctx, rec.ID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// listTXT pages through the TXT records of the zone, all of them when name is empty
+func (s *CloudflareUpdater) listTXT(ctx context.Context, name string) ([]dnsRecord, error) {
+	err := s.ResolveZone(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var records []dnsRecord
+	for page := 1; ; page++ {
+		query := url.Values{
+			"type":     {"TXT"},
+			"page":     {fmt.Sprint(page)},
+			"per_page": {fmt.Sprint(s.perPage())},
+		}
+		if name != "" {
+			query.Set("name", name)
+		}
+		var result []dnsRecord
+		resp, err := s.do(ctx, http.MethodGet, fmt.Sprintf("/zones/%s/dns_records?%s", s.ZoneID, query.Encode()), nil, &result)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, result...)
+		if resp.ResultInfo == nil || page >= resp.ResultInfo.TotalPages {
+			return records, nil
+		}
+	}
+}
+
+// writeRecord updates the record with id, or creates a new one when id is empty
+func (s *CloudflareUpdater) writeRecord(ctx context.Context, id string, name string, value string, ttl int64) error {
+	body := dnsRecord{Type: "TXT", Name: name, Content: value, TTL: ttl}
+	if s.DryRun {
+		s.logger().Info("DryRun TXT record not updated", "domain", s.UpdateDomain, "record", name, "value", value, "ttl", ttl)
+		return nil
+	}
+	if id == "" {
+		_, err := s.do(ctx, http.MethodPost, fmt.Sprintf("/zones/%s/dns_records", s.ZoneID), body, nil)
+		return err
+	}
+	_, err := s.do(ctx, http.MethodPut, fmt.Sprintf("/zones/%s/dns_records/%s", s.ZoneID, id), body, nil)
+	return err
+}
+
+func (s *CloudflareUpdater) deleteRecord(ctx context.Context, id string) error {
+	if s.DryRun {
+		s.logger().Info("DryRun TXT record not deleted", "domain", s.UpdateDomain, "id", id)
+		return nil
+	}
+	_, err := s.do(ctx, http.MethodDelete, fmt.Sprintf("/zones/%s/dns_records/%s", s.ZoneID, id), nil, nil)
+	return err
+}
+
+// do sends a request to the API and decodes the result field into out
+func (s *CloudflareUpdater) do(ctx context.Context, method string, path string, body interface{}, out interface{}) (*response, error) {
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, s.endpoint()+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.APIToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := s.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	httpResp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	var resp response
+	err = json.NewDecoder(httpResp.Body).Decode(&resp)
+	if err != nil {
+		return nil, fmt.Errorf("cloudflare %v %v: %v: %v", method, path, httpResp.Status, err)
+	}
+	if !resp.Success || httpResp.StatusCode >= 300 {
+		messages := make([]string, 0, len(resp.Errors))
+		for _, e := range resp.Errors {
+			messages = append(messages, fmt.Sprintf("%d: %s", e.Code, e.Message))
+		}
+		return nil, fmt.Errorf("cloudflare %v %v: %v: %v", method, path, httpResp.Status, strings.Join(messages, ", "))
+	}
+	if out != nil && len(resp.Result) > 0 {
+		err = json.Unmarshal(resp.Result, out)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &resp, nil
+}
+
+func (s *CloudflareUpdater) endpoint() string {
+	if s.Endpoint == "" {
+		return DefaultEndpoint
+	}
+	return strings.TrimSuffix(s.Endpoint, "/")
+}
+
+func (s *CloudflareUpdater) perPage() int {
+	if s.PerPage == 0 {
+		return DefaultPerPage
+	}
+	return s.PerPage
+}
+
+func indexOfContent(records []dnsRecord, value string) int {
+	for i, rec := range records {
+		if dns.UnquoteTXT(rec.Content) == value {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *CloudflareUpdater) logger() *slog.Logger {
+	return dns.LoggerOrDiscard(s.Logger)
+}
@@ -0,0 +1,212 @@
+package cloudflare
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	dns "github.com/searchspring.com/spf-flatten/dns"
+	"github.com/searchspring.com/spf-flatten/provider"
+	"github.com/searchspring.com/spf-flatten/provider/providertest"
+	"github.com/stretchr/testify/require"
+)
+
+// FakeCloudflare is a local stand-in for the parts of the v4 API the updater uses
+type FakeCloudflare struct {
+	Token   string
+	Zones   []zone
+	mu      sync.Mutex
+	records map[string]dnsRecord
+	nextID  int
+}
+
+func NewFakeCloudflare(token string, zones ...zone) *FakeCloudflare {
+	return &FakeCloudflare{Token: token, Zones: zones, records: map[string]dnsRecord{}}
+}
+
+func (s *FakeCloudflare) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.Header.Get("Authorization") != "Bearer "+s.Token {
+		writeResponse(w, http.StatusForbidden, nil, nil, apiError{Code: 9109, Message: "Invalid access token"})
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "zones":
+		zones := []zone{}
+		for _, z := range s.Zones {
+			if z.Name == r.URL.Query().Get("name") {
+				zones = append(zones, z)
+			}
+		}
+		writeResponse(w, http.StatusOK, zones, nil)
+	case len(parts) == 3 && parts[2] == "dns_records" && r.Method == http.MethodGet:
+		s.list(w, r)
+	case len(parts) == 3 && parts[2] == "dns_records" && r.Method == http.MethodPost:
+		var rec dnsRecord
+		_ = json.NewDecoder(r.Body).Decode(&rec)
+		s.nextID++
+		rec.ID = fmt.Sprint(s.nextID)
+		s.records[rec.ID] = rec
+		writeResponse(w, http.StatusOK, rec, nil)
+	case len(parts) == 4 && r.Method == http.MethodPut:
+		if _, ok := s.records[parts[3]]; !ok {
+			writeResponse(w, http.StatusNotFound, nil, nil, apiError{Code: 81044, Message: "Record does not exist."})
+			return
+		}
+		var rec dnsRecord
+		_ = json.NewDecoder(r.Body).Decode(&rec)
+		rec.ID = parts[3]
+		s.records[rec.ID] = rec
+		writeResponse(w, http.StatusOK, rec, nil)
+	case len(parts) == 4 && r.Method == http.MethodDelete:
+		delete(s.records, parts[3])
+		writeResponse(w, http.StatusOK, map[string]string{"id": parts[3]}, nil)
+	default:
+		writeResponse(w, http.StatusNotFound, nil, nil, apiError{Code: 7003, Message: "No route for that URI"})
+	}
+}
+
+func (s *FakeCloudflare) list(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	matches := []dnsRecord{}
+	for _, rec := range s.records {
+		if rec.Type == query.Get("type") && (query.Get("name") == "" || rec.Name == query.Get("name")) {
+			matches = append(matches, rec)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].ID < matches[j].ID })
+	page, _ := strconv.Atoi(query.Get("page"))
+	perPage, _ := strconv.Atoi(query.Get("per_page"))
+	totalPages := (len(matches) + perPage - 1) / perPage
+	start := (page - 1) * perPage
+	end := start + perPage
+	if start > len(matches) {
+		start = len(matches)
+	}
+	if end > len(matches) {
+		end = len(matches)
+	}
+	writeResponse(w, http.StatusOK, matches[start:end], map[string]int{"page": page, "total_pages": totalPages})
+}
+
+func (s *FakeCloudflare) Seed(records ...provider.Record) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, record := range records {
+		for _, value := range record.Values {
+			s.nextID++
+			id := fmt.Sprint(s.nextID)
+			// The API hands TXT content back quoted
+			s.records[id] = dnsRecord{ID: id, Type: "TXT", Name: strings.TrimSuffix(record.Name, "."), Content: dns.QuoteTXT(value), TTL: record.TTL}
+		}
+	}
+}
+
+func (s *FakeCloudflare) Records() []provider.Record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	byName := map[string]*provider.Record{}
+	for _, rec := range s.records {
+		name := provider.Fqdn(rec.Name)
+		if byName[name] == nil {
+			byName[name] = &provider.Record{Name: name, TTL: rec.TTL}
+		}
+		byName[name].Values = append(byName[name].Values, dns.UnquoteTXT(rec.Content))
+	}
+	var records []provider.Record
+	for _, rec := range byName {
+		records = append(records, *rec)
+	}
+	return records
+}
+
+func writeResponse(w http.ResponseWriter, status int, result interface{}, resultInfo interface{}, errors ...apiError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":     len(errors) == 0,
+		"errors":      append([]apiError{}, errors...),
+		"result":      result,
+		"result_info": resultInfo,
+	})
+}
+
+func newTestUpdater(t *testing.T, fake *FakeCloudflare) CloudflareUpdater {
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	updater, err := New(CloudflareUpdater{
+		UpdateDomain: providertest.Domain,
+		APIToken:     fake.Token,
+		Endpoint:     server.URL,
+		// Small pages so the conformance suite exercises pagination
+		PerPage: 2,
+	})
+	require.Nil(t, err)
+	return updater
+}
+
+func TestPublisherConformance(t *testing.T) {
+	providertest.Run(t, func(t *testing.T) providertest.Harness {
+		fake := NewFakeCloudflare("token", zone{ID: "Z1", Name: "example.com"})
+		updater := newTestUpdater(t, fake)
+		return providertest.Harness{Publisher: &updater, Seed: fake.Seed, Records: fake.Records}
+	})
+}
+
+func TestNew(t *testing.T) {
+	_, err := New(CloudflareUpdater{UpdateDomain: "example.com"})
+	require.EqualError(t, err, "no Cloudflare API token configured")
+
+	updater, err := New(CloudflareUpdater{UpdateDomain: "example.com", APIToken: "token"})
+	require.Nil(t, err)
+	require.Equal(t, DefaultEndpoint, updater.Endpoint)
+	require.Equal(t, DefaultPerPage, updater.PerPage)
+}
+
+func TestResolveZone(t *testing.T) {
+	fake := NewFakeCloudflare("token", zone{ID: "Z1", Name: "example.com"}, zone{ID: "Z2", Name: "mail.example.com"})
+	updater := newTestUpdater(t, fake)
+
+	updater.UpdateDomain = "news.mail.example.com"
+	err := updater.ResolveZone(context.TODO())
+	require.Nil(t, err)
+	require.Equal(t, "Z2", updater.ZoneID)
+
+	updater.ZoneID = ""
+	updater.UpdateDomain = "www.example.com."
+	err = updater.ResolveZone(context.TODO())
+	require.Nil(t, err)
+	require.Equal(t, "Z1", updater.ZoneID)
+
+	updater.ZoneID = ""
+	updater.UpdateDomain = "example.org"
+	err = updater.ResolveZone(context.TODO())
+	require.EqualError(t, err, "no Cloudflare zone found for example.org")
+}
+
+func TestAPIErrors(t *testing.T) {
+	fake := NewFakeCloudflare("token", zone{ID: "Z1", Name: "example.com"})
+	updater := newTestUpdater(t, fake)
+	updater.APIToken = "wrong"
+	_, err := updater.ListRecords(context.TODO(), "example.com")
+	require.ErrorContains(t, err, "403 Forbidden: 9109: Invalid access token")
+}
+
+func TestDryRun(t *testing.T) {
+	fake := NewFakeCloudflare("token", zone{ID: "Z1", Name: "example.com"})
+	updater := newTestUpdater(t, fake)
+	updater.DryRun = true
+	diff, err := provider.Publish(context.TODO(), &updater, "example.com", map[string]string{"example.com": "v=spf1 -all"}, provider.PlanOptions{})
+	require.Nil(t, err)
+	require.Len(t, diff.Added, 1)
+	require.Empty(t, fake.Records())
+}
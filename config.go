@@ -0,0 +1,403 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	dns "github.com/searchspring.com/spf-flatten/dns"
+	"github.com/searchspring.com/spf-flatten/provider"
+	"gopkg.in/yaml.v3"
+)
+
+// target is a domain to manage as listed in the config file, anything it leaves out is taken from the defaults
+type target struct {
+	Template     string            `yaml:"template"`
+	Includes     []string          `yaml:"includes"`
+	IP4          []string          `yaml:"ip4"`
+	IP6          []string          `yaml:"ip6"`
+	A            []string          `yaml:"a"`
+	MX           []string          `yaml:"mx"`
+	UpdateDomain string            `yaml:"update_domain"`
+	Provider     string            `yaml:"provider"`
+	Zone         string            `yaml:"zone"`
+	All          string            `yaml:"all"`
+	TTL          int64             `yaml:"ttl"`
+	RootTTL      int64             `yaml:"root_ttl"`
+	TestIPs      []string          `yaml:"test_ips"`
+	Naming       string            `yaml:"naming"`
+	Schedule     string            `yaml:"schedule"`
+	Jitter       string            `yaml:"jitter"`
+	Settings     map[string]string `yaml:"settings"`
+
+	// line is where the target starts and lines where each of its fields was set, inherited ones pointing into the defaults
+	line  int
+	lines map[string]int
+}
+
+var targetFields = []string{"template", "includes", "ip4", "ip6", "a", "mx", "update_domain", "provider", "zone", "all", "ttl", "root_ttl", "test_ips", "naming", "schedule", "jitter", "settings"}
+
+// configErrors lists every problem found in a config file, one file:line: message per line
+type configErrors []string
+
+func (e configErrors) Error() string {
+	return strings.Join(e, "\n")
+}
+
+// configParser collects the problems in a config file
+type configParser struct {
+	file string
+	errs configErrors
+}
+
+// errorf notes a problem once, those in the defaults would otherwise repeat for every target inheriting them
+func (p *configParser) errorf(line int, format string, args ...interface{}) {
+	err := fmt.Sprintf("%v:%d: %v", p.file, line, fmt.Sprintf(format, args...))
+	if !contains(p.errs, err) {
+		p.errs = append(p.errs, err)
+	}
+}
+
+var yamlLine = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// yamlError reports an error from the YAML decoder against the line it names
+func (p *configParser) yamlError(err error) {
+	var typeErr *yaml.TypeError
+	messages := []string{err.Error()}
+	if errors.As(err, &typeErr) {
+		messages = typeErr.Errors
+	}
+	for _, message := range messages {
+		line := 0
+		if m := yamlLine.FindStringSubmatch(message); m != nil {
+			line, _ = strconv.Atoi(m[1])
+			message = m[2]
+		}
+		p.errorf(line, "%v", message)
+	}
+}
+
+// loadConfig reads and checks the targets of a config file before any of them is worked on
+func loadConfig(path string) ([]target, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(content, path)
+}
+
+func parseConfig(content []byte, file string) ([]target, error) {
+	p := &configParser{file: file}
+	var doc yaml.Node
+	err := yaml.Unmarshal(content, &doc)
+	if err != nil {
+		p.yamlError(err)
+		return nil, p.errs
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		p.errorf(doc.Line, "expected a mapping with defaults and targets")
+		return nil, p.errs
+	}
+
+	var defaults target
+	var targets []target
+	root := doc.Content[0]
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+		switch key.Value {
+		case "defaults":
+			defaults = p.decodeTarget(value)
+		case "targets":
+			if value.Kind != yaml.SequenceNode {
+				p.errorf(value.Line, "targets must be a list")
+				continue
+			}
+			for _, node := range value.Content {
+				targets = append(targets, p.decodeTarget(node))
+			}
+		default:
+			p.errorf(key.Line, "unknown field %q", key.Value)
+		}
+	}
+	if len(targets) == 0 && len(p.errs) == 0 {
+		p.errorf(root.Line, "no targets configured")
+	}
+
+	seen := map[string]int{}
+	for i := range targets {
+		targets[i].inherit(defaults)
+		p.check(targets[i], seen)
+	}
+	if len(p.errs) > 0 {
+		return nil, p.errs
+	}
+	return targets, nil
+}
+
+// decodeTarget reads a target noting the line of each field
+func (p *configParser) decodeTarget(node *yaml.Node) target {
+	t := target{line: node.Line, lines: map[string]int{}}
+	if node.Kind != yaml.MappingNode {
+		p.errorf(node.Line, "expected a mapping of target fields")
+		return t
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key := node.Content[i]
+		if !contains(targetFields, key.Value) {
+			p.errorf(key.Line, "unknown field %q", key.Value)
+			continue
+		}
+		t.lines[key.Value] = key.Line
+		if key.Value == "settings" && node.Content[i+1].Kind == yaml.MappingNode {
+			settings := node.Content[i+1].Content
+			for j := 0; j+1 < len(settings); j += 2 {
+				t.lines["settings."+settings[j].Value] = settings[j].Line
+			}
+		}
+	}
+	err := node.Decode(&t)
+	if err != nil {
+		p.yamlError(err)
+	}
+	return t
+}
+
+// inherit fills in whatever the target leaves out from the defaults
+func (t *target) inherit(d target) {
+	if t.Template == "" && !t.hasInline() {
+		t.Template, t.Includes, t.IP4, t.IP6, t.A, t.MX = d.Template, d.Includes, d.IP4, d.IP6, d.A, d.MX
+	}
+	for _, field := range []struct {
+		value    *string
+		fallback string
+	}{
+		{&t.UpdateDomain, d.UpdateDomain},
+		{&t.Provider, d.Provider},
+		{&t.Zone, d.Zone},
+		{&t.All, d.All},
+		{&t.Naming, d.Naming},
+		{&t.Schedule, d.Schedule},
+		{&t.Jitter, d.Jitter},
+	} {
+		if *field.value == "" {
+			*field.value = field.fallback
+		}
+	}
+	if t.TTL == 0 {
+		t.TTL = d.TTL
+	}
+	if t.RootTTL == 0 {
+		t.RootTTL = d.RootTTL
+	}
+	if len(t.TestIPs) == 0 {
+		t.TestIPs = d.TestIPs
+	}
+	merged := map[string]string{}
+	for k, v := range d.Settings {
+		merged[k] = v
+	}
+	for k, v := range t.Settings {
+		merged[k] = v
+	}
+	t.Settings = merged
+	for k, line := range d.lines {
+		if _, ok := t.lines[k]; !ok {
+			t.lines[k] = line
+		}
+	}
+}
+
+// lineOf gives where a field was set, or the start of the target
+func (t target) lineOf(field string) int {
+	if line, ok := t.lines[field]; ok {
+		return line
+	}
+	return t.line
+}
+
+// check validates a target once it has inherited the defaults
+func (p *configParser) check(t target, seen map[string]int) {
+	if t.UpdateDomain == "" {
+		p.errorf(t.line, "update_domain is required")
+	} else if line, ok := seen[provider.Fqdn(t.UpdateDomain)]; ok {
+		p.errorf(t.lineOf("update_domain"), "update_domain %v is already configured at line %d", t.UpdateDomain, line)
+	} else {
+		seen[provider.Fqdn(t.UpdateDomain)] = t.lineOf("update_domain")
+	}
+
+	switch {
+	case t.Template != "" && t.hasInline():
+		p.errorf(t.lineOf("template"), "set either template or inline mechanisms, not both")
+	case t.Template == "" && !t.hasInline():
+		p.errorf(t.line, "template or inline mechanisms such as includes are required")
+	}
+	for _, mechanisms := range t.inline() {
+		for _, value := range mechanisms.values {
+			err := checkMechanism(mechanisms.kind, value)
+			if err != nil {
+				p.errorf(t.lineOf(mechanisms.field), "%v", err)
+			}
+		}
+	}
+
+	name := t.Provider
+	if name == "" {
+		name = "route53"
+	}
+	if publisher, ok := providers[name]; !ok {
+		p.errorf(t.lineOf("provider"), "unknown provider %q", t.Provider)
+	} else if t.Zone != "" && publisher.zone == "" {
+		p.errorf(t.lineOf("zone"), "the %v provider has no zone to set", name)
+	}
+
+	err := checkAll(t.All)
+	if err != nil {
+		p.errorf(t.lineOf("all"), "%v", err)
+	}
+	if t.TTL < 0 {
+		p.errorf(t.lineOf("ttl"), "ttl must be a positive number of seconds")
+	}
+	if t.RootTTL < 0 {
+		p.errorf(t.lineOf("root_ttl"), "root_ttl must be a positive number of seconds")
+	}
+	if len(t.TestIPs) == 0 {
+		p.errorf(t.line, "test_ips is required")
+	}
+	for _, ip := range t.TestIPs {
+		if net.ParseIP(ip) == nil {
+			p.errorf(t.lineOf("test_ips"), "test_ips: %q is not an IP address", ip)
+		}
+	}
+	err = dns.Naming{Pattern: t.Naming}.Validate()
+	if err != nil {
+		p.errorf(t.lineOf("naming"), "%v", err)
+	}
+	_, err = parseSchedule(t.Schedule, "")
+	if err != nil {
+		p.errorf(t.lineOf("schedule"), "%v", err)
+	}
+	_, err = parseSchedule("", t.Jitter)
+	if err != nil {
+		p.errorf(t.lineOf("jitter"), "%v", err)
+	}
+	for k := range t.Settings {
+		if !isTargetSetting(k) {
+			p.errorf(t.lineOf("settings."+k), "unknown setting %q", k)
+		}
+	}
+}
+
+// isTargetSetting reports whether a target's settings may hold env, those of the providers and exports which have no field of their own
+func isTargetSetting(env string) bool {
+	if env == "PROVIDER" {
+		return false
+	}
+	for _, s := range concat(providerSettings, exportSettings) {
+		if s.env == env {
+			return true
+		}
+	}
+	return false
+}
+
+// settings gives the target's configuration on top of base, the command's flags and ENV variables
+func (t target) settings(base settings) settings {
+	s := settings{}
+	for k, v := range base {
+		s[k] = v
+	}
+	set := func(env string, value string) {
+		if value != "" {
+			s[env] = value
+		}
+	}
+	// The target's template replaces any given on the command line, be it a domain or inline
+	delete(s, templateDomain.env)
+	for _, st := range inlineSettings {
+		delete(s, st.env)
+	}
+	set(templateDomain.env, t.Template)
+	for _, mechanisms := range t.inline() {
+		var values []string
+		for _, value := range mechanisms.values {
+			// An empty a or mx is the record's own domain, which a space separated setting cannot hold
+			if value == "" {
+				value = currentDomain
+			}
+			values = append(values, value)
+		}
+		set(mechanisms.setting.env, strings.Join(values, " "))
+	}
+	set(updateDomain.env, t.UpdateDomain)
+	set("PROVIDER", t.Provider)
+	set("ALL_QUALIFIER", t.All)
+	set("LEAF_NAMING", t.Naming)
+	set(testIP.env, strings.Join(t.TestIPs, " "))
+	set(scheduleSetting.env, t.Schedule)
+	set(jitterSetting.env, t.Jitter)
+	if t.TTL > 0 {
+		s["TTL"] = strconv.FormatInt(t.TTL, 10)
+	}
+	if t.RootTTL > 0 {
+		s["ROOT_TTL"] = strconv.FormatInt(t.RootTTL, 10)
+	}
+	for k, v := range t.Settings {
+		s[k] = v
+	}
+	if t.Zone != "" {
+		s[providers[providerName(s)].zone] = t.Zone
+	}
+	return s
+}
+
+// inlineMechanisms are the values of one kind of mechanism in a target's inline template
+type inlineMechanisms struct {
+	field   string
+	kind    string
+	setting setting
+	values  []string
+}
+
+func (t target) inline() []inlineMechanisms {
+	var all []inlineMechanisms
+	for i, values := range [][]string{t.Includes, t.IP4, t.IP6, t.A, t.MX} {
+		st := inlineSettings[i]
+		field := st.flag()
+		if field == "include" {
+			field = "includes"
+		}
+		all = append(all, inlineMechanisms{field: field, kind: st.flag(), setting: st, values: values})
+	}
+	return all
+}
+
+func (t target) hasInline() bool {
+	for _, mechanisms := range t.inline() {
+		if len(mechanisms.values) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAll validates the term ending every generated record
+func checkAll(all string) error {
+	switch all {
+	case "", "~all", "-all", "?all":
+		return nil
+	}
+	return fmt.Errorf("all must be ~all, -all or ?all, not %q", all)
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testConfig = `# sending domains
+defaults:
+  provider: zonefile
+  template: template.example.com
+  all: -all
+  ttl: 600
+  test_ips: [192.0.2.10]
+  settings:
+    ZONEFILE_PATH: /dev/null
+targets:
+  - update_domain: example.org
+  - update_domain: example.net
+    includes: [_spf.vendor.com]
+    ip4: [203.0.113.0/24, 198.51.100.1]
+    naming: "{n}._spf"
+    ttl: 60
+    root_ttl: 3600
+    test_ips: [192.0.2.11, 2001:db8::1]
+    provider: route53
+    zone: Z123
+    settings:
+      AWS_REGION: us-east-1
+`
+
+func TestParseConfig(t *testing.T) {
+	targets, err := parseConfig([]byte(testConfig), "spf.yaml")
+	require.Nil(t, err)
+	require.Len(t, targets, 2)
+
+	require.Equal(t, settings{
+		"TEMPLATE_DOMAIN": "template.example.com",
+		"UPDATE_DOMAIN":   "example.org",
+		"PROVIDER":        "zonefile",
+		"ALL_QUALIFIER":   "-all",
+		"TTL":             "600",
+		"TEST_IP":         "192.0.2.10",
+		"ZONEFILE_PATH":   "/dev/null",
+	}, targets[0].settings(settings{}))
+
+	require.Equal(t, settings{
+		"TEMPLATE_INCLUDE": "_spf.vendor.com",
+		"TEMPLATE_IP4":     "203.0.113.0/24 198.51.100.1",
+		"UPDATE_DOMAIN":    "example.net",
+		"PROVIDER":         "route53",
+		"ALL_QUALIFIER":    "-all",
+		"LEAF_NAMING":      "{n}._spf",
+		"TTL":              "60",
+		"ROOT_TTL":         "3600",
+		"TEST_IP":          "192.0.2.11 2001:db8::1",
+		"ZONEFILE_PATH":    "/dev/null",
+		"AWS_REGION":       "us-east-1",
+		"ZONEID":           "Z123",
+		"ROLE_ARN":         "arn:aws:iam::123456789012:role/spf",
+	}, targets[1].settings(settings{"TEMPLATE_DOMAIN": "other.example.com", "TEMPLATE_MX": "example.net", "ROLE_ARN": "arn:aws:iam::123456789012:role/spf"}))
+}
+
+func TestConfigBareMechanisms(t *testing.T) {
+	targets, err := parseConfig([]byte(`targets:
+  - update_domain: example.org
+    test_ips: [192.0.2.10]
+    a: [""]
+    mx: ["/24", mail.example.org]
+`), "spf.yaml")
+	require.Nil(t, err)
+	s := targets[0].settings(settings{})
+	require.Equal(t, "@", s["TEMPLATE_A"])
+	require.Equal(t, "/24 mail.example.org", s["TEMPLATE_MX"])
+	record, err := inlineTemplate(s)
+	require.Nil(t, err)
+	require.Equal(t, []string{"a:example.org", "mx:example.org/24", "mx:mail.example.org"}, record.Mechanisms)
+}
+
+func TestParseJSONConfig(t *testing.T) {
+	targets, err := parseConfig([]byte(`{
+  "targets": [
+    {"template": "template.example.com", "update_domain": "example.org", "test_ips": ["192.0.2.10"]}
+  ]
+}`), "spf.json")
+	require.Nil(t, err)
+	require.Equal(t, "example.org", targets[0].UpdateDomain)
+}
+
+func TestConfigErrors(t *testing.T) {
+	_, err := parseConfig([]byte(`defaults:
+  all: +all
+  test_ips: [192.0.2.300]
+  providr: route53
+targets:
+  - update_domain: example.org
+    template: template.example.com
+    ip6: [192.0.2.1]
+    ttl: soon
+  - update_domain: Example.org.
+    template: template.example.com
+    provider: zonefile
+    zone: example.org
+    naming: _spf
+    settings:
+      TEMPLATE_DOMAIN: other.example.com
+  - test_ips: [192.0.2.10]
+extra: true
+`), "spf.yaml")
+	require.EqualError(t, err, `spf.yaml:4: unknown field "providr"
+spf.yaml:9: cannot unmarshal !!str `+"`soon`"+` into int64
+spf.yaml:18: unknown field "extra"
+spf.yaml:7: set either template or inline mechanisms, not both
+spf.yaml:8: ip6: "192.0.2.1" is not an IPv6 address or range
+spf.yaml:2: all must be ~all, -all or ?all, not "+all"
+spf.yaml:3: test_ips: "192.0.2.300" is not an IP address
+spf.yaml:10: update_domain Example.org. is already configured at line 6
+spf.yaml:13: the zonefile provider has no zone to set
+spf.yaml:14: naming "_spf" must hold {n} exactly once
+spf.yaml:16: unknown setting "TEMPLATE_DOMAIN"
+spf.yaml:17: update_domain is required
+spf.yaml:17: template or inline mechanisms such as includes are required`)
+
+	_, err = parseConfig([]byte("targets:\n  - update_domain: [example.org\n"), "spf.yaml")
+	require.EqualError(t, err, "spf.yaml:1: did not find expected ',' or ']'")
+
+	_, err = parseConfig([]byte(`targets:
+  - update_domain: example.org
+    template: template.example.com
+    test_ips: [192.0.2.10]
+    schedule: hourly
+    jitter: -5m
+`), "spf.yaml")
+	require.EqualError(t, err, `spf.yaml:5: schedule "hourly" is neither an interval such as 1h nor a cron expression: expected exactly 5 fields, found 1: [hourly]
+spf.yaml:6: jitter "-5m" must be a duration such as 5m`)
+
+	_, err = parseConfig([]byte("targets: []\n"), "spf.yaml")
+	require.EqualError(t, err, "spf.yaml:1: no targets configured")
+}
+
+func TestRunConfig(t *testing.T) {
+	withTemplate(t, template)
+	dir := t.TempDir()
+	config := filepath.Join(dir, "spf.yaml")
+	require.Nil(t, os.WriteFile(config, []byte(`defaults:
+  template: template.example.com
+  provider: zonefile
+  test_ips: [192.0.2.10]
+targets:
+  - update_domain: example.org
+    settings:
+      ZONEFILE_PATH: `+filepath.Join(dir, "org.zone")+`
+  - update_domain: example.net
+    template: missing.example.com
+  - update_domain: example.com
+    includes: [_spf.vendor.com]
+    all: -all
+    settings:
+      ZONEFILE_PATH: `+filepath.Join(dir, "com.zone")+`
+`), 0644))
+
+	code, stdout, stderr := runCLI("plan", "--config", config)
+	require.Equal(t, exitError, code)
+	require.Contains(t, stdout, "# example.org\n+ _spf1.example.org.\t300\tTXT\tv=spf1 ip4:192.0.2.0/24 ip6:2001:db8::/32 a:mail.vendor.com ip4:203.0.113.1 ~all\n")
+	require.Contains(t, stdout, "# example.net\n# example.com\n+ _spf1.example.com.\t300\tTXT\tv=spf1 ip4:192.0.2.0/24 ip6:2001:db8::/32 a:mail.vendor.com -all\n")
+	require.Equal(t, "spf-flatten plan example.net: looking up the template: no such host missing.example.com\n", stderr)
+
+	code, _, stderr = runCLI("plan", "--config", filepath.Join(dir, "missing.yaml"))
+	require.Equal(t, exitError, code)
+	require.Contains(t, stderr, "missing.yaml: no such file or directory")
+}
+
+func TestConfigRoute53Credentials(t *testing.T) {
+	targets, err := parseConfig([]byte(`defaults:
+  template: template.example.com
+  test_ips: [192.0.2.10]
+  settings:
+    AWS_REGION: us-east-1
+targets:
+  - update_domain: example.org
+    settings:
+      AWS_PROFILE: dns-admin
+      ROLE_SESSION_NAME: spf-example-org
+  - update_domain: example.net
+    settings:
+      AWS_ACCESS_KEY_ID: AKIDEXAMPLE
+      AWS_SECRET_ACCESS_KEY: secret
+`), "spf.yaml")
+	require.Nil(t, err)
+
+	updater, err := route53Updater(targets[0].settings(settings{"ROLE_ARN": "arn:aws:iam::123456789012:role/spf"}), "example.org", false, nil)
+	require.Nil(t, err)
+	require.Equal(t, "dns-admin", updater.Profile)
+	require.Equal(t, "spf-example-org", updater.RoleSessionName)
+	require.Equal(t, "arn:aws:iam::123456789012:role/spf", updater.RoleARN)
+	require.Equal(t, "", updater.AccessKeyID)
+
+	updater, err = route53Updater(targets[1].settings(settings{}), "example.net", false, nil)
+	require.Nil(t, err)
+	require.Equal(t, "", updater.Profile)
+	require.Equal(t, "AKIDEXAMPLE", updater.AccessKeyID)
+	require.Equal(t, "secret", updater.SecretAccessKey)
+}
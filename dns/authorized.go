@@ -0,0 +1,258 @@
+package dns
+
+import (
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+// AuthorizedChange is how the senders authorized through one include changed
+type AuthorizedChange struct {
+	// Source is the include the terms came through, empty for those whose origin is unknown
+	Source  string   `json:"source"`
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+}
+
+// Authorized maps each term of the tree that authorizes senders to the include of the root it came through, or the
+// root itself for its own terms. ip4 and ip6 ranges are in CIDR notation so the same range is always written the same way.
+func (i *Include) Authorized() map[string]string {
+	authorized := map[string]string{}
+	i.addTerms(i.Domain, authorized)
+	for _, child := range i.Includes {
+		child.addTree(child.Domain, authorized)
+	}
+	return authorized
+}
+
+// addTree notes the terms of the record and of every record it includes as coming through source
+func (i *Include) addTree(source string, authorized map[string]string) {
+	i.addTerms(source, authorized)
+	for _, child := range i.Includes {
+		child.addTree(source, authorized)
+	}
+}
+
+// addTerms notes the record's own terms, the first include a term comes through being its source
+func (i *Include) addTerms(source string, authorized map[string]string) {
+	for _, mech := range i.Mechanisms {
+		term, ok := canonicalTerm(mech)
+		if !ok {
+			continue
+		}
+		if _, seen := authorized[term]; !seen {
+			authorized[term] = source
+		}
+	}
+}
+
+// canonicalTerm gives the term as compared between trees, false for includes, all and modifiers which authorize no sender themselves
+func canonicalTerm(mech string) (string, bool) {
+	term := strings.ToLower(strings.TrimPrefix(mech, "+"))
+	name := strings.TrimLeft(term, "-~?")
+	switch {
+	case name == "" || name == "all" || strings.HasPrefix(name, "include:") || strings.Contains(name, "="):
+		return "", false
+	case strings.HasPrefix(name, "ip4:"), strings.HasPrefix(name, "ip6:"):
+		value := name[4:]
+		if !strings.Contains(value, "/") {
+			if strings.HasPrefix(name, "ip4:") {
+				value += "/32"
+			} else {
+				value += "/128"
+			}
+		}
+		if _, network, err := net.ParseCIDR(value); err == nil {
+			return term[:len(term)-len(name)] + name[:4] + network.String(), true
+		}
+	}
+	return term, true
+}
+
+// DiffAuthorized lists the senders authorized after but not before, and before but not after, grouped by the include
+// they came through. ip4 and ip6 ranges are compared as sets of addresses, so splitting or joining ranges changes nothing
+// and a range that shrinks or grows gives only the addresses lost or gained. Other terms are compared as written.
+// Groups are in order of source, those of unknown origin last.
+func DiffAuthorized(before map[string]string, after map[string]string) []AuthorizedChange {
+	groups := map[string]*AuthorizedChange{}
+	group := func(source string) *AuthorizedChange {
+		if groups[source] == nil {
+			groups[source] = &AuthorizedChange{Source: source}
+		}
+		return groups[source]
+	}
+	for term, source := range after {
+		if _, _, isIP := ipTerm(term); isIP {
+			continue
+		}
+		if _, ok := before[term]; !ok {
+			g := group(source)
+			g.Added = append(g.Added, term)
+		}
+	}
+	for term, source := range before {
+		if _, _, isIP := ipTerm(term); isIP {
+			continue
+		}
+		if _, ok := after[term]; !ok {
+			g := group(source)
+			g.Removed = append(g.Removed, term)
+		}
+	}
+
+	beforeRanges, afterRanges := ipRanges(before), ipRanges(after)
+	for qualifier, ranges := range afterRanges {
+		for _, r := range ranges {
+			for _, gained := range subtract(r.prefix, beforeRanges[qualifier].prefixes()) {
+				g := group(r.source)
+				g.Added = append(g.Added, qualifier+formatIPTerm(gained))
+			}
+		}
+	}
+	for qualifier, ranges := range beforeRanges {
+		for _, r := range ranges {
+			for _, lost := range subtract(r.prefix, afterRanges[qualifier].prefixes()) {
+				g := group(r.source)
+				g.Removed = append(g.Removed, qualifier+formatIPTerm(lost))
+			}
+		}
+	}
+
+	changes := make([]AuthorizedChange, 0, len(groups))
+	for _, g := range groups {
+		sort.Strings(g.Added)
+		sort.Strings(g.Removed)
+		changes = append(changes, *g)
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		if (changes[i].Source == "") != (changes[j].Source == "") {
+			return changes[j].Source == ""
+		}
+		return changes[i].Source < changes[j].Source
+	})
+	return changes
+}
+
+// Overlapping gives the source of the term of authorized that covers some of the same senders as term, the same term
+// or for ip4 and ip6 an overlapping range with the same qualifier. Empty when there is none.
+func Overlapping(term string, authorized map[string]string) string {
+	if source, ok := authorized[term]; ok {
+		return source
+	}
+	qualifier, prefix, isIP := ipTerm(term)
+	if !isIP {
+		return ""
+	}
+	var found []string
+	for other, source := range authorized {
+		q, p, ok := ipTerm(other)
+		if ok && q == qualifier && p.Overlaps(prefix) {
+			found = append(found, source)
+		}
+	}
+	if len(found) == 0 {
+		return ""
+	}
+	sort.Strings(found)
+	return found[0]
+}
+
+// ipRange is an ip4 or ip6 range and the include it came through
+type ipRange struct {
+	prefix netip.Prefix
+	source string
+}
+
+type ipRangeSet []ipRange
+
+func (set ipRangeSet) prefixes() []netip.Prefix {
+	prefixes := make([]netip.Prefix, len(set))
+	for i, r := range set {
+		prefixes[i] = r.prefix
+	}
+	return prefixes
+}
+
+// ipRanges gathers the ip4 and ip6 terms by qualifier, leaving out ranges inside another of the same qualifier
+func ipRanges(authorized map[string]string) map[string]ipRangeSet {
+	all := map[string]ipRangeSet{}
+	for term, source := range authorized {
+		if qualifier, prefix, ok := ipTerm(term); ok {
+			all[qualifier] = append(all[qualifier], ipRange{prefix: prefix, source: source})
+		}
+	}
+	ranges := map[string]ipRangeSet{}
+	for qualifier, set := range all {
+		// Widest first, so a range is only kept when none of those already kept covers it
+		sort.Slice(set, func(i, j int) bool {
+			if set[i].prefix.Bits() != set[j].prefix.Bits() {
+				return set[i].prefix.Bits() < set[j].prefix.Bits()
+			}
+			if set[i].prefix != set[j].prefix {
+				return set[i].prefix.Addr().Less(set[j].prefix.Addr())
+			}
+			return set[i].source < set[j].source
+		})
+		var kept ipRangeSet
+	next:
+		for _, r := range set {
+			for _, k := range kept {
+				if k.prefix.Overlaps(r.prefix) {
+					continue next
+				}
+			}
+			kept = append(kept, r)
+		}
+		ranges[qualifier] = kept
+	}
+	return ranges
+}
+
+// subtract gives the fewest ranges covering the addresses of prefix that none of others do
+func subtract(prefix netip.Prefix, others []netip.Prefix) []netip.Prefix {
+	var inside []netip.Prefix
+	for _, other := range others {
+		if !other.Overlaps(prefix) {
+			continue
+		}
+		if other.Bits() <= prefix.Bits() {
+			return nil
+		}
+		inside = append(inside, other)
+	}
+	if len(inside) == 0 {
+		return []netip.Prefix{prefix}
+	}
+	lower, upper := halves(prefix)
+	return append(subtract(lower, inside), subtract(upper, inside)...)
+}
+
+// halves splits a range into its lower and upper half
+func halves(prefix netip.Prefix) (netip.Prefix, netip.Prefix) {
+	bits := prefix.Bits()
+	addr := prefix.Addr().AsSlice()
+	addr[bits/8] |= 0x80 >> (bits % 8)
+	upper, _ := netip.AddrFromSlice(addr)
+	return netip.PrefixFrom(prefix.Addr(), bits+1), netip.PrefixFrom(upper, bits+1)
+}
+
+// ipTerm splits an ip4 or ip6 term as Authorized writes it into its qualifier and range, false for other terms
+func ipTerm(term string) (string, netip.Prefix, bool) {
+	name := strings.TrimLeft(term, "-~?")
+	if !strings.HasPrefix(name, "ip4:") && !strings.HasPrefix(name, "ip6:") {
+		return "", netip.Prefix{}, false
+	}
+	prefix, err := netip.ParsePrefix(name[4:])
+	if err != nil {
+		return "", netip.Prefix{}, false
+	}
+	return term[:len(term)-len(name)], prefix.Masked(), true
+}
+
+func formatIPTerm(prefix netip.Prefix) string {
+	if prefix.Addr().Is4() {
+		return "ip4:" + prefix.String()
+	}
+	return "ip6:" + prefix.String()
+}
@@ -3,6 +3,7 @@ package dns
 import (
 	"context"
 	"fmt"
+	"log/slog"
 	"net"
 	"strings"
 
@@ -16,11 +17,17 @@ type NetworkInterface interface {
 type DefaultNetworkInterface struct{}
 
 type DNS struct {
-	UpdateDomain   string
-	TestIP         string
+	UpdateDomain string
+	TestIP       string
+	// All ends every generated record, DefaultAll when empty
+	All string
+	// Naming is how the generated leaf records are named
+	Naming         Naming
 	NetworkHandler NetworkInterface
 	Records        []string
 	SPFRecord      *SPFRecord
+	// Logger gets the lookups and validation results at debug level, nothing is logged when nil
+	Logger *slog.Logger
 }
 
 // SPFRecord represents a parsed SPF record
@@ -50,26 +57,46 @@ func (s DNS) SplitSPFRecords(records []string) (txtRecs map[string]string) {
 	// build top level spf record and sub spf records
 	for len(records) > 0 {
 		rec, records = JoinStringsByBytes(records, 255)
-		spfSubdomain = fmt.Sprintf("_spf%d.%s", recnum, s.UpdateDomain)
-		txtRecs[spfSubdomain] = fmt.Sprintf("v=spf1 %v ~all", strings.Join(rec, " "))
+		spfSubdomain = s.Naming.Leaf(recnum, s.UpdateDomain)
+		txtRecs[spfSubdomain] = fmt.Sprintf("v=spf1 %v %v", strings.Join(rec, " "), s.all())
 		newSpfRec = fmt.Sprintf("%s include:%s", newSpfRec, spfSubdomain)
 		recnum = recnum + 1
 	}
-	txtRecs[s.UpdateDomain] = fmt.Sprintf("%s ~all", newSpfRec)
+	txtRecs[s.UpdateDomain] = fmt.Sprintf("%s %s", newSpfRec, s.all())
 	return
 }
 
+func (s DNS) all() string {
+	if s.All == "" {
+		return DefaultAll
+	}
+	return s.All
+}
+
+// IsSPFLeaf reports whether name is one of the _spfN records SplitSPFRecords generates for domain by default
+func IsSPFLeaf(name string, domain string) bool {
+	return Naming{}.IsLeaf(name, domain)
+}
+
 // Test individual SPF record for compliance https://tools.ietf.org/html/rfc7208
 func SPFRecordIsValid(dns *TestResolver, ip string, domain string) bool {
+	return DNS{}.recordIsValid(dns, ip, domain)
+}
+
+func (s DNS) recordIsValid(dns *TestResolver, ip string, domain string) bool {
 	ipaddr := net.ParseIP(ip)
 	result, err := spf.CheckHostWithSender(ipaddr, "helo", fmt.Sprintf("sender@%s", strings.Trim(domain, ".")), spf.WithResolver(dns))
 	if result == spf.Pass {
 		return true
 	}
-	fmt.Printf("IP: %v\nDomain: %v\nResult: %v\nError: %v\nDNS: %+v\n\n", ip, domain, result, err, dns)
+	s.logger().Debug("SPF check did not pass", "record", domain, "ip", ip, "result", string(result), "error", err)
 	return false
 }
 
+func (s DNS) logger() *slog.Logger {
+	return LoggerOrDiscard(s.Logger)
+}
+
 func extractIPAddressFromRecord(spfRecord string) net.IP {
 	for _, mech := range strings.Split(spfRecord, " ") {
 		if !(strings.HasPrefix(mech, "ip4:") || strings.HasPrefix(mech, "ip6:")) {
@@ -83,7 +110,7 @@ func extractIPAddressFromRecord(spfRecord string) net.IP {
 			var err error
 			ip, _, err = net.ParseCIDR(ipString)
 			if err != nil {
-				fmt.Println("Error parsing CIDR:", err)
+				// Validation then uses the test IP, which the broken range fails
 				break
 			}
 			ip[len(ip)-1]++
@@ -112,12 +139,10 @@ func (s DNS) SPFRecordsAreValid(txtRecs map[string]string) (bool, error) {
 			ipaddr = ip.String()
 		}
 		// Actually validate the record
-		if !SPFRecordIsValid(dnsRes, ipaddr, domain) {
-			fmt.Printf("%v:InValid\n", domain)
-			fmt.Printf("IPAddr:%v\n", ipaddr)
+		if !s.recordIsValid(dnsRes, ipaddr, domain) {
 			return false, fmt.Errorf("invalid record for domain: %v", domain)
 		}
-		fmt.Printf("%v:Valid\n", domain)
+		s.logger().Debug("SPF record valid", "record", domain, "ip", ipaddr)
 	}
 	return true, nil
 }
@@ -128,6 +153,7 @@ func (s DNS) DNSLookupSPF(domain string) (*SPFRecord, error) {
 	var spfRecord SPFRecord
 	txt, err := s.NetworkHandler.LookupTXT(context.TODO(), domain)
 	if err != nil {
+		s.logger().Debug("SPF lookup failed", "domain", domain, "error", err)
 		return &spfRecord, err
 	}
 	for _, ans := range txt {
@@ -140,25 +166,32 @@ func (s DNS) DNSLookupSPF(domain string) (*SPFRecord, error) {
 			}
 		}
 	}
+	s.logger().Debug("looked up SPF record", "domain", domain, "mechanisms", len(spfRecord.Mechanisms))
 	s.SPFRecord = &spfRecord
 	return s.SPFRecord, nil
 }
 
 // FlattenSPF flattens the SPF record by resolving included mechanisms
 func (s DNS) FlattenSPF(record SPFRecord) ([]string, error) {
+	return s.flattenSPF(record, nil)
+}
+
+// flattenSPF flattens a record reached through the chain of includes
+func (s DNS) flattenSPF(record SPFRecord, chain []string) ([]string, error) {
 	flattened := make([]string, 0)
 
 	for _, mech := range record.Mechanisms {
 		if strings.HasPrefix(mech, "include:") {
 			// Resolve included mechanism
 			includeDomain := strings.TrimPrefix(mech, "include:")
+			s.logger().Debug("flattening include", "domain", includeDomain, "chain", strings.Join(append(chain, includeDomain), " -> "))
 			includeRecord, err := s.DNSLookupSPF(includeDomain)
 			if err != nil {
 				return nil, err
 			}
 
 			// Recursively flatten included record
-			includeFlattened, err := s.FlattenSPF(*includeRecord)
+			includeFlattened, err := s.flattenSPF(*includeRecord, append(chain, includeDomain))
 			if err != nil {
 				return nil, err
 			}
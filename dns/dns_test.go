@@ -3,10 +3,14 @@ package dns
 import (
 	"context"
 	"fmt"
+	"log/slog"
 	"net"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	miekg "github.com/miekg/dns"
 	"github.com/stretchr/testify/require"
 )
 
@@ -248,6 +252,31 @@ func TestSplitSPFRecords(t *testing.T) {
 	}
 }
 
+func TestSplitSPFRecordsNaming(t *testing.T) {
+	dnsInstance := DNS{UpdateDomain: "example.com", All: "-all", Naming: Naming{Pattern: "{n}._spf"}}
+	result := dnsInstance.SplitSPFRecords([]string{"ip4:192.168.0.0/24"})
+	require.Equal(t, map[string]string{
+		"1._spf.example.com": "v=spf1 ip4:192.168.0.0/24 -all",
+		"example.com":        "v=spf1 include:1._spf.example.com -all",
+	}, result)
+}
+
+func TestNaming(t *testing.T) {
+	naming := Naming{Pattern: "Mail{n}-spf"}
+	require.Nil(t, naming.Validate())
+	require.Equal(t, "mail3-spf.example.com", naming.Leaf(3, "example.com"))
+	num, ok := naming.LeafNumber("MAIL12-spf.example.com.", "example.com")
+	require.True(t, ok)
+	require.Equal(t, 12, num)
+	require.False(t, naming.IsLeaf("mail-spf.example.com", "example.com"))
+	require.False(t, naming.IsLeaf("_spf1.example.com", "example.com"))
+	require.True(t, Naming{}.IsLeaf("_spf1.example.com", "example.com"))
+
+	require.EqualError(t, Naming{Pattern: "_spf"}.Validate(), `naming "_spf" must hold {n} exactly once`)
+	require.EqualError(t, Naming{Pattern: "{n}..spf"}.Validate(), `naming "{n}..spf" is not a valid relative domain name`)
+	require.EqualError(t, Naming{Pattern: "spf {n}"}.Validate(), `naming "spf {n}" is not a valid relative domain name`)
+}
+
 func TestExtractIPAddressFromSPF(t *testing.T) {
 	tests := []struct {
 		name       string
@@ -285,3 +314,192 @@ func TestExtractIPAddressFromSPF(t *testing.T) {
 		})
 	}
 }
+
+func TestQuoteTXT(t *testing.T) {
+	require.Equal(t, `"v=spf1 ip4:1.1.1.1 ~all"`, QuoteTXT("v=spf1 ip4:1.1.1.1 ~all"))
+	require.Equal(t, `"say \"hi\" \\o/"`, QuoteTXT(`say "hi" \o/`))
+
+	long := strings.Repeat("a", 300)
+	quoted := QuoteTXT(long)
+	require.Equal(t, `"`+strings.Repeat("a", 255)+`" "`+strings.Repeat("a", 45)+`"`, quoted)
+	require.Equal(t, long, UnquoteTXT(quoted))
+}
+
+func TestUnquoteTXT(t *testing.T) {
+	require.Equal(t, "v=spf1 ~all", UnquoteTXT(`"v=spf1 " "~all"`))
+	require.Equal(t, `say "hi" \o/`, UnquoteTXT(`"say \"hi\" \\o/"`))
+	require.Equal(t, "a;b", UnquoteTXT(`"a\059b"`))
+	require.Equal(t, "v=spf1 ~all", UnquoteTXT("v=spf1 ~all"))
+}
+
+func TestIsSPFLeaf(t *testing.T) {
+	require.True(t, IsSPFLeaf("_spf1.example.com", "example.com"))
+	require.True(t, IsSPFLeaf("_SPF12.example.com.", "example.com"))
+	require.False(t, IsSPFLeaf("_spf.example.com", "example.com"))
+	require.False(t, IsSPFLeaf("_spf1a.example.com", "example.com"))
+	require.False(t, IsSPFLeaf("_spf1.other.com", "example.com"))
+	require.False(t, IsSPFLeaf("example.com", "example.com"))
+}
+
+// ZoneNetworkHandler answers TXT lookups from a map of names to records
+type ZoneNetworkHandler map[string][]string
+
+func (s ZoneNetworkHandler) LookupTXT(cxt context.Context, host string) ([]string, error) {
+	if txt, ok := s[host]; ok {
+		return txt, nil
+	}
+	return nil, fmt.Errorf("Error: no such host")
+}
+
+func TestIncludeTree(t *testing.T) {
+	dns := DNS{NetworkHandler: ZoneNetworkHandler{
+		"example.com":       {"google-site-verification=abc", "v=spf1 include:_spf.vendor.com mx a:mail.example.com ip4:192.0.2.1 ~all"},
+		"_spf.vendor.com":   {"v=spf1 include:_net1.vendor.com include:_net2.vendor.com -all"},
+		"_net1.vendor.com":  {"v=spf1 ip4:198.51.100.0/24 -all"},
+		"_net2.vendor.com":  {"v=spf1 ip6:2001:db8::/32 exists:%{i}.vendor.com -all"},
+		"loop.example.com":  {"v=spf1 include:loop2.example.com ~all"},
+		"loop2.example.com": {"v=spf1 include:LOOP.example.com. ~all"},
+	}}
+	tree, err := dns.IncludeTree("example.com")
+	require.Nil(t, err)
+	require.Equal(t, "example.com", tree.Domain)
+	require.Equal(t, []string{"include:_spf.vendor.com", "mx", "a:mail.example.com", "ip4:192.0.2.1", "~all"}, tree.Mechanisms)
+	require.Len(t, tree.Includes, 1)
+	vendor := tree.Includes[0]
+	require.Equal(t, "_spf.vendor.com", vendor.Domain)
+	require.Equal(t, []string{"_net1.vendor.com", "_net2.vendor.com"}, []string{vendor.Includes[0].Domain, vendor.Includes[1].Domain})
+	require.Equal(t, 1, vendor.Includes[1].Lookups())
+	require.Equal(t, 3, vendor.Lookups())
+	require.Equal(t, 6, tree.Lookups())
+
+	_, err = dns.IncludeTree("loop.example.com")
+	require.EqualError(t, err, "include loop: loop.example.com -> loop2.example.com -> LOOP.example.com.")
+
+	_, err = dns.IncludeTree("_spf.other.com")
+	require.EqualError(t, err, "_spf.other.com: Error: no such host")
+}
+
+func TestAuthorized(t *testing.T) {
+	dns := DNS{NetworkHandler: ZoneNetworkHandler{
+		"example.com":      {"v=spf1 include:_spf.vendor.com include:_spf.other.com +mx ip4:192.0.2.1 ~all"},
+		"_spf.vendor.com":  {"v=spf1 include:_net1.vendor.com ip6:2001:DB8::1 -all"},
+		"_net1.vendor.com": {"v=spf1 ip4:198.51.100.7/24 -ip4:203.0.113.9 -all"},
+		"_spf.other.com":   {"v=spf1 ip4:192.0.2.1 redirect=_spf.vendor.com"},
+	}}
+	tree, err := dns.IncludeTree("example.com")
+	require.Nil(t, err)
+	require.Equal(t, map[string]string{
+		"mx":                  "example.com",
+		"ip4:192.0.2.1/32":    "example.com",
+		"ip6:2001:db8::1/128": "_spf.vendor.com",
+		"ip4:198.51.100.0/24": "_spf.vendor.com",
+		"-ip4:203.0.113.9/32": "_spf.vendor.com",
+	}, tree.Authorized())
+
+	changes := DiffAuthorized(map[string]string{
+		"ip4:192.0.2.1/32":    "",
+		"ip4:192.0.2.2/32":    "",
+		"ip4:198.51.100.0/24": "_spf1.example.com",
+	}, map[string]string{
+		"ip4:192.0.2.1/32":    "example.com",
+		"ip4:198.51.100.0/24": "_spf.vendor.com",
+		"ip4:203.0.113.0/24":  "_spf.vendor.com",
+		"ip4:203.0.113.9/32":  "_spf.vendor.com",
+		"a:mail.example.com":  "example.com",
+	})
+	require.Equal(t, []AuthorizedChange{
+		{Source: "_spf.vendor.com", Added: []string{"ip4:203.0.113.0/24"}},
+		{Source: "example.com", Added: []string{"a:mail.example.com"}},
+		{Source: "", Removed: []string{"ip4:192.0.2.2/32"}},
+	}, changes)
+	require.Empty(t, DiffAuthorized(tree.Authorized(), tree.Authorized()))
+
+	// Splitting and joining ranges authorizes the same senders, shrinking a range only loses what it no longer covers
+	require.Empty(t, DiffAuthorized(map[string]string{
+		"ip4:192.0.2.0/25":       "",
+		"ip4:192.0.2.128/25":     "",
+		"ip6:2001:db8::/33":      "",
+		"ip6:2001:db8:8000::/33": "",
+	}, map[string]string{
+		"ip4:192.0.2.0/24":  "_spf.vendor.com",
+		"ip4:192.0.2.7/32":  "example.com",
+		"ip6:2001:db8::/32": "_spf.vendor.com",
+	}))
+	require.Equal(t, []AuthorizedChange{
+		{Source: "_spf.vendor.com", Removed: []string{"ip4:198.51.100.0/25", "ip4:198.51.100.192/26"}},
+		{Source: "", Added: []string{"-ip4:198.51.100.0/24"}},
+	}, DiffAuthorized(map[string]string{
+		"ip4:198.51.100.0/24": "_spf.vendor.com",
+	}, map[string]string{
+		"ip4:198.51.100.128/26": "_spf.vendor.com",
+		"-ip4:198.51.100.0/24":  "",
+	}))
+
+	require.Equal(t, "_spf.vendor.com", Overlapping("ip4:198.51.100.128/25", tree.Authorized()))
+	require.Equal(t, "example.com", Overlapping("mx", tree.Authorized()))
+	require.Equal(t, "", Overlapping("ip4:203.0.113.9/32", tree.Authorized()))
+	require.Equal(t, "", Overlapping("a:mail.example.com", tree.Authorized()))
+}
+
+func TestLogger(t *testing.T) {
+	var logs strings.Builder
+	dns := DNS{
+		UpdateDomain: "example.com",
+		NetworkHandler: ZoneNetworkHandler{
+			"_spf.vendor.com":  {"v=spf1 include:_net1.vendor.com -all"},
+			"_net1.vendor.com": {"v=spf1 ip4:198.51.100.0/24 -all"},
+		},
+		Logger: slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})),
+	}
+	_, err := dns.FlattenSPF(SPFRecord{Mechanisms: []string{"include:_spf.vendor.com", "~all"}})
+	require.Nil(t, err)
+	require.Contains(t, logs.String(), `msg="flattening include" domain=_net1.vendor.com chain="_spf.vendor.com -> _net1.vendor.com"`)
+	require.Contains(t, logs.String(), `msg="looked up SPF record" domain=_spf.vendor.com mechanisms=2`)
+}
+
+func TestResolverTTL(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	started := make(chan struct{})
+	server := &miekg.Server{
+		PacketConn:        conn,
+		NotifyStartedFunc: func() { close(started) },
+		Handler: miekg.HandlerFunc(func(w miekg.ResponseWriter, r *miekg.Msg) {
+			resp := new(miekg.Msg)
+			resp.SetReply(r)
+			switch r.Question[0].Name {
+			case "_spf.vendor.com.":
+				resp.Answer = append(resp.Answer,
+					&miekg.TXT{Hdr: miekg.RR_Header{Name: r.Question[0].Name, Rrtype: miekg.TypeTXT, Class: miekg.ClassINET, Ttl: 3600}, Txt: []string{"v=spf1 ip4:192.0.2.0/24 ", "-all"}},
+					&miekg.TXT{Hdr: miekg.RR_Header{Name: r.Question[0].Name, Rrtype: miekg.TypeTXT, Class: miekg.ClassINET, Ttl: 300}, Txt: []string{"verification=abc"}},
+				)
+			case "_zero.vendor.com.":
+				resp.Answer = append(resp.Answer,
+					&miekg.TXT{Hdr: miekg.RR_Header{Name: r.Question[0].Name, Rrtype: miekg.TypeTXT, Class: miekg.ClassINET, Ttl: 0}, Txt: []string{`verification=\"a\\b c\"`}},
+					&miekg.TXT{Hdr: miekg.RR_Header{Name: r.Question[0].Name, Rrtype: miekg.TypeTXT, Class: miekg.ClassINET, Ttl: 300}, Txt: []string{"v=spf1 -all"}},
+				)
+			default:
+				resp.Rcode = miekg.RcodeNameError
+			}
+			_ = w.WriteMsg(resp)
+		}),
+	}
+	go func() { _ = server.ActivateAndServe() }()
+	<-started
+	t.Cleanup(func() { _ = server.Shutdown() })
+
+	resolver := Resolver{Server: conn.LocalAddr().String()}
+	txt, ttl, err := resolver.LookupTXTWithTTL(context.Background(), "_spf.vendor.com")
+	require.Nil(t, err)
+	require.Equal(t, []string{"v=spf1 ip4:192.0.2.0/24 -all", "verification=abc"}, txt)
+	require.Equal(t, 5*time.Minute, ttl)
+
+	// Quotes and backslashes come back unescaped, and an answer not to be cached at all is the lowest TTL
+	txt, ttl, err = resolver.LookupTXTWithTTL(context.Background(), "_zero.vendor.com")
+	require.Nil(t, err)
+	require.Equal(t, []string{`verification="a\b c"`, "v=spf1 -all"}, txt)
+	require.Equal(t, time.Duration(0), ttl)
+
+	_, err = resolver.LookupTXT(context.Background(), "missing.vendor.com")
+	require.EqualError(t, err, "lookup missing.vendor.com on "+conn.LocalAddr().String()+": nxdomain")
+}
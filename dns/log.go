@@ -0,0 +1,23 @@
+package dns
+
+import (
+	"context"
+	"log/slog"
+)
+
+// discardHandler drops every record, as slog.DiscardHandler does from Go 1.24
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+// LoggerOrDiscard gives logger, or one that drops everything when it is nil, so the packages of this module stay
+// silent when used as a library unless given a logger
+func LoggerOrDiscard(logger *slog.Logger) *slog.Logger {
+	if logger == nil {
+		return slog.New(discardHandler{})
+	}
+	return logger
+}
@@ -0,0 +1,72 @@
+package dns
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DefaultAll ends every generated record unless DNS.All says otherwise
+const DefaultAll = "~all"
+
+// DefaultLeafPattern names the leaf records _spf1, _spf2 and so on
+const DefaultLeafPattern = "_spf{n}"
+
+// Naming is how the leaf records SplitSPFRecords generates are named below the update domain
+type Naming struct {
+	// Pattern holds {n} where the leaf's number goes, IE _spf{n} or {n}._spf. DefaultLeafPattern when empty.
+	Pattern string `json:"pattern"`
+}
+
+func (n Naming) pattern() string {
+	if n.Pattern == "" {
+		return DefaultLeafPattern
+	}
+	return strings.ToLower(n.Pattern)
+}
+
+// Validate checks the pattern holds {n} once and is otherwise made of host name labels
+func (n Naming) Validate() error {
+	pattern := n.pattern()
+	if strings.Count(pattern, "{n}") != 1 {
+		return fmt.Errorf("naming %q must hold {n} exactly once", n.Pattern)
+	}
+	for _, label := range strings.Split(strings.Replace(pattern, "{n}", "1", 1), ".") {
+		if label == "" || len(label) > 63 || strings.Trim(label, "abcdefghijklmnopqrstuvwxyz0123456789_-") != "" {
+			return fmt.Errorf("naming %q is not a valid relative domain name", n.Pattern)
+		}
+	}
+	return nil
+}
+
+// Leaf gives the name of leaf number num of domain
+func (n Naming) Leaf(num int, domain string) string {
+	return strings.Replace(n.pattern(), "{n}", strconv.Itoa(num), 1) + "." + domain
+}
+
+// LeafNumber returns which leaf of domain name is, or false when name is not one of its leaves
+func (n Naming) LeafNumber(name string, domain string) (int, bool) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	relative, found := strings.CutSuffix(name, "."+domain)
+	if !found {
+		return 0, false
+	}
+	prefix, suffix, _ := strings.Cut(n.pattern(), "{n}")
+	num, found := strings.CutPrefix(relative, prefix)
+	if !found {
+		return 0, false
+	}
+	num, found = strings.CutSuffix(num, suffix)
+	if !found || num == "" || !isDigits(num) {
+		return 0, false
+	}
+	leaf, err := strconv.Atoi(num)
+	return leaf, err == nil
+}
+
+// IsLeaf reports whether name is one of the leaf records SplitSPFRecords generates for domain
+func (n Naming) IsLeaf(name string, domain string) bool {
+	_, ok := n.LeafNumber(name, domain)
+	return ok
+}
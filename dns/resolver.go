@@ -0,0 +1,95 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	miekg "github.com/miekg/dns"
+)
+
+// TTLNetworkInterface is a NetworkInterface that can also say how long its answers may be cached
+type TTLNetworkInterface interface {
+	NetworkInterface
+	LookupTXTWithTTL(ctx context.Context, host string) ([]string, time.Duration, error)
+}
+
+// NoTXTRecords is the Err of the net.DNSError Resolver gives for a name that exists but has no TXT records, NODATA
+const NoTXTRecords = "no TXT records"
+
+// Resolver asks a recursive nameserver for TXT records directly, unlike the system resolver it gives their TTL
+type Resolver struct {
+	// Server is the nameserver's host:port, the first in /etc/resolv.conf when empty
+	Server  string
+	Timeout time.Duration
+}
+
+var _ TTLNetworkInterface = Resolver{}
+
+func (r Resolver) LookupTXT(ctx context.Context, host string) ([]string, error) {
+	txt, _, err := r.LookupTXTWithTTL(ctx, host)
+	return txt, err
+}
+
+// LookupTXTWithTTL gives the TXT records of host, each joined from its strings, and the lowest TTL among them
+func (r Resolver) LookupTXTWithTTL(ctx context.Context, host string) ([]string, time.Duration, error) {
+	server, err := r.server()
+	if err != nil {
+		return nil, 0, err
+	}
+	m := new(miekg.Msg)
+	m.SetQuestion(miekg.Fqdn(host), miekg.TypeTXT)
+	m.RecursionDesired = true
+	client := &miekg.Client{Timeout: r.Timeout}
+	resp, _, err := client.ExchangeContext(ctx, m, server)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.Truncated {
+		client.Net = "tcp"
+		resp, _, err = client.ExchangeContext(ctx, m, server)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	if resp.Rcode != miekg.RcodeSuccess {
+		return nil, 0, &net.DNSError{Err: strings.ToLower(miekg.RcodeToString[resp.Rcode]), Name: host, Server: server, IsNotFound: resp.Rcode == miekg.RcodeNameError}
+	}
+
+	var txt []string
+	var ttl time.Duration
+	// A TTL of 0 is a real one, so whether there is a lowest yet is kept apart from it
+	found := false
+	for _, rr := range resp.Answer {
+		record, ok := rr.(*miekg.TXT)
+		if !ok {
+			continue
+		}
+		recordTTL := time.Duration(record.Hdr.Ttl) * time.Second
+		if !found || recordTTL < ttl {
+			ttl = recordTTL
+			found = true
+		}
+		txt = append(txt, JoinTXT(record.Txt))
+	}
+	if len(txt) == 0 {
+		return nil, 0, &net.DNSError{Err: NoTXTRecords, Name: host, Server: server, IsNotFound: true}
+	}
+	return txt, ttl, nil
+}
+
+func (r Resolver) server() (string, error) {
+	if r.Server != "" {
+		return r.Server, nil
+	}
+	config, err := miekg.ClientConfigFromFile("/etc/resolv.conf")
+	if err != nil {
+		return "", err
+	}
+	if len(config.Servers) == 0 {
+		return "", fmt.Errorf("no nameserver in /etc/resolv.conf")
+	}
+	return net.JoinHostPort(config.Servers[0], config.Port), nil
+}
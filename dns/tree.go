@@ -0,0 +1,88 @@
+package dns
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MaxLookups is how many DNS lookups RFC 7208 section 4.6.4 allows evaluating an SPF record to take
+const MaxLookups = 10
+
+// Include is an SPF record as published in DNS and the records it includes
+type Include struct {
+	Domain string `json:"domain"`
+	// Mechanisms are every term of the record after v=spf1, includes too
+	Mechanisms []string `json:"mechanisms"`
+	// Includes are the records of the include mechanisms, in order
+	Includes []*Include `json:"includes,omitempty"`
+}
+
+// IncludeTree looks up the SPF record of domain and, recursively, every record it includes
+func (s DNS) IncludeTree(domain string) (*Include, error) {
+	return s.includeTree(domain, nil)
+}
+
+func (s DNS) includeTree(domain string, path []string) (*Include, error) {
+	for _, parent := range path {
+		if strings.EqualFold(strings.TrimSuffix(parent, "."), strings.TrimSuffix(domain, ".")) {
+			return nil, fmt.Errorf("include loop: %v", strings.Join(append(path, domain), " -> "))
+		}
+	}
+	record, err := s.DNSLookupSPF(domain)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", domain, err)
+	}
+	include := &Include{Domain: domain, Mechanisms: record.Mechanisms}
+	for _, mech := range record.Mechanisms {
+		if !strings.HasPrefix(mech, "include:") {
+			continue
+		}
+		child, err := s.includeTree(strings.TrimPrefix(mech, "include:"), append(path, domain))
+		if err != nil {
+			return nil, err
+		}
+		include.Includes = append(include.Includes, child)
+	}
+	return include, nil
+}
+
+// Lookups counts the DNS lookups evaluating the record takes, including those of the records it includes
+func (i *Include) Lookups() int {
+	count := 0
+	for _, mech := range i.Mechanisms {
+		if costsLookup(mech) {
+			count++
+		}
+	}
+	for _, child := range i.Includes {
+		count += child.Lookups()
+	}
+	return count
+}
+
+// RecordsLookups counts the DNS lookups evaluating the records SplitSPFRecords generates takes, an include of each
+// leaf from the root and whatever the leaves hold that needs one
+func RecordsLookups(txtRecs map[string]string) int {
+	count := 0
+	for _, rec := range txtRecs {
+		for _, term := range strings.Fields(rec) {
+			if costsLookup(term) {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// costsLookup reports whether a term is one of those RFC 7208 counts towards the lookup limit
+func costsLookup(term string) bool {
+	name := strings.ToLower(strings.TrimLeft(term, "+-~?"))
+	if end := strings.IndexAny(name, ":/="); end >= 0 {
+		name = name[:end]
+	}
+	switch name {
+	case "include", "a", "mx", "ptr", "exists", "redirect":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+package dns
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Maximum length of a single character-string inside a TXT record https://tools.ietf.org/html/rfc1035#section-3.3
+const MaxTXTStringLength = 255
+
+// QuoteTXT renders a TXT value in presentation format, split into quoted character-strings of at most 255 bytes
+func QuoteTXT(value string) string {
+	chunks := SplitTXT(value)
+	for i, chunk := range chunks {
+		chunks[i] = `"` + EscapeTXT(chunk) + `"`
+	}
+	return strings.Join(chunks, " ")
+}
+
+// EscapeTXT escapes backslashes and quotes in a single character-string, without adding the surrounding quotes
+func EscapeTXT(chunk string) string {
+	chunk = strings.ReplaceAll(chunk, `\`, `\\`)
+	return strings.ReplaceAll(chunk, `"`, `\"`)
+}
+
+// SplitTXT splits a TXT value into character-strings of at most 255 bytes
+func SplitTXT(value string) []string {
+	chunks := []string{}
+	for len(value) > MaxTXTStringLength {
+		chunks = append(chunks, value[:MaxTXTStringLength])
+		value = value[MaxTXTStringLength:]
+	}
+	return append(chunks, value)
+}
+
+// UnquoteTXT reverses QuoteTXT, joining the character-strings back into a single value.
+// Values that are not quoted are returned unchanged.
+func UnquoteTXT(value string) string {
+	value = strings.TrimSpace(value)
+	if !strings.HasPrefix(value, `"`) {
+		return value
+	}
+	var b strings.Builder
+	inQuotes := false
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == '"':
+			inQuotes = !inQuotes
+		case !inQuotes:
+			// whitespace between character-strings
+		case c == '\\' && i+3 < len(value) && isDigits(value[i+1:i+4]):
+			// \DDD decimal escape
+			n, _ := strconv.Atoi(value[i+1 : i+4])
+			b.WriteByte(byte(n))
+			i += 3
+		case c == '\\' && i+1 < len(value):
+			b.WriteByte(value[i+1])
+			i++
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// JoinTXT joins the character-strings of a TXT record as miekg/dns presents them, undoing their escapes
+func JoinTXT(chunks []string) string {
+	var b strings.Builder
+	for _, chunk := range chunks {
+		b.WriteString(UnquoteTXT(`"` + chunk + `"`))
+	}
+	return b.String()
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/searchspring.com/spf-flatten/iac"
+)
+
+// Render the records as infrastructure as code in the named format, merged into existing when it is not nil
+func exportRecords(format string, updateDomain string, txtRecs map[string]string, opts iac.Options, existing []byte) ([]byte, error) {
+	if existing != nil {
+		switch format {
+		case "octodns":
+			return iac.MergeOctoDNS(existing, updateDomain, txtRecs, opts)
+		case "dnscontrol":
+			return iac.MergeDNSControl(existing, updateDomain, txtRecs, opts)
+		}
+		return nil, fmt.Errorf("EXPORT format %q cannot be merged into an existing file", format)
+	}
+	switch format {
+	case "terraform":
+		return iac.Terraform(updateDomain, txtRecs, opts), nil
+	case "terraform-json":
+		return iac.TerraformJSON(updateDomain, txtRecs, opts)
+	case "cloudformation":
+		return iac.CloudFormation(updateDomain, txtRecs, opts)
+	case "octodns":
+		return iac.OctoDNS(updateDomain, txtRecs, opts)
+	case "dnscontrol":
+		return iac.DNSControl(updateDomain, txtRecs, opts)
+	}
+	return nil, fmt.Errorf("unknown EXPORT format %q", format)
+}
+
+// Read the file an export is merged into
+func readExport(path string) ([]byte, error) {
+	if path == "" || path == "-" {
+		return nil, fmt.Errorf("EXPORT_MERGE needs EXPORT_PATH set to the file to merge into")
+	}
+	existing, err := os.ReadFile(path)
+	if existing == nil && err == nil {
+		existing = []byte{}
+	}
+	return existing, err
+}
+
+// Write an export to path, or stdout when path is empty
+func writeExport(stdout io.Writer, path string, content []byte) error {
+	if path == "" || path == "-" {
+		_, err := stdout.Write(content)
+		return err
+	}
+	return os.WriteFile(path, content, 0644)
+}
@@ -0,0 +1,245 @@
+// Package hook publishes through a team's own tooling, handing the records as JSON to an HTTP webhook
+// or to an executable on stdin.
+package hook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	dns "github.com/searchspring.com/spf-flatten/dns"
+	"github.com/searchspring.com/spf-flatten/provider"
+)
+
+const DefaultTimeout = time.Minute
+
+// Actions a hook is asked to perform
+const (
+	// List asks for the TXT records the hook already manages. An empty reply means none.
+	List = "list"
+	// Publish hands over the desired records along with what changed and what to delete
+	Publish = "publish"
+)
+
+// Request is the JSON document sent to the hook
+type Request struct {
+	Action string `json:"action"`
+	Domain string `json:"domain"`
+	// Records is the whole desired tree, root and leaves
+	Records []Record `json:"records,omitempty"`
+	// Changes are the records in Records that are new or differ from what the hook listed
+	Changes []Change `json:"changes,omitempty"`
+	// Deletions are _spfN leaves that are no longer wanted
+	Deletions []Record `json:"deletions,omitempty"`
+}
+
+// Response is the JSON document a hook replies to List with
+type Response struct {
+	Records []Record `json:"records"`
+}
+
+type Record struct {
+	Name   string   `json:"name"`
+	TTL    int64    `json:"ttl"`
+	Values []string `json:"values"`
+}
+
+type Change struct {
+	Action string `json:"action"`
+	Record
+}
+
+// HookUpdater sends requests to either a webhook URL or a local command. Success is a 2xx status or a zero exit code.
+type HookUpdater struct {
+	UpdateDomain string
+	// URL receives each request as a POST
+	URL string
+	// Token is sent as a bearer token to URL when set
+	Token string
+	// Command is run with each request on stdin and any reply on stdout
+	Command []string
+	Timeout time.Duration
+	// Naming picks out the leaf records of the domain, the default _spfN when empty
+	Naming dns.Naming
+	DryRun bool
+	// Logger gets what was published, or with DryRun would have been, nothing is logged when nil
+	Logger     *slog.Logger
+	HTTPClient *http.Client
+	listed     *listing
+}
+
+// listing is the tree the hook last reported, the base the desired records are built on
+type listing struct {
+	mu      sync.Mutex
+	records map[string]provider.Record
+}
+
+var _ provider.BatchPublisher = &HookUpdater{}
+
+func New(s HookUpdater) (HookUpdater, error) {
+	if (s.URL == "") == (len(s.Command) == 0) {
+		return s, fmt.Errorf("configure either a webhook URL or a command for the hook publisher")
+	}
+	if s.Timeout == 0 {
+		s.Timeout = DefaultTimeout
+	}
+	if s.HTTPClient == nil {
+		s.HTTPClient = http.DefaultClient
+	}
+	s.listed = &listing{}
+	return s, nil
+}
+
+// ListRecords asks the hook for the TXT records of domain and its _spfN leaves
+func (s *HookUpdater) ListRecords(ctx context.Context, domain string) ([]provider.Record, error) {
+	reply, err := s.send(ctx, Request{Action: List, Domain: provider.Fqdn(domain)})
+	if err != nil {
+		return nil, err
+	}
+	listed := make(map[string]provider.Record)
+	if len(bytes.TrimSpace(reply)) > 0 {
+		var resp Response
+		err = json.Unmarshal(reply, &resp)
+		if err != nil {
+			return nil, fmt.Errorf("hook list reply: %v", err)
+		}
+		for _, rec := range resp.Records {
+			name := provider.Fqdn(rec.Name)
+			if name == provider.Fqdn(domain) || s.Naming.IsLeaf(name, domain) {
+				listed[name] = provider.Record{Name: name, TTL: rec.TTL, Values: rec.Values}
+			}
+		}
+	}
+	s.listed.mu.Lock()
+	s.listed.records = listed
+	s.listed.mu.Unlock()
+
+	var records []provider.Record
+	for _, rec := range listed {
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+func (s *HookUpdater) Apply(ctx context.Context, changes provider.ChangeSet) error {
+	return s.ApplyBatch(ctx, changes, nil)
+}
+
+func (s *HookUpdater) DeleteRecords(ctx context.Context, records []provider.Record) error {
+	return s.ApplyBatch(ctx, nil, records)
+}
+
+// ApplyBatch sends one publish request holding the full desired tree
+func (s *HookUpdater) ApplyBatch(ctx context.Context, changes provider.ChangeSet, stale []provider.Record) error {
+	if s.listed == nil {
+		return fmt.Errorf("HookUpdater must be created with New")
+	}
+	req := Request{Action: Publish, Domain: provider.Fqdn(s.UpdateDomain)}
+	desired := make(map[string]provider.Record)
+	s.listed.mu.Lock()
+	for name, rec := range s.listed.records {
+		desired[name] = rec
+	}
+	s.listed.mu.Unlock()
+	for _, change := range changes {
+		rec := change.Record
+		rec.Name = provider.Fqdn(rec.Name)
+		desired[rec.Name] = rec
+		req.Changes = append(req.Changes, Change{Action: string(change.Action), Record: toRecord(rec)})
+	}
+	for _, rec := range stale {
+		rec.Name = provider.Fqdn(rec.Name)
+		delete(desired, rec.Name)
+		req.Deletions = append(req.Deletions, toRecord(rec))
+	}
+	for _, rec := range desired {
+		req.Records = append(req.Records, toRecord(rec))
+	}
+	sort.Slice(req.Records, func(i, j int) bool { return req.Records[i].Name < req.Records[j].Name })
+
+	if s.DryRun {
+		payload, _ := json.MarshalIndent(req, "", "  ")
+		s.logger().Info("DryRun TXT records not updated", "domain", s.UpdateDomain, "request", string(payload))
+		return nil
+	}
+	_, err := s.send(ctx, req)
+	if err != nil {
+		return err
+	}
+	s.listed.mu.Lock()
+	s.listed.records = desired
+	s.listed.mu.Unlock()
+	s.logger().Info("TXT records updated", "domain", s.UpdateDomain, "records", len(req.Records))
+	return nil
+}
+
+// send delivers a request to the webhook or command and returns its reply
+func (s *HookUpdater) send(ctx context.Context, req Request) ([]byte, error) {
+	if s.listed == nil {
+		return nil, fmt.Errorf("HookUpdater must be created with New")
+	}
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.Timeout)
+	defer cancel()
+	if s.URL != "" {
+		return s.post(ctx, req.Action, payload)
+	}
+	return s.run(ctx, req.Action, payload)
+}
+
+func (s *HookUpdater) post(ctx context.Context, action string, payload []byte) ([]byte, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if s.Token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+s.Token)
+	}
+	resp, err := s.HTTPClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("webhook %v failed: %v: %v", action, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+func (s *HookUpdater) run(ctx context.Context, action string, payload []byte) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, s.Command[0], s.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(payload)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf("hook %v %v failed: %v: %v", s.Command[0], action, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+func toRecord(rec provider.Record) Record {
+	return Record{Name: rec.Name, TTL: rec.TTL, Values: rec.Values}
+}
+
+func (s *HookUpdater) logger() *slog.Logger {
+	return dns.LoggerOrDiscard(s.Logger)
+}
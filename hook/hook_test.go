@@ -0,0 +1,239 @@
+package hook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/searchspring.com/spf-flatten/provider"
+	"github.com/searchspring.com/spf-flatten/provider/providertest"
+	"github.com/stretchr/testify/require"
+)
+
+// handle is what a well behaved hook does with a request, keeping its records in store
+func handle(store map[string]Record, req Request) Response {
+	if req.Action == List {
+		resp := Response{Records: []Record{}}
+		for _, rec := range store {
+			resp.Records = append(resp.Records, rec)
+		}
+		return resp
+	}
+	for _, rec := range req.Records {
+		store[rec.Name] = rec
+	}
+	for _, rec := range req.Deletions {
+		delete(store, rec.Name)
+	}
+	return Response{}
+}
+
+// FakeWebhook is a local webhook that needs a bearer token
+type FakeWebhook struct {
+	Token    string
+	Requests []Request
+	mu       sync.Mutex
+	store    map[string]Record
+}
+
+func NewFakeWebhook(token string) *FakeWebhook {
+	return &FakeWebhook{Token: token, store: map[string]Record{}}
+}
+
+func (s *FakeWebhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.Header.Get("Authorization") != "Bearer "+s.Token {
+		http.Error(w, "bad token", http.StatusForbidden)
+		return
+	}
+	var req Request
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.Requests = append(s.Requests, req)
+	resp := handle(s.store, req)
+	if req.Action == Publish {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func (s *FakeWebhook) Seed(records ...provider.Record) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, rec := range records {
+		s.store[rec.Name] = toRecord(rec)
+	}
+}
+
+func (s *FakeWebhook) Records() []provider.Record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fromStore(s.store)
+}
+
+func fromStore(store map[string]Record) []provider.Record {
+	var records []provider.Record
+	for _, rec := range store {
+		records = append(records, provider.Record{Name: rec.Name, TTL: rec.TTL, Values: rec.Values})
+	}
+	return records
+}
+
+// TestHelperProcess is the command the exec tests run, it keeps its records in the JSON file named by HOOK_STORE
+func TestHelperProcess(t *testing.T) {
+	path := os.Getenv("HOOK_STORE")
+	if path == "" {
+		return
+	}
+	if os.Getenv("HOOK_FAIL") != "" {
+		fmt.Fprintln(os.Stderr, "zone is locked")
+		os.Exit(3)
+	}
+	store := readStore(path)
+	var req Request
+	err := json.NewDecoder(os.Stdin).Decode(&req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	resp := handle(store, req)
+	if req.Action == List {
+		_ = json.NewEncoder(os.Stdout).Encode(resp)
+	}
+	writeStore(path, store)
+	os.Exit(0)
+}
+
+func readStore(path string) map[string]Record {
+	store := map[string]Record{}
+	content, err := os.ReadFile(path)
+	if err == nil {
+		_ = json.Unmarshal(content, &store)
+	}
+	return store
+}
+
+func writeStore(path string, store map[string]Record) {
+	content, _ := json.Marshal(store)
+	_ = os.WriteFile(path, content, 0600)
+}
+
+func newExecUpdater(t *testing.T, store string) HookUpdater {
+	t.Setenv("HOOK_STORE", store)
+	updater, err := New(HookUpdater{
+		UpdateDomain: providertest.Domain,
+		Command:      []string{os.Args[0], "-test.run=^TestHelperProcess$"},
+	})
+	require.Nil(t, err)
+	return updater
+}
+
+func newWebhookUpdater(t *testing.T, fake *FakeWebhook) HookUpdater {
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	updater, err := New(HookUpdater{UpdateDomain: providertest.Domain, URL: server.URL, Token: "secret"})
+	require.Nil(t, err)
+	return updater
+}
+
+func TestPublisherConformance(t *testing.T) {
+	t.Run("Webhook", func(t *testing.T) {
+		providertest.Run(t, func(t *testing.T) providertest.Harness {
+			fake := NewFakeWebhook("secret")
+			updater := newWebhookUpdater(t, fake)
+			return providertest.Harness{Publisher: &updater, Seed: fake.Seed, Records: fake.Records}
+		})
+	})
+	t.Run("Exec", func(t *testing.T) {
+		providertest.Run(t, func(t *testing.T) providertest.Harness {
+			store := filepath.Join(t.TempDir(), "store.json")
+			updater := newExecUpdater(t, store)
+			seed := func(records ...provider.Record) {
+				current := readStore(store)
+				for _, rec := range records {
+					current[rec.Name] = toRecord(rec)
+				}
+				writeStore(store, current)
+			}
+			return providertest.Harness{Publisher: &updater, Seed: seed, Records: func() []provider.Record { return fromStore(readStore(store)) }}
+		})
+	})
+}
+
+func TestPublishRequest(t *testing.T) {
+	fake := NewFakeWebhook("secret")
+	fake.Seed(
+		provider.Record{Name: "example.com.", TTL: 300, Values: []string{"v=spf1 include:_spf1.example.com include:_spf2.example.com ~all"}},
+		provider.Record{Name: "_spf1.example.com.", TTL: 300, Values: []string{"v=spf1 ip4:192.0.2.1 ~all"}},
+		provider.Record{Name: "_spf2.example.com.", TTL: 300, Values: []string{"v=spf1 ip4:192.0.2.2 ~all"}},
+	)
+	updater := newWebhookUpdater(t, fake)
+	_, err := provider.Publish(context.TODO(), &updater, "example.com", map[string]string{
+		"example.com":       "v=spf1 include:_spf1.example.com ~all",
+		"_spf1.example.com": "v=spf1 ip4:192.0.2.1 ~all",
+	}, provider.PlanOptions{})
+	require.Nil(t, err)
+	require.Len(t, fake.Requests, 2)
+	require.Equal(t, Request{
+		Action: Publish,
+		Domain: "example.com.",
+		Records: []Record{
+			{Name: "_spf1.example.com.", TTL: 300, Values: []string{"v=spf1 ip4:192.0.2.1 ~all"}},
+			{Name: "example.com.", TTL: 300, Values: []string{"v=spf1 include:_spf1.example.com ~all"}},
+		},
+		Changes: []Change{
+			{Action: "UPDATE", Record: Record{Name: "example.com.", TTL: 300, Values: []string{"v=spf1 include:_spf1.example.com ~all"}}},
+		},
+		Deletions: []Record{
+			{Name: "_spf2.example.com.", TTL: 300, Values: []string{"v=spf1 ip4:192.0.2.2 ~all"}},
+		},
+	}, fake.Requests[1])
+}
+
+func TestFailures(t *testing.T) {
+	fake := NewFakeWebhook("secret")
+	updater := newWebhookUpdater(t, fake)
+	updater.Token = "wrong"
+	_, err := updater.ListRecords(context.TODO(), "example.com")
+	require.EqualError(t, err, "webhook list failed: 403 Forbidden: bad token")
+
+	updater = newExecUpdater(t, filepath.Join(t.TempDir(), "store.json"))
+	t.Setenv("HOOK_FAIL", "true")
+	err = updater.Apply(context.TODO(), provider.ChangeSet{
+		{Action: provider.Create, Record: provider.Record{Name: "example.com.", TTL: 300, Values: []string{"v=spf1 -all"}}},
+	})
+	require.ErrorContains(t, err, "publish failed: exit status 3: zone is locked")
+}
+
+func TestEmptyListReply(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(server.Close)
+	updater, err := New(HookUpdater{UpdateDomain: "example.com", URL: server.URL})
+	require.Nil(t, err)
+	diff, err := provider.Publish(context.TODO(), &updater, "example.com", map[string]string{"example.com": "v=spf1 -all"}, provider.PlanOptions{})
+	require.Nil(t, err)
+	require.Len(t, diff.Added, 1)
+}
+
+func TestNew(t *testing.T) {
+	_, err := New(HookUpdater{})
+	require.EqualError(t, err, "configure either a webhook URL or a command for the hook publisher")
+
+	_, err = New(HookUpdater{URL: "http://127.0.0.1", Command: []string{"true"}})
+	require.EqualError(t, err, "configure either a webhook URL or a command for the hook publisher")
+
+	updater, err := New(HookUpdater{Command: []string{"true"}})
+	require.Nil(t, err)
+	require.Equal(t, DefaultTimeout, updater.Timeout)
+}
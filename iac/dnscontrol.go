@@ -0,0 +1,74 @@
+package iac
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Marker comments around the generated TXT() lines inside a DNSControl D() block
+const (
+	DNSControlBeginMarker = "// BEGIN spf-flatten"
+	DNSControlEndMarker   = "// END spf-flatten"
+)
+
+// DNSControl renders the records as TXT() lines for a DNSControl D() block, wrapped in the markers
+// MergeDNSControl looks for so the snippet can be pasted once and refreshed from then on
+func DNSControl(domain string, txtRecs map[string]string, opts Options) ([]byte, error) {
+	lines, err := dnsControlLines(domain, txtRecs, opts, "    ")
+	if err != nil {
+		return nil, err
+	}
+	return []byte("    " + DNSControlBeginMarker + "\n" + lines + "    " + DNSControlEndMarker + "\n"), nil
+}
+
+// MergeDNSControl replaces the lines between the markers of an existing dnsconfig.js, indenting them like the begin marker
+func MergeDNSControl(existing []byte, domain string, txtRecs map[string]string, opts Options) ([]byte, error) {
+	begin := bytes.Index(existing, []byte(DNSControlBeginMarker))
+	end := bytes.Index(existing, []byte(DNSControlEndMarker))
+	if begin < 0 || end < begin {
+		return nil, fmt.Errorf("DNSControl config has no %q and %q lines to write the records between", DNSControlBeginMarker, DNSControlEndMarker)
+	}
+	lineStart := bytes.LastIndexByte(existing[:begin], '\n') + 1
+	indent := string(existing[lineStart:begin])
+	if strings.TrimSpace(indent) != "" {
+		return nil, fmt.Errorf("%q must be on a line of its own", DNSControlBeginMarker)
+	}
+	sectionStart := begin + bytes.IndexByte(existing[begin:], '\n') + 1
+	sectionEnd := bytes.LastIndexByte(existing[:end], '\n') + 1
+
+	lines, err := dnsControlLines(domain, txtRecs, opts, indent)
+	if err != nil {
+		return nil, err
+	}
+	merged := append([]byte(nil), existing[:sectionStart]...)
+	merged = append(merged, lines...)
+	return append(merged, existing[sectionEnd:]...), nil
+}
+
+func dnsControlLines(domain string, txtRecs map[string]string, opts Options, indent string) (string, error) {
+	var b strings.Builder
+	for _, r := range resources(domain, txtRecs, opts) {
+		name, err := opts.relativeName(domain, r.record.Name)
+		if err != nil {
+			return "", err
+		}
+		if name == "" {
+			name = "@"
+		}
+		for _, value := range r.record.Values {
+			fmt.Fprintf(&b, "%vTXT(%v, %v, TTL(%d)),\n", indent, jsString(name), jsString(value), r.record.TTL)
+		}
+	}
+	return b.String(), nil
+}
+
+// jsString quotes a string as a JavaScript literal, JSON strings being valid JavaScript
+func jsString(s string) string {
+	var b bytes.Buffer
+	encoder := json.NewEncoder(&b)
+	encoder.SetEscapeHTML(false)
+	_ = encoder.Encode(s)
+	return strings.TrimSuffix(b.String(), "\n")
+}
@@ -0,0 +1,253 @@
+// Package iac renders the SPF records as infrastructure as code, for zones managed by Terraform or CloudFormation
+// where writing the records directly would fight the tool's state.
+package iac
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	dns "github.com/searchspring.com/spf-flatten/dns"
+	"github.com/searchspring.com/spf-flatten/provider"
+)
+
+// Name of the Terraform variable or CloudFormation parameter the hosted zone id comes from when ZoneID is not set
+const (
+	ZoneIDVariable  = "spf_flatten_zone_id"
+	ZoneIDParameter = "HostedZoneId"
+)
+
+type Options struct {
+	// ZoneID is the Route53 hosted zone id written into every resource. When empty it is left as an input.
+	ZoneID string
+	// Zone is what octoDNS and DNSControl record names are relative to, the domain itself when empty
+	Zone string
+	provider.PlanOptions
+}
+
+// resource is one exported record set with its stable names
+type resource struct {
+	record provider.Record
+	// Terraform resource name and CloudFormation logical id, derived from the record name so re-runs line up
+	tfName string
+	cfName string
+}
+
+// Terraform renders aws_route53_record resources in HCL
+func Terraform(domain string, txtRecs map[string]string, opts Options) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# SPF records for %v generated by spf-flatten, do not edit\n", strings.TrimSuffix(provider.Fqdn(domain), "."))
+	zoneID := "var." + ZoneIDVariable
+	if opts.ZoneID != "" {
+		zoneID = hclString(opts.ZoneID)
+	} else {
+		fmt.Fprintf(&b, "\nvariable %q {\n  type        = string\n  description = \"Route53 hosted zone the SPF records are written to\"\n}\n", ZoneIDVariable)
+	}
+	for _, r := range resources(domain, txtRecs, opts) {
+		var values []string
+		for _, value := range r.record.Values {
+			values = append(values, hclString(terraformTXT(value)))
+		}
+		fmt.Fprintf(&b, "\nresource \"aws_route53_record\" %q {\n", r.tfName)
+		fmt.Fprintf(&b, "  zone_id = %v\n", zoneID)
+		fmt.Fprintf(&b, "  name    = %v\n", hclString(strings.TrimSuffix(r.record.Name, ".")))
+		fmt.Fprintf(&b, "  type    = \"TXT\"\n")
+		fmt.Fprintf(&b, "  ttl     = %d\n", r.record.TTL)
+		fmt.Fprintf(&b, "  records = [%v]\n", strings.Join(values, ", "))
+		fmt.Fprintf(&b, "}\n")
+	}
+	return []byte(b.String())
+}
+
+// TerraformJSON renders the same resources as Terraform's JSON configuration syntax
+func TerraformJSON(domain string, txtRecs map[string]string, opts Options) ([]byte, error) {
+	type record struct {
+		ZoneID  string   `json:"zone_id"`
+		Name    string   `json:"name"`
+		Type    string   `json:"type"`
+		TTL     int64    `json:"ttl"`
+		Records []string `json:"records"`
+	}
+	config := map[string]interface{}{}
+	zoneID := "${var." + ZoneIDVariable + "}"
+	if opts.ZoneID != "" {
+		zoneID = templateEscape(opts.ZoneID)
+	} else {
+		config["variable"] = map[string]interface{}{
+			ZoneIDVariable: map[string]string{"type": "string", "description": "Route53 hosted zone the SPF records are written to"},
+		}
+	}
+	records := map[string]record{}
+	for _, r := range resources(domain, txtRecs, opts) {
+		rec := record{ZoneID: zoneID, Name: strings.TrimSuffix(r.record.Name, "."), Type: "TXT", TTL: r.record.TTL}
+		for _, value := range r.record.Values {
+			rec.Records = append(rec.Records, templateEscape(terraformTXT(value)))
+		}
+		records[r.tfName] = rec
+	}
+	config["resource"] = map[string]interface{}{"aws_route53_record": records}
+	out, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(out, '\n'), nil
+}
+
+// CloudFormation renders a template of AWS::Route53::RecordSet resources
+func CloudFormation(domain string, txtRecs map[string]string, opts Options) ([]byte, error) {
+	type properties struct {
+		HostedZoneID    interface{} `json:"HostedZoneId"`
+		Name            string      `json:"Name"`
+		Type            string      `json:"Type"`
+		TTL             string      `json:"TTL"`
+		ResourceRecords []string    `json:"ResourceRecords"`
+	}
+	type recordSet struct {
+		Type       string     `json:"Type"`
+		Properties properties `json:"Properties"`
+	}
+	type template struct {
+		AWSTemplateFormatVersion string                 `json:"AWSTemplateFormatVersion"`
+		Description              string                 `json:"Description"`
+		Parameters               map[string]interface{} `json:"Parameters,omitempty"`
+		Resources                map[string]recordSet   `json:"Resources"`
+	}
+
+	t := template{
+		AWSTemplateFormatVersion: "2010-09-09",
+		Description:              fmt.Sprintf("SPF records for %v generated by spf-flatten", provider.Fqdn(domain)),
+		Resources:                map[string]recordSet{},
+	}
+	var zoneID interface{} = opts.ZoneID
+	if opts.ZoneID == "" {
+		zoneID = map[string]string{"Ref": ZoneIDParameter}
+		t.Parameters = map[string]interface{}{
+			ZoneIDParameter: map[string]string{"Type": "AWS::Route53::HostedZone::Id", "Description": "Route53 hosted zone the SPF records are written to"},
+		}
+	}
+	for _, r := range resources(domain, txtRecs, opts) {
+		props := properties{HostedZoneID: zoneID, Name: r.record.Name, Type: "TXT", TTL: strconv.FormatInt(r.record.TTL, 10)}
+		for _, value := range r.record.Values {
+			props.ResourceRecords = append(props.ResourceRecords, dns.QuoteTXT(value))
+		}
+		t.Resources[r.cfName] = recordSet{Type: "AWS::Route53::RecordSet", Properties: props}
+	}
+	out, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(out, '\n'), nil
+}
+
+// resources plans the records against an empty zone, so TTLs follow the same rules as publishing,
+// and names them after the domain and _spfN number
+func resources(domain string, txtRecs map[string]string, opts Options) []resource {
+	domain = provider.Fqdn(domain)
+	base := strings.Split(strings.TrimSuffix(domain, "."), ".")
+	plan := provider.NewPlan(domain, nil, txtRecs, opts.PlanOptions)
+
+	var out []resource
+	for _, change := range plan.Changes {
+		r := resource{record: change.Record}
+		labels := base
+		if num, ok := opts.Naming.LeafNumber(change.Record.Name, domain); ok {
+			labels = append(append([]string(nil), base...), "leaf"+strconv.Itoa(num))
+		} else if change.Record.Name != domain {
+			labels = strings.Split(strings.TrimSuffix(change.Record.Name, "."), ".")
+		}
+		r.tfName = terraformName(labels)
+		r.cfName = logicalID(labels)
+		out = append(out, r)
+	}
+	// Root first then leaves by number, so the rendered files read in order and diff cleanly
+	sort.SliceStable(out, func(i, j int) bool {
+		return opts.leafNumber(domain, out[i].record.Name) < opts.leafNumber(domain, out[j].record.Name)
+	})
+	return out
+}
+
+func (o Options) zone(domain string) string {
+	if o.Zone != "" {
+		return provider.Fqdn(o.Zone)
+	}
+	return provider.Fqdn(domain)
+}
+
+// relativeName gives name relative to the zone, the apex being empty
+func (o Options) relativeName(domain string, name string) (string, error) {
+	zone := o.zone(domain)
+	name = provider.Fqdn(name)
+	if name == zone {
+		return "", nil
+	}
+	relative, found := strings.CutSuffix(name, "."+zone)
+	if !found {
+		return "", fmt.Errorf("%v is not in zone %v", name, zone)
+	}
+	return relative, nil
+}
+
+func (o Options) absoluteName(domain string, relative string) string {
+	if relative == "" || relative == "@" {
+		return o.zone(domain)
+	}
+	return provider.Fqdn(relative + "." + o.zone(domain))
+}
+
+// leafNumber gives the number of a leaf, 0 for the root
+func (o Options) leafNumber(domain string, name string) int {
+	n, _ := o.Naming.LeafNumber(name, domain)
+	return n
+}
+
+// terraformName builds spf_example_com_leaf1, resource names may only hold letters, digits, _ and -
+func terraformName(labels []string) string {
+	name := "spf_" + strings.Join(labels, "_")
+	return strings.Map(func(r rune) rune {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-') {
+			return unicode.ToLower(r)
+		}
+		return '_'
+	}, name)
+}
+
+// logicalID builds SpfExampleComLeaf1, logical ids may only hold letters and digits
+func logicalID(labels []string) string {
+	var b strings.Builder
+	b.WriteString("Spf")
+	for _, label := range labels {
+		upper := true
+		for _, r := range label {
+			if r >= unicode.MaxASCII || !(unicode.IsLetter(r) || unicode.IsDigit(r)) {
+				upper = true
+				continue
+			}
+			if upper {
+				r = unicode.ToUpper(r)
+				upper = false
+			}
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// terraformTXT joins the 255 byte character-strings with "", the AWS provider's convention for long TXT values
+func terraformTXT(value string) string {
+	return strings.Join(dns.SplitTXT(value), `""`)
+}
+
+// templateEscape stops Terraform reading SPF macros like %{i} as template directives
+func templateEscape(s string) string {
+	s = strings.ReplaceAll(s, "${", "$${")
+	return strings.ReplaceAll(s, "%{", "%%{")
+}
+
+func hclString(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + templateEscape(s) + `"`
+}
@@ -0,0 +1,262 @@
+package iac
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/searchspring.com/spf-flatten/provider"
+	"github.com/stretchr/testify/require"
+)
+
+var testRecs = map[string]string{
+	"example.com":        "v=spf1 include:_spf1.example.com include:_spf2.example.com include:_spf10.example.com ~all",
+	"_spf1.example.com":  "v=spf1 ip4:192.0.2.1 exists:%{i}._spf.example.com ~all",
+	"_spf2.example.com":  "v=spf1 ip4:192.0.2.2 ~all",
+	"_spf10.example.com": "v=spf1 ip4:192.0.2.10 ~all",
+}
+
+func TestTerraform(t *testing.T) {
+	hcl := string(Terraform("example.com", testRecs, Options{PlanOptions: provider.PlanOptions{TTL: 60, RootTTL: 3600}}))
+	require.Equal(t, `# SPF records for example.com generated by spf-flatten, do not edit
+
+variable "spf_flatten_zone_id" {
+  type        = string
+  description = "Route53 hosted zone the SPF records are written to"
+}
+
+resource "aws_route53_record" "spf_example_com" {
+  zone_id = var.spf_flatten_zone_id
+  name    = "example.com"
+  type    = "TXT"
+  ttl     = 3600
+  records = ["v=spf1 include:_spf1.example.com include:_spf2.example.com include:_spf10.example.com ~all"]
+}
+
+resource "aws_route53_record" "spf_example_com_leaf1" {
+  zone_id = var.spf_flatten_zone_id
+  name    = "_spf1.example.com"
+  type    = "TXT"
+  ttl     = 60
+  records = ["v=spf1 ip4:192.0.2.1 exists:%%{i}._spf.example.com ~all"]
+}
+
+resource "aws_route53_record" "spf_example_com_leaf2" {
+  zone_id = var.spf_flatten_zone_id
+  name    = "_spf2.example.com"
+  type    = "TXT"
+  ttl     = 60
+  records = ["v=spf1 ip4:192.0.2.2 ~all"]
+}
+
+resource "aws_route53_record" "spf_example_com_leaf10" {
+  zone_id = var.spf_flatten_zone_id
+  name    = "_spf10.example.com"
+  type    = "TXT"
+  ttl     = 60
+  records = ["v=spf1 ip4:192.0.2.10 ~all"]
+}
+`, hcl)
+
+	long := "v=spf1 " + strings.Repeat("ip4:192.0.2.1 ", 20) + "~all"
+	hcl = string(Terraform("Mail-Example.com.", map[string]string{"mail-example.com": long}, Options{ZoneID: "Z123"}))
+	require.Contains(t, hcl, `resource "aws_route53_record" "spf_mail-example_com" {`)
+	require.Contains(t, hcl, `  zone_id = "Z123"`)
+	require.Contains(t, hcl, `  ttl     = 300`)
+	require.Contains(t, hcl, `  records = ["`+long[:255]+`\"\"`+long[255:]+`"]`)
+	require.NotContains(t, hcl, "variable")
+}
+
+func TestTerraformJSON(t *testing.T) {
+	out, err := TerraformJSON("example.com", testRecs, Options{})
+	require.Nil(t, err)
+	var config struct {
+		Variable map[string]interface{} `json:"variable"`
+		Resource struct {
+			Records map[string]struct {
+				ZoneID  string   `json:"zone_id"`
+				Name    string   `json:"name"`
+				TTL     int64    `json:"ttl"`
+				Records []string `json:"records"`
+			} `json:"aws_route53_record"`
+		} `json:"resource"`
+	}
+	require.Nil(t, json.Unmarshal(out, &config))
+	require.Contains(t, config.Variable, ZoneIDVariable)
+	require.Len(t, config.Resource.Records, 4)
+	leaf := config.Resource.Records["spf_example_com_leaf1"]
+	require.Equal(t, "${var.spf_flatten_zone_id}", leaf.ZoneID)
+	require.Equal(t, "_spf1.example.com", leaf.Name)
+	require.Equal(t, int64(300), leaf.TTL)
+	require.Equal(t, []string{"v=spf1 ip4:192.0.2.1 exists:%%{i}._spf.example.com ~all"}, leaf.Records)
+
+	again, err := TerraformJSON("example.com", testRecs, Options{})
+	require.Nil(t, err)
+	require.Equal(t, string(out), string(again))
+}
+
+func TestCloudFormation(t *testing.T) {
+	out, err := CloudFormation("example.com", testRecs, Options{PlanOptions: provider.PlanOptions{TTL: 60}})
+	require.Nil(t, err)
+	var template struct {
+		Parameters map[string]interface{} `json:"Parameters"`
+		Resources  map[string]struct {
+			Type       string `json:"Type"`
+			Properties struct {
+				HostedZoneID    interface{} `json:"HostedZoneId"`
+				Name            string      `json:"Name"`
+				TTL             string      `json:"TTL"`
+				ResourceRecords []string    `json:"ResourceRecords"`
+			} `json:"Properties"`
+		} `json:"Resources"`
+	}
+	require.Nil(t, json.Unmarshal(out, &template))
+	require.Contains(t, template.Parameters, ZoneIDParameter)
+	require.Len(t, template.Resources, 4)
+	root := template.Resources["SpfExampleCom"]
+	require.Equal(t, "AWS::Route53::RecordSet", root.Type)
+	require.Equal(t, map[string]interface{}{"Ref": ZoneIDParameter}, root.Properties.HostedZoneID)
+	require.Equal(t, "example.com.", root.Properties.Name)
+	require.Equal(t, "60", root.Properties.TTL)
+	require.Equal(t, []string{`"v=spf1 include:_spf1.example.com include:_spf2.example.com include:_spf10.example.com ~all"`}, root.Properties.ResourceRecords)
+	require.Contains(t, template.Resources, "SpfExampleComLeaf10")
+
+	out, err = CloudFormation("example.com", testRecs, Options{ZoneID: "Z123"})
+	require.Nil(t, err)
+	require.NotContains(t, string(out), "Parameters")
+	require.Contains(t, string(out), `"HostedZoneId": "Z123"`)
+}
+
+func TestNames(t *testing.T) {
+	require.Equal(t, "spf_mail-example_com_leaf3", terraformName([]string{"Mail-Example", "com", "leaf3"}))
+	require.Equal(t, "SpfMailExampleComLeaf3", logicalID([]string{"mail-example", "com", "leaf3"}))
+}
+
+func TestOctoDNS(t *testing.T) {
+	out, err := OctoDNS("example.com", testRecs, Options{PlanOptions: provider.PlanOptions{TTL: 60, RootTTL: 3600}})
+	require.Nil(t, err)
+	require.Equal(t, `---
+'':
+  type: TXT
+  ttl: 3600
+  value: v=spf1 include:_spf1.example.com include:_spf2.example.com include:_spf10.example.com ~all
+_spf1:
+  type: TXT
+  ttl: 60
+  value: v=spf1 ip4:192.0.2.1 exists:%{i}._spf.example.com ~all
+_spf2:
+  type: TXT
+  ttl: 60
+  value: v=spf1 ip4:192.0.2.2 ~all
+_spf10:
+  type: TXT
+  ttl: 60
+  value: v=spf1 ip4:192.0.2.10 ~all
+`, string(out))
+
+	_, err = OctoDNS("example.com", testRecs, Options{Zone: "example.org"})
+	require.EqualError(t, err, "example.com. is not in zone example.org.")
+}
+
+func TestMergeOctoDNS(t *testing.T) {
+	existing := `---
+# managed by the mail team
+'':
+  - type: MX
+    values:
+      - exchange: mx1.example.com.
+        preference: 10
+  - type: TXT
+    values:
+      - google-site-verification=abc
+      - v=spf1 include:_spf1.mail -all
+_spf1.mail:
+  type: TXT
+  value: v=spf1 ip4:192.0.2.1 -all
+_spf3.mail:
+  type: TXT
+  value: v=spf1 ip4:192.0.2.3 -all
+mail:
+  octodns:
+    cloudflare:
+      proxied: false
+  type: TXT
+  value: v=spf1 include:_spf1.mail -all
+www:
+  type: A
+  value: 192.0.2.80
+`
+	out, err := MergeOctoDNS([]byte(existing), "mail.example.com", map[string]string{
+		"mail.example.com":       "v=spf1 include:_spf1.mail.example.com include:_spf2.mail.example.com ~all",
+		"_spf1.mail.example.com": "v=spf1 ip4:192.0.2.1 ~all",
+		"_spf2.mail.example.com": "v=spf1 ip4:192.0.2.2; ~all",
+	}, Options{Zone: "example.com"})
+	require.Nil(t, err)
+	require.Equal(t, `---
+# managed by the mail team
+'':
+  - type: MX
+    values:
+      - exchange: mx1.example.com.
+        preference: 10
+  - type: TXT
+    values:
+      - google-site-verification=abc
+      - v=spf1 include:_spf1.mail -all
+_spf1.mail:
+  type: TXT
+  ttl: 300
+  value: v=spf1 ip4:192.0.2.1 ~all
+_spf2.mail:
+  type: TXT
+  ttl: 300
+  value: v=spf1 ip4:192.0.2.2\; ~all
+mail:
+  octodns:
+    cloudflare:
+      proxied: false
+  type: TXT
+  ttl: 300
+  value: v=spf1 include:_spf1.mail.example.com include:_spf2.mail.example.com ~all
+www:
+  type: A
+  value: 192.0.2.80
+`, string(out))
+}
+
+func TestDNSControl(t *testing.T) {
+	out, err := DNSControl("example.com", testRecs, Options{PlanOptions: provider.PlanOptions{TTL: 60}})
+	require.Nil(t, err)
+	require.Equal(t, `    // BEGIN spf-flatten
+    TXT("@", "v=spf1 include:_spf1.example.com include:_spf2.example.com include:_spf10.example.com ~all", TTL(60)),
+    TXT("_spf1", "v=spf1 ip4:192.0.2.1 exists:%{i}._spf.example.com ~all", TTL(60)),
+    TXT("_spf2", "v=spf1 ip4:192.0.2.2 ~all", TTL(60)),
+    TXT("_spf10", "v=spf1 ip4:192.0.2.10 ~all", TTL(60)),
+    // END spf-flatten
+`, string(out))
+}
+
+func TestMergeDNSControl(t *testing.T) {
+	existing := `D("example.com", REG_NONE, DnsProvider(DSP_BIND),
+  A("www", "192.0.2.80"),
+  // BEGIN spf-flatten
+  TXT("@", "v=spf1 -all"),
+  TXT("_spf1", "v=spf1 ip4:192.0.2.1 -all"),
+  // END spf-flatten
+  TXT("@", "google-site-verification=abc"),
+);
+`
+	out, err := MergeDNSControl([]byte(existing), "example.com", map[string]string{"example.com": "v=spf1 ip4:192.0.2.2 ~all"}, Options{})
+	require.Nil(t, err)
+	require.Equal(t, `D("example.com", REG_NONE, DnsProvider(DSP_BIND),
+  A("www", "192.0.2.80"),
+  // BEGIN spf-flatten
+  TXT("@", "v=spf1 ip4:192.0.2.2 ~all", TTL(300)),
+  // END spf-flatten
+  TXT("@", "google-site-verification=abc"),
+);
+`, string(out))
+
+	_, err = MergeDNSControl([]byte(`D("example.com", REG_NONE);`), "example.com", testRecs, Options{})
+	require.EqualError(t, err, `DNSControl config has no "// BEGIN spf-flatten" and "// END spf-flatten" lines to write the records between`)
+}
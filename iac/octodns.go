@@ -0,0 +1,232 @@
+package iac
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/searchspring.com/spf-flatten/provider"
+	"gopkg.in/yaml.v3"
+)
+
+// OctoDNS renders the records as an octoDNS zone YAML fragment
+func OctoDNS(domain string, txtRecs map[string]string, opts Options) ([]byte, error) {
+	return MergeOctoDNS(nil, domain, txtRecs, opts)
+}
+
+// MergeOctoDNS writes the records into an existing octoDNS zone file. Other record types and non-SPF TXT
+// values are kept, _spfN leaves that are no longer wanted are removed and new names are inserted in the
+// natural order octoDNS enforces.
+func MergeOctoDNS(existing []byte, domain string, txtRecs map[string]string, opts Options) ([]byte, error) {
+	var doc yaml.Node
+	if len(bytes.TrimSpace(existing)) > 0 {
+		err := yaml.Unmarshal(existing, &doc)
+		if err != nil {
+			return nil, fmt.Errorf("octoDNS config: %v", err)
+		}
+	}
+	if doc.Kind == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+	zone := doc.Content[0]
+	if zone.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("octoDNS config is not a mapping of record names")
+	}
+
+	desired := map[string]bool{}
+	for _, r := range resources(domain, txtRecs, opts) {
+		name, err := opts.relativeName(domain, r.record.Name)
+		if err != nil {
+			return nil, err
+		}
+		desired[name] = true
+		var values []string
+		for _, value := range r.record.Values {
+			values = append(values, octoDNSEscape(value))
+		}
+		setOctoDNSTXT(zone, name, r.record.TTL, values)
+	}
+	for i := 0; i < len(zone.Content); i += 2 {
+		name := zone.Content[i].Value
+		if !desired[name] && opts.Naming.IsLeaf(opts.absoluteName(domain, name), domain) && removeOctoDNSTXT(zone, i) {
+			i -= 2
+		}
+	}
+
+	var out bytes.Buffer
+	out.WriteString("---\n")
+	encoder := yaml.NewEncoder(&out)
+	encoder.SetIndent(2)
+	err := encoder.Encode(doc.Content[0])
+	if err != nil {
+		return nil, err
+	}
+	return out.Bytes(), encoder.Close()
+}
+
+// setOctoDNSTXT replaces the TXT record at name, carrying over its non-SPF values, or adds one
+func setOctoDNSTXT(zone *yaml.Node, name string, ttl int64, values []string) {
+	for i := 0; i < len(zone.Content); i += 2 {
+		if zone.Content[i].Value != name {
+			continue
+		}
+		value := zone.Content[i+1]
+		records := []*yaml.Node{value}
+		if value.Kind == yaml.SequenceNode {
+			records = value.Content
+		}
+		for _, record := range records {
+			if mappingValue(record, "type") == "TXT" {
+				for _, existing := range txtValues(record) {
+					if !provider.IsSPF(existing) {
+						values = append(values, existing)
+					}
+				}
+				fillTXT(record, ttl, values)
+				return
+			}
+		}
+		record := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		fillTXT(record, ttl, values)
+		if value.Kind == yaml.SequenceNode {
+			value.Content = append(value.Content, record)
+		} else {
+			zone.Content[i+1] = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Content: []*yaml.Node{value, record}}
+		}
+		return
+	}
+
+	key := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: name}
+	if name == "" {
+		key.Style = yaml.SingleQuotedStyle
+	}
+	record := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	fillTXT(record, ttl, values)
+	at := len(zone.Content)
+	for i := 0; i < len(zone.Content); i += 2 {
+		if naturalLess(name, zone.Content[i].Value) {
+			at = i
+			break
+		}
+	}
+	zone.Content = append(zone.Content[:at], append([]*yaml.Node{key, record}, zone.Content[at:]...)...)
+}
+
+// removeOctoDNSTXT drops the TXT record from the name at key index i, reporting whether the whole name went
+func removeOctoDNSTXT(zone *yaml.Node, i int) bool {
+	value := zone.Content[i+1]
+	if value.Kind == yaml.MappingNode {
+		if mappingValue(value, "type") != "TXT" {
+			return false
+		}
+		zone.Content = append(zone.Content[:i], zone.Content[i+2:]...)
+		return true
+	}
+	var kept []*yaml.Node
+	for _, record := range value.Content {
+		if mappingValue(record, "type") != "TXT" {
+			kept = append(kept, record)
+		}
+	}
+	if len(kept) == 0 {
+		zone.Content = append(zone.Content[:i], zone.Content[i+2:]...)
+		return true
+	}
+	value.Content = kept
+	return false
+}
+
+// fillTXT sets type, ttl and value or values on a record, leaving any other keys like octodns alone
+func fillTXT(record *yaml.Node, ttl int64, values []string) {
+	deleteKey(record, "value")
+	deleteKey(record, "values")
+	setKey(record, "type", &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "TXT"})
+	setKey(record, "ttl", &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: strconv.FormatInt(ttl, 10)})
+	if len(values) == 1 {
+		setKey(record, "value", &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: values[0]})
+		return
+	}
+	list := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+	for _, value := range values {
+		list.Content = append(list.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value})
+	}
+	setKey(record, "values", list)
+}
+
+func txtValues(record *yaml.Node) []string {
+	var values []string
+	for i := 0; i+1 < len(record.Content); i += 2 {
+		switch record.Content[i].Value {
+		case "value":
+			values = append(values, record.Content[i+1].Value)
+		case "values":
+			for _, value := range record.Content[i+1].Content {
+				values = append(values, value.Value)
+			}
+		}
+	}
+	return values
+}
+
+func mappingValue(mapping *yaml.Node, key string) string {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1].Value
+		}
+	}
+	return ""
+}
+
+func setKey(mapping *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			mapping.Content[i+1] = value
+			return
+		}
+	}
+	mapping.Content = append(mapping.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+}
+
+func deleteKey(mapping *yaml.Node, key string) {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			mapping.Content = append(mapping.Content[:i], mapping.Content[i+2:]...)
+			return
+		}
+	}
+}
+
+// octoDNSEscape escapes semicolons, which octoDNS requires in TXT values
+func octoDNSEscape(value string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(value, `\;`, `;`), `;`, `\;`)
+}
+
+// naturalLess compares runs of digits by number, so _spf2 sorts before _spf10 as octoDNS expects
+func naturalLess(a string, b string) bool {
+	for a != "" && b != "" {
+		ca, cb := chunk(a), chunk(b)
+		a, b = a[len(ca):], b[len(cb):]
+		na, errA := strconv.Atoi(ca)
+		nb, errB := strconv.Atoi(cb)
+		switch {
+		case errA == nil && errB == nil && na != nb:
+			return na < nb
+		case (errA == nil) != (errB == nil):
+			return errA == nil
+		case ca != cb:
+			return ca < cb
+		}
+	}
+	return len(a) < len(b)
+}
+
+// chunk returns the leading run of digits or non-digits
+func chunk(s string) string {
+	digit := s[0] >= '0' && s[0] <= '9'
+	i := 1
+	for i < len(s) && (s[i] >= '0' && s[i] <= '9') == digit {
+		i++
+	}
+	return s[:i]
+}
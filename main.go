@@ -1,70 +1,812 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"math"
+	"net"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	dns "github.com/searchspring.com/spf-flatten/dns"
+	"github.com/searchspring.com/spf-flatten/iac"
+	"github.com/searchspring.com/spf-flatten/provider"
 	r53 "github.com/searchspring.com/spf-flatten/route53"
+	"github.com/searchspring.com/spf-flatten/zonefile"
 )
 
+// Exit codes
+const (
+	exitOK      = 0
+	exitError   = 1
+	exitChanges = 2
+)
+
+// newDNS builds the resolver the template domain is looked up with
+var newDNS = dns.New
+
+// command is one of the CLI's subcommands
+type command struct {
+	name     string
+	summary  string
+	settings []setting
+	run      func(ctx context.Context, r *runner, s settings) (int, error)
+	// prepare, when set, runs before the targets and may change them, finish after them all given the combined exit code
+	prepare func(r *runner, s settings, targets []settings) ([]settings, error)
+	finish  func(r *runner, s settings, code int) error
+	// runAll, when set, is given all the targets at once instead of run being called for each
+	runAll func(ctx context.Context, r *runner, targets []settings) (int, error)
+}
+
+// runner is what a command shares across its targets
+type runner struct {
+	// stdout is where the text goes, stderr with --output json
+	stdout io.Writer
+	// report gathers the results --output json prints, nil for text
+	report *report
+	// result is the current target's
+	result *result
+	// plan gathers the targets plan --out writes, or holds those apply --plan publishes
+	plan *planFile
+	// logger writes to stderr at the LOG_LEVEL and in the LOG_FORMAT asked for
+	logger *slog.Logger
+	// ttls, when set, notes the TTLs of the answers the template was resolved from
+	ttls *ttlRecorder
+	// metrics, when set, counts the lookups that fail
+	metrics *serveMetrics
+	// previous, when set, is the template's tree as of the last run, which senders no longer authorized are traced back to
+	previous *dns.Include
+	// previousPlan is the plan file plan --previous-plan names, whose answers give each domain's previous tree
+	previousPlan *planFile
+}
+
+var commands = []command{
+	{
+		name:     "flatten",
+		summary:  "Print the flattened records, or export them for infrastructure as code",
+		settings: concat([]setting{configPath, output, logLevel, logFormat}, recordSettings, ttlSettings, exportSettings),
+		run:      runFlatten,
+	},
+	{
+		name:     "validate",
+		summary:  "Check the flattened records pass SPF evaluation for TEST_IP",
+		settings: concat([]setting{configPath, output, logLevel, logFormat}, recordSettings, []setting{testIP}),
+		run:      runValidate,
+	},
+	{
+		name:     "plan",
+		summary:  "Show how the provider's records differ from the flattened ones",
+		settings: concat([]setting{configPath, output, logLevel, logFormat}, recordSettings, []setting{testIP, planOut, previousPlan}, ttlSettings, providerSettings),
+		run:      runPlan,
+		prepare:  preparePlan,
+		finish:   finishPlan,
+	},
+	{
+		name:     "apply",
+		summary:  "Publish the flattened records to the provider",
+		settings: concat([]setting{configPath, output, logLevel, logFormat}, recordSettings, []setting{testIP, dryRun, planPath}, ttlSettings, providerSettings),
+		run:      runApply,
+		prepare:  prepareApply,
+		finish:   finishApply,
+	},
+	{
+		name:     "inspect",
+		summary:  "Show the include tree of the template domain and the DNS lookups it takes",
+		settings: concat([]setting{configPath, output, logLevel, logFormat, templateDomain}, inlineSettings),
+		run:      runInspect,
+	},
+	{
+		name:     "serve",
+		summary:  "Keep publishing the flattened records, re-flattening each domain on its SCHEDULE or as the template's answers expire",
+		settings: concat([]setting{configPath, logLevel, logFormat}, recordSettings, []setting{testIP, dryRun, scheduleSetting, jitterSetting, listenAddr, dnsServer}, ttlSettings, providerSettings),
+		runAll:   runServe,
+	},
+}
+
 func main() {
-	envs := map[string]string{
-		"aws_Region":      os.Getenv("AWS_REGION"),
-		"template_Domain": os.Getenv("TEMPLATE_DOMAIN"),
-		"update_Domain":   os.Getenv("UPDATE_DOMAIN"),
-		"test_IP":         os.Getenv("TEST_IP"),
-		"zone_ID":         os.Getenv("ZONEID"),
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run executes the command named by the first argument and returns the exit code
+func run(args []string, stdout io.Writer, stderr io.Writer) int {
+	if len(args) == 0 {
+		usage(stderr)
+		return exitError
+	}
+	switch args[0] {
+	case "help", "-h", "-help", "--help":
+		usage(stdout)
+		return exitOK
 	}
+	for _, cmd := range commands {
+		if cmd.name != args[0] {
+			continue
+		}
+		s := settings{}
+		fs := newFlagSet(cmd.name, cmd.settings, s)
+		fs.SetOutput(stderr)
+		fs.Usage = func() {
+			fmt.Fprintf(fs.Output(), "Usage: spf-flatten %v [flags]\n\n%v.\n\nFlags, each overriding the ENV variable shown:\n", cmd.name, cmd.summary)
+			fs.PrintDefaults()
+		}
+		err := fs.Parse(args[1:])
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		if err != nil {
+			return exitError
+		}
+		if fs.NArg() > 0 {
+			fmt.Fprintf(stderr, "spf-flatten %v: unexpected argument %q\n", cmd.name, fs.Arg(0))
+			return exitError
+		}
+		err = checkOutput(s)
+		if err != nil {
+			fmt.Fprintf(stderr, "spf-flatten %v: %v\n", cmd.name, err)
+			return exitError
+		}
+
+		logger, err := newLogger(s, stderr)
+		if err != nil {
+			fmt.Fprintf(stderr, "spf-flatten %v: %v\n", cmd.name, err)
+			return exitError
+		}
 
-	for k, v := range envs {
-		if v == "" {
-			log.Fatalf("You must test '%s' ENV variable.", strings.ToUpper(k))
+		started := time.Now()
+		r := &runner{stdout: stdout, logger: logger}
+		if s.get(output.env) == "json" {
+			// The text goes to stderr, leaving stdout to the report
+			r.stdout = stderr
+			r.report = &report{Command: cmd.name}
+		}
+		code, err := runCommand(cmd, r, s, stderr)
+		if err != nil {
+			fmt.Fprintf(stderr, "spf-flatten %v: %v\n", cmd.name, err)
+			code = exitError
+		}
+		if r.report != nil {
+			r.report.ExitCode = code
+			if err != nil {
+				r.report.Error = err.Error()
+			}
+			writeReport(stdout, *r.report, started)
 		}
+		return code
 	}
+	fmt.Fprintf(stderr, "spf-flatten: unknown command %q\n\n", args[0])
+	usage(stderr)
+	return exitError
+}
 
-	// Retrieve SPF record for the domain
-	d := dns.New()
-	record, err := d.DNSLookupSPF(envs["template_Domain"])
+func usage(w io.Writer) {
+	fmt.Fprint(w, "Usage: spf-flatten <command> [flags]\n\nFlattens the SPF record of a template domain into records for another domain that stay within the DNS lookup limit.\n\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-9v %v\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprint(w, "\nRun spf-flatten <command> --help for its flags. Every flag can also be set with its ENV variable, IE --update-domain with UPDATE_DOMAIN.\n\nExit codes: 0 success with nothing to change, 1 error, 2 changes planned.\n")
+}
+
+// runCommand works out the command's targets and runs it for each, the error being one that fails the command as a whole
+func runCommand(cmd command, r *runner, s settings, stderr io.Writer) (int, error) {
+	targets, err := commandTargets(s)
+	if err == nil && cmd.prepare != nil {
+		targets, err = cmd.prepare(r, s, targets)
+	}
 	if err != nil {
-		log.Fatalf("DNSLookupSPF: %s", err)
+		return exitError, err
+	}
+	if cmd.runAll != nil {
+		return cmd.runAll(context.Background(), r, targets)
+	}
+	code := runTargets(cmd, r, targets, stderr)
+	if cmd.finish != nil {
+		err = cmd.finish(r, s, code)
+		if err != nil {
+			return exitError, err
+		}
+	}
+	return code, nil
+}
+
+// runTargets runs the command for each target and combines their exit codes
+func runTargets(cmd command, r *runner, targets []settings, stderr io.Writer) int {
+	// Carry on past a failing target so one broken domain does not hold up the rest
+	code := exitOK
+	for _, ts := range targets {
+		if len(targets) > 1 {
+			fmt.Fprintf(r.stdout, "# %v\n", ts.get(updateDomain.env))
+		}
+		targetCode := runTarget(cmd, r, ts, len(targets) > 1, stderr)
+		code = worstExit(code, targetCode)
 	}
-	d.UpdateDomain = envs["update_Domain"]
-	d.TestIP = envs["test_IP"]
+	return code
+}
 
-	// Flatten SPF record
-	flat, err := d.FlattenSPF(*record)
+// runTarget runs the command for one target, noting its result for the report
+func runTarget(cmd command, r *runner, s settings, named bool, stderr io.Writer) int {
+	started := time.Now()
+	r.result = &result{UpdateDomain: s.get(updateDomain.env)}
+	code, err := cmd.run(context.Background(), r, s)
+	if err != nil {
+		if named {
+			fmt.Fprintf(stderr, "spf-flatten %v %v: %v\n", cmd.name, s.get(updateDomain.env), err)
+		} else {
+			fmt.Fprintf(stderr, "spf-flatten %v: %v\n", cmd.name, err)
+		}
+		code = exitError
+		r.result.Error = err.Error()
+	}
+	r.result.ExitCode = code
+	r.result.DurationMS = time.Since(started).Milliseconds()
+	if r.report != nil {
+		r.report.Targets = append(r.report.Targets, r.result)
+	}
+	return code
+}
+
+// commandTargets gives the settings of each target in the config file, or just the command's own settings without one
+func commandTargets(s settings) ([]settings, error) {
+	if s.get(configPath.env) == "" {
+		return []settings{s}, nil
+	}
+	targets, err := loadConfig(s.get(configPath.env))
+	if err != nil {
+		return nil, err
+	}
+	var all []settings
+	for _, t := range targets {
+		all = append(all, t.settings(s))
+	}
+	return all, nil
+}
+
+// worstExit combines the exit codes of several targets, an error outranking planned changes
+func worstExit(a int, b int) int {
+	if a == exitError || b == exitError {
+		return exitError
+	}
+	if a == exitChanges || b == exitChanges {
+		return exitChanges
+	}
+	return exitOK
+}
+
+func concat(lists ...[]setting) []setting {
+	var all []setting
+	for _, list := range lists {
+		all = append(all, list...)
+	}
+	return all
+}
+
+// Look up the template domain's SPF record and split its flattened mechanisms into records for the update domain,
+// noting the TXT answers looked up in answers unless it is nil
+func flatten(r *runner, s settings, answers map[string][]string) (dns.DNS, map[string]string, error) {
+	err := s.require(updateDomain)
+	if err != nil {
+		return dns.DNS{}, nil, err
+	}
+	err = checkAll(s.get("ALL_QUALIFIER"))
+	if err != nil {
+		return dns.DNS{}, nil, err
+	}
+	err = naming(s).Validate()
 	if err != nil {
-		log.Fatal(err)
+		return dns.DNS{}, nil, err
+	}
+	d := r.newDNS()
+	if answers != nil {
+		d.NetworkHandler = recordingNetwork{NetworkInterface: d.NetworkHandler, answers: answers}
 	}
+	record, err := templateRecord(d, s)
+	if err != nil {
+		return d, nil, err
+	}
+	d.UpdateDomain = s.get(updateDomain.env)
+	d.All = s.get("ALL_QUALIFIER")
+	d.Naming = naming(s)
 
-	// Split up records into top level record and include records
+	flat, err := d.FlattenSPF(*record)
+	if err != nil {
+		return d, nil, err
+	}
 	txtRecs := d.SplitSPFRecords(flat)
+	r.result.Records = txtRecs
+	r.result.Lookups = dns.RecordsLookups(txtRecs)
+	return d, txtRecs, nil
+}
 
-	// Check records for validity
-	_, err = d.SPFRecordsAreValid(txtRecs)
+// templateRecord is the SPF record to flatten, given inline or else looked up from the template domain
+func templateRecord(d dns.DNS, s settings) (*dns.SPFRecord, error) {
+	record, err := inlineTemplate(s)
+	if err != nil || record != nil {
+		return record, err
+	}
+	if s.get(templateDomain.env) == "" {
+		return nil, fmt.Errorf("you must set --template-domain or inline mechanisms such as --include, or their ENV variables")
+	}
+	record, err = d.DNSLookupSPF(s.get(templateDomain.env))
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("looking up the template: %v", err)
 	}
+	return record, nil
+}
 
-	// Update Route53
-	r53updater, err := r53.New(r53.Route53Updater{
-		Region:       envs["aws_Region"],
-		UpdateDomain: envs["update_Domain"],
-		Zoneid:       envs["zone_ID"],
-		DryRun:       true,
-	})
+// inlineTemplate builds the template record from the mechanisms given inline, nil when there are none
+func inlineTemplate(s settings) (*dns.SPFRecord, error) {
+	var record *dns.SPFRecord
+	for _, st := range inlineSettings {
+		for _, value := range strings.Fields(s.get(st.env)) {
+			err := checkMechanism(st.flag(), value)
+			if err != nil {
+				return nil, err
+			}
+			if record == nil {
+				record = &dns.SPFRecord{}
+			}
+			record.Mechanisms = append(record.Mechanisms, mechanism(st.flag(), value, s.get(updateDomain.env)))
+		}
+	}
+	return record, nil
+}
+
+// currentDomain stands for the domain of the record in an a or mx value, IE --a @ or --mx @/24 for bare a and mx/24
+const currentDomain = "@"
+
+// mechanism writes an inline value as a mechanism of the template
+func mechanism(kind string, value string, domain string) string {
+	if kind != "a" && kind != "mx" {
+		return kind + ":" + value
+	}
+	target, cidr, hasCIDR := strings.Cut(value, "/")
+	// The flattened terms move into leaves, where a bare a or mx would look up the leaf rather than UPDATE_DOMAIN
+	if target == currentDomain || target == "" {
+		target = strings.TrimSuffix(domain, ".")
+	}
+	term := kind
+	if target != "" {
+		term += ":" + target
+	}
+	if hasCIDR {
+		term += "/" + cidr
+	}
+	return term
+}
+
+// checkMechanism validates the value of an inline mechanism, an address or range for ip4 and ip6, a domain for include
+// and for a and mx a domain, or @ for the record's own, with an optional dual-cidr-length IE example.com/24//64
+func checkMechanism(kind string, value string) error {
+	switch kind {
+	case "ip4", "ip6":
+		ip := net.ParseIP(value)
+		if ip == nil {
+			ip, _, _ = net.ParseCIDR(value)
+		}
+		if ip == nil || (ip.To4() != nil) != (kind == "ip4") {
+			return fmt.Errorf("%v: %q is not an IPv%v address or range", kind, value, kind[2:])
+		}
+	case "a", "mx":
+		target, cidr, hasCIDR := strings.Cut(value, "/")
+		if target != currentDomain && target != "" && strings.ContainsAny(target, " \t:") {
+			return fmt.Errorf("%v: %q is not a domain", kind, value)
+		}
+		if hasCIDR && !validDualCIDR(cidr) {
+			return fmt.Errorf("%v: %q has an invalid prefix length, expected IE /24, //64 or /24//64", kind, value)
+		}
+	default:
+		if value == "" || strings.ContainsAny(value, " \t:/") {
+			return fmt.Errorf("%v: %q is not a domain", kind, value)
+		}
+	}
+	return nil
+}
+
+// validDualCIDR checks the prefix lengths after an a or mx target's first slash, RFC 7208 section 5.6's dual-cidr-length
+func validDualCIDR(cidr string) bool {
+	ip4, ip6, hasIP6 := strings.Cut(cidr, "//")
+	if strings.HasPrefix(cidr, "/") {
+		// Only an IPv6 prefix length, IE a//64
+		ip4, ip6, hasIP6 = "", strings.TrimPrefix(cidr, "/"), true
+	}
+	if ip4 == "" && !hasIP6 {
+		return false
+	}
+	return validPrefixLength(ip4, 32, ip4 == "") && (!hasIP6 || validPrefixLength(ip6, 128, false))
+}
+
+func validPrefixLength(length string, max int, optional bool) bool {
+	if length == "" {
+		return optional
+	}
+	n, err := strconv.ParseUint(length, 10, 8)
+	return err == nil && n <= uint64(max)
+}
+
+// Flatten the records and check them for validity with every test IP
+func flattenValid(r *runner, s settings, answers map[string][]string) (map[string]string, error) {
+	err := s.require(testIP)
+	if err != nil {
+		return nil, err
+	}
+	d, txtRecs, err := flatten(r, s, answers)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	for _, ip := range strings.Fields(s.get(testIP.env)) {
+		d.TestIP = ip
+		_, err = d.SPFRecordsAreValid(txtRecs)
+		if err != nil {
+			r.result.Validation = append(r.result.Validation, validation{IP: ip, Error: err.Error()})
+			return nil, err
+		}
+		r.result.Validation = append(r.result.Validation, validation{IP: ip, Valid: true})
+	}
+	return txtRecs, nil
+}
 
-	for domain, rec := range txtRecs {
-		fmt.Printf("%v\tTXT\t%v\n\n", domain, rec)
-		err = r53updater.UpdateTXTRecord(domain, rec)
+func naming(s settings) dns.Naming {
+	return dns.Naming{Pattern: s.get("LEAF_NAMING")}
+}
+
+func planOptions(s settings) (provider.PlanOptions, error) {
+	ttl, err := s.optionalTTL("TTL")
+	if err != nil {
+		return provider.PlanOptions{}, err
+	}
+	rootTTL, err := s.optionalTTL("ROOT_TTL")
+	if err != nil {
+		return provider.PlanOptions{}, err
+	}
+	return provider.PlanOptions{TTL: ttl, RootTTL: rootTTL, Naming: naming(s)}, nil
+}
+
+// newDNS builds the resolver, logging to the command's logger
+func (r *runner) newDNS() dns.DNS {
+	d := newDNS()
+	d.Logger = r.logger
+	if r.ttls != nil {
+		// The system resolver does not give TTLs, asking a nameserver directly does
+		if _, ok := d.NetworkHandler.(dns.DefaultNetworkInterface); ok {
+			d.NetworkHandler = dns.Resolver{Server: r.ttls.server}
+		}
+		d.NetworkHandler = ttlNetwork{NetworkInterface: d.NetworkHandler, ttls: r.ttls}
+	}
+	if r.metrics != nil {
+		errors := r.metrics.dnsErrors.MustCurryWith(prometheus.Labels{"domain": r.result.UpdateDomain})
+		d.NetworkHandler = countingNetwork{NetworkInterface: d.NetworkHandler, errors: errors}
+	}
+	return d
+}
+
+// publisher builds the named provider's publisher, a zone file going to stdout goes where the command's text does
+func (r *runner) publisher(name string, s settings, updateDomain string, dryRun bool) (provider.Publisher, error) {
+	p, err := newPublisher(name, s, updateDomain, dryRun, r.logger)
+	if zf, ok := p.(*zonefile.ZoneFileUpdater); ok {
+		zf.Out = r.stdout
+	}
+	return p, err
+}
+
+func providerName(s settings) string {
+	if name := s.get("PROVIDER"); name != "" {
+		return name
+	}
+	return "route53"
+}
+
+func runFlatten(ctx context.Context, r *runner, s settings) (int, error) {
+	_, txtRecs, err := flatten(r, s, nil)
+	if err != nil {
+		return exitError, err
+	}
+	opts, err := planOptions(s)
+	if err != nil {
+		return exitError, err
+	}
+
+	// Export for Terraform, CloudFormation, octoDNS or DNSControl to apply instead of printing the records
+	if format := s.get("EXPORT"); format != "" {
+		var existing []byte
+		if s.isTrue("EXPORT_MERGE") {
+			existing, err = readExport(s.get("EXPORT_PATH"))
+			if err != nil {
+				return exitError, err
+			}
+		}
+		content, err := exportRecords(format, s.get(updateDomain.env), txtRecs, iac.Options{
+			ZoneID:      s.get("ZONEID"),
+			Zone:        s.get("EXPORT_ZONE"),
+			PlanOptions: opts,
+		}, existing)
 		if err != nil {
-			log.Printf("Update Record Fail: %v\n", err)
+			return exitError, err
+		}
+		if r.report != nil && (s.get("EXPORT_PATH") == "" || s.get("EXPORT_PATH") == "-") {
+			r.result.Export = string(content)
+			return exitOK, nil
 		}
+		return exitOK, writeExport(r.stdout, s.get("EXPORT_PATH"), content)
+	}
+
+	for _, domain := range sortedNames(txtRecs, naming(s), s.get(updateDomain.env)) {
+		fmt.Fprintf(r.stdout, "%v\tTXT\t%v\n", domain, txtRecs[domain])
+	}
+	return exitOK, nil
+}
+
+func runValidate(ctx context.Context, r *runner, s settings) (int, error) {
+	txtRecs, err := flattenValid(r, s, nil)
+	if err != nil {
+		return exitError, err
 	}
+	fmt.Fprintf(r.stdout, "%d records valid for %v\n", len(txtRecs), strings.Join(strings.Fields(s.get(testIP.env)), ", "))
+	return exitOK, nil
+}
+
+func runPlan(ctx context.Context, r *runner, s settings) (int, error) {
+	var answers map[string][]string
+	if r.plan != nil {
+		answers = map[string][]string{}
+	}
+	txtRecs, err := flattenValid(r, s, answers)
+	if err != nil {
+		return exitError, err
+	}
+	opts, err := planOptions(s)
+	if err != nil {
+		return exitError, err
+	}
+	publisher, err := r.publisher(providerName(s), s, s.get(updateDomain.env), true)
+	if err != nil {
+		return exitError, err
+	}
+	current, err := publisher.ListRecords(ctx, s.get(updateDomain.env))
+	if err != nil {
+		return exitError, err
+	}
+	plan := provider.NewPlan(s.get(updateDomain.env), current, txtRecs, opts)
+
+	// Ranges moving between records is noise, what matters to a reviewer is which senders gain or lose authorization
+	var senders []dns.AuthorizedChange
+	var sendersErr error
+	if plan.Diff.HasChanges() {
+		r.previous = previousTree(r, s)
+		senders, sendersErr = authorizedChanges(r, s, current)
+	}
+	if r.plan != nil {
+		r.plan.Targets = append(r.plan.Targets, targetPlan{
+			UpdateDomain: s.get(updateDomain.env),
+			Provider:     providerName(s),
+			Desired:      txtRecs,
+			Current:      current,
+			Options:      opts,
+			Plan:         plan,
+			DNSAnswers:   answers,
+			Senders:      senders,
+		})
+	}
+	r.result.Diff = &plan.Diff
+	r.result.Senders = senders
+	fmt.Fprint(r.stdout, plan.Diff)
+	if sendersErr != nil {
+		r.warn("authorized senders could not be compared: %v", sendersErr)
+	} else if plan.Diff.HasChanges() {
+		printAuthorized(r.stdout, senders)
+	}
+	if plan.Diff.HasChanges() {
+		return exitChanges, nil
+	}
+	return exitOK, nil
+}
+
+// preparePlan starts gathering the plan file when one is to be written
+func preparePlan(r *runner, s settings, targets []settings) ([]settings, error) {
+	if s.get(planOut.env) != "" {
+		r.plan = &planFile{}
+	}
+	if s.get(previousPlan.env) != "" {
+		p, err := readPlan(s.get(previousPlan.env))
+		if err != nil {
+			return nil, err
+		}
+		r.previousPlan = p
+	}
+	return targets, nil
+}
+
+// finishPlan writes the plan file, unless a target failed and the plan is incomplete
+func finishPlan(r *runner, s settings, code int) error {
+	if r.plan == nil || code == exitError {
+		return nil
+	}
+	err := writePlan(s.get(planOut.env), r.plan)
+	if err != nil {
+		return err
+	}
+	if r.report != nil {
+		r.report.PlanFile = s.get(planOut.env)
+	}
+	fmt.Fprintf(r.stdout, "Saved the plan to %v, publish it with spf-flatten apply --plan %v\n", s.get(planOut.env), s.get(planOut.env))
+	return nil
+}
+
+func runApply(ctx context.Context, r *runner, s settings) (int, error) {
+	if r.plan != nil {
+		return applyPlan(ctx, r, s)
+	}
+	txtRecs, err := flattenValid(r, s, nil)
+	if err != nil {
+		return exitError, err
+	}
+	opts, err := planOptions(s)
+	if err != nil {
+		return exitError, err
+	}
+	publisher, err := r.publisher(providerName(s), s, s.get(updateDomain.env), s.isTrue(dryRun.env))
+	if err != nil {
+		return exitError, err
+	}
+
+	// Publish through the provider neutral pipeline
+	diff, err := provider.Publish(ctx, publisher, s.get(updateDomain.env), txtRecs, opts)
+	if err != nil {
+		return exitError, fmt.Errorf("updating records: %v", err)
+	}
+	return published(r, s, publisher, txtRecs, diff)
+}
+
+// published reports what was published and, when asked to, waits for Route53 to serve it
+func published(r *runner, s settings, publisher provider.Publisher, txtRecs map[string]string, diff provider.Diff) (int, error) {
+	r.result.Diff = &diff
+	r.result.DryRun = s.isTrue(dryRun.env)
+	fmt.Fprint(r.stdout, diff)
+	if s.isTrue(dryRun.env) {
+		if diff.HasChanges() {
+			return exitChanges, nil
+		}
+		return exitOK, nil
+	}
+
+	// Optionally confirm Route53 is serving the new records
+	if r53updater, ok := publisher.(*r53.Route53Updater); ok && r53updater.WaitForSync && diff.HasChanges() {
+		err := r53updater.VerifyTXTRecords(txtRecs)
+		if err != nil {
+			return exitError, err
+		}
+		r.result.Verified = true
+		fmt.Fprintln(r.stdout, "TXT records verified against authoritative nameservers")
+	}
+	return exitOK, nil
+}
+
+// prepareApply loads the plan file to publish, whose domains are the targets unless others are given
+func prepareApply(r *runner, s settings, targets []settings) ([]settings, error) {
+	if s.get(planPath.env) == "" {
+		return targets, nil
+	}
+	p, err := readPlan(s.get(planPath.env))
+	if err != nil {
+		return nil, err
+	}
+	r.plan = p
+	return planTargets(targets, p), nil
+}
+
+// finishApply fails when part of the plan file was left unpublished
+func finishApply(r *runner, s settings, code int) error {
+	if r.plan == nil || code == exitError {
+		return nil
+	}
+	if domains := r.plan.unapplied(); len(domains) > 0 {
+		return fmt.Errorf("the plan for %v was not applied", strings.Join(domains, ", "))
+	}
+	return nil
+}
+
+func runInspect(ctx context.Context, r *runner, s settings) (int, error) {
+	tree, err := includeTree(r.newDNS(), s)
+	if err != nil {
+		return exitError, err
+	}
+	r.result.Tree = tree
+	r.result.Lookups = tree.Lookups()
+	printInclude(r.stdout, tree, 0)
+	lookups := tree.Lookups()
+	if lookups > dns.MaxLookups {
+		r.result.Warnings = append(r.result.Warnings, fmt.Sprintf("%d DNS lookups is over the %d RFC 7208 allows", lookups, dns.MaxLookups))
+		fmt.Fprintf(r.stdout, "\n%d DNS lookups, over the %d RFC 7208 allows\n", lookups, dns.MaxLookups)
+	} else {
+		fmt.Fprintf(r.stdout, "\n%d DNS lookups, within the %d RFC 7208 allows\n", lookups, dns.MaxLookups)
+	}
+	return exitOK, nil
+}
+
+// includeTree looks up the include tree of the inline template, or else of the template domain, with d
+func includeTree(d dns.DNS, s settings) (*dns.Include, error) {
+	record, err := inlineTemplate(s)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		err := s.require(templateDomain)
+		if err != nil {
+			return nil, err
+		}
+		return d.IncludeTree(s.get(templateDomain.env))
+	}
+	root := &dns.Include{Domain: s.get(updateDomain.env), Mechanisms: record.Mechanisms}
+	if root.Domain == "" {
+		root.Domain = "inline template"
+	}
+	for _, mech := range record.Mechanisms {
+		if domain, ok := strings.CutPrefix(mech, "include:"); ok {
+			child, err := d.IncludeTree(domain)
+			if err != nil {
+				return nil, err
+			}
+			root.Includes = append(root.Includes, child)
+		}
+	}
+	return root, nil
+}
+
+// printInclude writes a record's domain, its terms other than includes with ip4 and ip6 counted, and then its includes indented below
+func printInclude(w io.Writer, include *dns.Include, depth int) {
+	var terms []string
+	counts := map[string]int{}
+	for _, mech := range include.Mechanisms {
+		switch {
+		case strings.HasPrefix(mech, "include:"):
+		case strings.HasPrefix(mech, "ip4:"), strings.HasPrefix(mech, "ip6:"):
+			counts[mech[:3]]++
+		default:
+			terms = append(terms, mech)
+		}
+	}
+	for _, kind := range []string{"ip6", "ip4"} {
+		if counts[kind] > 0 {
+			terms = append([]string{fmt.Sprintf("%d %v", counts[kind], kind)}, terms...)
+		}
+	}
+	line := fmt.Sprintf("%v%v (%d lookups)", strings.Repeat("  ", depth), include.Domain, include.Lookups())
+	if len(terms) > 0 {
+		line += ": " + strings.Join(terms, ", ")
+	}
+	fmt.Fprintln(w, line)
+	for _, child := range include.Includes {
+		printInclude(w, child, depth+1)
+	}
+}
+
+// sortedNames orders the root record first and then the leaves by the number naming gives them
+func sortedNames(txtRecs map[string]string, naming dns.Naming, domain string) []string {
+	var names []string
+	for name := range txtRecs {
+		names = append(names, name)
+	}
+	order := func(name string) int {
+		if provider.Fqdn(name) == provider.Fqdn(domain) {
+			return 0
+		}
+		if num, ok := naming.LeafNumber(name, domain); ok {
+			return num
+		}
+		// SplitSPFRecords names nothing else, but should anything else turn up it goes last
+		return math.MaxInt
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if oi, oj := order(names[i]), order(names[j]); oi != oj {
+			return oi < oj
+		}
+		return names[i] < names[j]
+	})
+	return names
 }
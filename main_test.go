@@ -0,0 +1,680 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dns "github.com/searchspring.com/spf-flatten/dns"
+	"github.com/searchspring.com/spf-flatten/provider"
+	"github.com/stretchr/testify/require"
+)
+
+// zone answers TXT lookups for the template domain and its includes
+type zone map[string][]string
+
+func (s zone) LookupTXT(cxt context.Context, host string) ([]string, error) {
+	if txt, ok := s[host]; ok {
+		return txt, nil
+	}
+	return nil, fmt.Errorf("no such host %v", host)
+}
+
+func withTemplate(t *testing.T, z zone) {
+	newDNS = func() dns.DNS {
+		return dns.DNS{NetworkHandler: z}
+	}
+	t.Cleanup(func() { newDNS = dns.New })
+}
+
+var template = zone{
+	"template.example.com": {"v=spf1 include:_spf.vendor.com ip4:203.0.113.1 ~all"},
+	"_spf.vendor.com":      {"v=spf1 include:_net.vendor.com a:mail.vendor.com -all"},
+	"_net.vendor.com":      {"v=spf1 ip4:192.0.2.0/24 ip6:2001:db8::/32 -all"},
+}
+
+func runCLI(args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := run(args, &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestUsage(t *testing.T) {
+	code, _, stderr := runCLI()
+	require.Equal(t, exitError, code)
+	require.Contains(t, stderr, "Usage: spf-flatten <command> [flags]")
+
+	code, stdout, _ := runCLI("--help")
+	require.Equal(t, exitOK, code)
+	require.Contains(t, stdout, "  inspect   Show the include tree")
+
+	code, _, stderr = runCLI("publish")
+	require.Equal(t, exitError, code)
+	require.Contains(t, stderr, `unknown command "publish"`)
+
+	code, _, stderr = runCLI("plan", "--help")
+	require.Equal(t, exitOK, code)
+	require.Contains(t, stderr, "Usage: spf-flatten plan [flags]")
+	require.Contains(t, stderr, "-update-domain value")
+	require.Contains(t, stderr, "($UPDATE_DOMAIN)")
+
+	code, _, stderr = runCLI("flatten", "--dry-run")
+	require.Equal(t, exitError, code)
+	require.Contains(t, stderr, "flag provided but not defined: -dry-run")
+}
+
+func TestFlagsOverrideEnv(t *testing.T) {
+	t.Setenv("CLOUDFLARE_API_TOKEN", "cf-token-123")
+	t.Setenv("UPDATE_DOMAIN", "example.net")
+	t.Setenv("PRIVATE_ZONE", "true")
+	s := settings{}
+	fs := newFlagSet("plan", providerSettings, s)
+	fs.SetOutput(&bytes.Buffer{})
+	require.Nil(t, fs.Parse([]string{"--private-zone=false", "--provider", "cloudflare"}))
+	require.Equal(t, settings{"CLOUDFLARE_API_TOKEN": "cf-token-123", "PRIVATE_ZONE": "false", "PROVIDER": "cloudflare"}, s)
+
+	var help bytes.Buffer
+	fs.SetOutput(&help)
+	fs.PrintDefaults()
+	require.NotContains(t, help.String(), "cf-token-123")
+}
+
+func TestFlatten(t *testing.T) {
+	withTemplate(t, template)
+	t.Setenv("TEMPLATE_DOMAIN", "template.example.com")
+	t.Setenv("UPDATE_DOMAIN", "example.net")
+	code, stdout, _ := runCLI("flatten", "--update-domain", "example.org")
+	require.Equal(t, exitOK, code)
+	require.Equal(t, "example.org\tTXT\tv=spf1 include:_spf1.example.org ~all\n"+
+		"_spf1.example.org\tTXT\tv=spf1 ip4:192.0.2.0/24 ip6:2001:db8::/32 a:mail.vendor.com ip4:203.0.113.1 ~all\n", stdout)
+
+	code, stdout, _ = runCLI("flatten", "--export", "dnscontrol")
+	require.Equal(t, exitOK, code)
+	require.Contains(t, stdout, `TXT("_spf1", "v=spf1 ip4:192.0.2.0/24`)
+
+	code, _, stderr := runCLI("flatten", "--template-domain", "missing.example.com")
+	require.Equal(t, exitError, code)
+	require.Equal(t, "spf-flatten flatten: looking up the template: no such host missing.example.com\n", stderr)
+}
+
+func TestSortedNames(t *testing.T) {
+	txtRecs := map[string]string{"example.org": ""}
+	for _, num := range []int{10, 2, 1, 11, 3} {
+		txtRecs[dns.Naming{Pattern: "{n}._spf"}.Leaf(num, "example.org")] = ""
+	}
+	require.Equal(t, []string{"example.org", "1._spf.example.org", "2._spf.example.org", "3._spf.example.org", "10._spf.example.org", "11._spf.example.org"},
+		sortedNames(txtRecs, dns.Naming{Pattern: "{n}._spf"}, "example.org"))
+}
+
+func TestInlineTemplate(t *testing.T) {
+	withTemplate(t, template)
+	t.Setenv("TEMPLATE_DOMAIN", "template.example.com")
+	t.Setenv("TEMPLATE_IP4", "198.51.100.1")
+	code, stdout, _ := runCLI("flatten", "--update-domain", "example.org", "--include", "_net.vendor.com", "--ip4", "203.0.113.0/24", "--ip4", "203.0.113.128/25", "--mx", "example.org")
+	require.Equal(t, exitOK, code)
+	require.Equal(t, "example.org\tTXT\tv=spf1 include:_spf1.example.org ~all\n"+
+		"_spf1.example.org\tTXT\tv=spf1 ip4:192.0.2.0/24 ip6:2001:db8::/32 ip4:203.0.113.0/24 ip4:203.0.113.128/25 mx:example.org ~all\n", stdout)
+
+	code, _, stderr := runCLI("flatten", "--update-domain", "example.org", "--ip4", "2001:db8::/32")
+	require.Equal(t, exitError, code)
+	require.Equal(t, "spf-flatten flatten: ip4: \"2001:db8::/32\" is not an IPv4 address or range\n", stderr)
+
+	// Bare a and mx are the record's own domain, which is UPDATE_DOMAIN once flattened into leaves
+	code, stdout, _ = runCLI("flatten", "--update-domain", "example.org", "--ip4", "203.0.113.1", "--a", "@", "--mx", "@/24", "--a", "mail.example.org/24//64", "--mx", "example.net//64")
+	require.Equal(t, exitOK, code)
+	require.Equal(t, "example.org\tTXT\tv=spf1 include:_spf1.example.org ~all\n"+
+		"_spf1.example.org\tTXT\tv=spf1 ip4:203.0.113.1 a:example.org a:mail.example.org/24//64 mx:example.org/24 mx:example.net//64 ~all\n", stdout)
+
+	for _, value := range []string{"example.org/33", "example.org//129", "example.org/", "example.org/24/64", "a:example.org"} {
+		require.NotNil(t, checkMechanism("a", value), value)
+	}
+	require.Nil(t, checkMechanism("mx", ""))
+
+	code, stdout, _ = runCLI("inspect", "--include", "_spf.vendor.com", "--ip6", "2001:db8::1")
+	require.Equal(t, exitOK, code)
+	require.Equal(t, `inline template (3 lookups): 1 ip4, 1 ip6
+  _spf.vendor.com (2 lookups): a:mail.vendor.com, -all
+    _net.vendor.com (0 lookups): 1 ip4, 1 ip6, -all
+
+3 DNS lookups, within the 10 RFC 7208 allows
+`, stdout)
+}
+
+func TestValidate(t *testing.T) {
+	withTemplate(t, template)
+	code, _, stderr := runCLI("validate", "--template-domain", "template.example.com", "--update-domain", "example.org")
+	require.Equal(t, exitError, code)
+	require.Equal(t, "spf-flatten validate: you must set --test-ip or the TEST_IP ENV variable\n", stderr)
+
+	code, stdout, _ := runCLI("validate", "--template-domain", "template.example.com", "--update-domain", "example.org", "--test-ip", "192.0.2.10")
+	require.Equal(t, exitOK, code)
+	require.Equal(t, "2 records valid for 192.0.2.10\n", stdout)
+}
+
+func TestPlanAndApply(t *testing.T) {
+	withTemplate(t, template)
+	path := filepath.Join(t.TempDir(), "spf.zone")
+	t.Setenv("TEMPLATE_DOMAIN", "template.example.com")
+	t.Setenv("UPDATE_DOMAIN", "example.org")
+	t.Setenv("TEST_IP", "192.0.2.10")
+	t.Setenv("PROVIDER", "zonefile")
+	t.Setenv("ZONEFILE_PATH", path)
+
+	code, stdout, _ := runCLI("plan")
+	require.Equal(t, exitChanges, code)
+	require.Contains(t, stdout, "2 added, 0 modified, 0 deleted, 0 unchanged\n")
+	require.NoFileExists(t, path)
+
+	code, _, _ = runCLI("apply", "--dry-run")
+	require.Equal(t, exitChanges, code)
+	require.NoFileExists(t, path)
+
+	code, stdout, _ = runCLI("apply")
+	require.Equal(t, exitOK, code)
+	require.Contains(t, stdout, "2 added, 0 modified, 0 deleted, 0 unchanged\n")
+	content, err := os.ReadFile(path)
+	require.Nil(t, err)
+	require.Contains(t, string(content), "_spf1.example.org.")
+
+	code, stdout, _ = runCLI("plan")
+	require.Equal(t, exitOK, code)
+	require.Contains(t, stdout, "0 added, 0 modified, 0 deleted, 2 unchanged\n")
+
+	code, _, stderr := runCLI("plan", "--provider", "bind")
+	require.Equal(t, exitError, code)
+	require.Equal(t, "spf-flatten plan: unknown PROVIDER \"bind\"\n", stderr)
+}
+
+func TestPlanAuthorizedSenders(t *testing.T) {
+	withTemplate(t, template)
+	t.Setenv("TEMPLATE_DOMAIN", "template.example.com")
+	t.Setenv("UPDATE_DOMAIN", "example.org")
+	t.Setenv("TEST_IP", "192.0.2.10")
+	t.Setenv("PROVIDER", "zonefile")
+	t.Setenv("ZONEFILE_PATH", filepath.Join(t.TempDir(), "spf.zone"))
+
+	code, stdout, _ := runCLI("plan")
+	require.Equal(t, exitChanges, code)
+	require.Contains(t, stdout, "Authorized senders:\n  _spf.vendor.com: 3 added, 0 removed\n    + a:mail.vendor.com\n    + ip4:192.0.2.0/24\n    + ip6:2001:db8::/32\n  template.example.com: 1 added, 0 removed\n    + ip4:203.0.113.1/32\n")
+	applied := filepath.Join(t.TempDir(), "applied.json")
+	code, _, _ = runCLI("plan", "--out", applied)
+	require.Equal(t, exitChanges, code)
+	code, _, _ = runCLI("apply", "--plan", applied)
+	require.Equal(t, exitOK, code)
+
+	// The vendor swaps its IPv6 range for another address and the template drops its own, all landing in _spf1
+	withTemplate(t, zone{
+		"template.example.com": {"v=spf1 include:_spf.vendor.com ~all"},
+		"_spf.vendor.com":      {"v=spf1 include:_net.vendor.com a:mail.vendor.com -all"},
+		"_net.vendor.com":      {"v=spf1 ip4:192.0.2.0/24 ip4:198.51.100.7 -all"},
+	})
+	code, stdout, _ = runCLI("plan")
+	require.Equal(t, exitChanges, code)
+	require.Contains(t, stdout, "0 added, 1 modified, 0 deleted, 1 unchanged\nAuthorized senders:\n  _spf.vendor.com: 1 added, 0 removed\n    + ip4:198.51.100.7/32\n  origin unknown: 0 added, 2 removed\n    - ip4:203.0.113.1/32\n    - ip6:2001:db8::/32\n")
+
+	// The answers of the plan the records were applied from tell where each range came from
+	code, stdout, _ = runCLI("plan", "--previous-plan", applied)
+	require.Equal(t, exitChanges, code)
+	require.Contains(t, stdout, "Authorized senders:\n  _spf.vendor.com: 1 added, 1 removed\n    + ip4:198.51.100.7/32\n    - ip6:2001:db8::/32\n  template.example.com: 0 added, 1 removed\n    - ip4:203.0.113.1/32\n")
+
+	code, _, stderr := runCLI("plan", "--previous-plan", filepath.Join(t.TempDir(), "missing.json"))
+	require.Equal(t, exitError, code)
+	require.Contains(t, stderr, "missing.json: no such file or directory")
+
+	// Only moving ranges around the records authorizes no one new
+	withTemplate(t, zone{
+		"template.example.com": {"v=spf1 ip4:203.0.113.1 include:_spf.vendor.com ~all"},
+		"_spf.vendor.com":      template["_spf.vendor.com"],
+		"_net.vendor.com":      template["_net.vendor.com"],
+	})
+	code, stdout, _ = runCLI("plan")
+	require.Equal(t, exitChanges, code)
+	require.Contains(t, stdout, "The same senders stay authorized\n")
+
+	// What the vendor's range shrinks by is put down to the vendor, splitting it in two changes nothing
+	withTemplate(t, zone{
+		"template.example.com": template["template.example.com"],
+		"_spf.vendor.com":      template["_spf.vendor.com"],
+		"_net.vendor.com":      {"v=spf1 ip4:192.0.2.0/25 ip6:2001:db8::/33 ip6:2001:db8:8000::/33 -all"},
+	})
+	code, stdout, _ = runCLI("plan")
+	require.Equal(t, exitChanges, code)
+	require.Contains(t, stdout, "Authorized senders:\n  _spf.vendor.com: 0 added, 1 removed\n    - ip4:192.0.2.128/25\n")
+
+	// A range gone altogether is put down to the include whose answers held it last run
+	previous, err := dns.DNS{NetworkHandler: template}.IncludeTree("template.example.com")
+	require.Nil(t, err)
+	dropped := zone{
+		"template.example.com": template["template.example.com"],
+		"_spf.vendor.com":      template["_spf.vendor.com"],
+		"_net.vendor.com":      {"v=spf1 ip6:2001:db8::/32 -all"},
+	}
+	withTemplate(t, dropped)
+	tree, err := dns.DNS{NetworkHandler: dropped}.IncludeTree("template.example.com")
+	require.Nil(t, err)
+	current := []provider.Record{
+		{Name: "example.org.", Values: []string{"v=spf1 include:_spf1.example.org ~all"}},
+		{Name: "_spf1.example.org.", Values: []string{"v=spf1 ip4:192.0.2.0/24 ip6:2001:db8::/32 a:mail.vendor.com ip4:203.0.113.1 ~all"}},
+	}
+	s := settings{"UPDATE_DOMAIN": "example.org"}
+	changes, err := authorizedChangesFrom(&runner{}, s, tree, current)
+	require.Nil(t, err)
+	require.Equal(t, []dns.AuthorizedChange{{Source: "", Removed: []string{"ip4:192.0.2.0/24"}}}, changes)
+	changes, err = authorizedChangesFrom(&runner{previous: previous}, s, tree, current)
+	require.Nil(t, err)
+	require.Equal(t, []dns.AuthorizedChange{{Source: "_spf.vendor.com", Removed: []string{"ip4:192.0.2.0/24"}}}, changes)
+}
+
+func TestPlanFile(t *testing.T) {
+	withTemplate(t, template)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "spf.zone")
+	planPath := filepath.Join(dir, "spf.plan")
+	t.Setenv("TEMPLATE_DOMAIN", "template.example.com")
+	t.Setenv("TEST_IP", "192.0.2.10")
+	t.Setenv("PROVIDER", "zonefile")
+	t.Setenv("ZONEFILE_PATH", path)
+
+	code, stdout, _ := runCLI("plan", "--update-domain", "example.org", "--out", planPath)
+	require.Equal(t, exitChanges, code)
+	require.Contains(t, stdout, "Saved the plan to "+planPath)
+	p, err := readPlan(planPath)
+	require.Nil(t, err)
+	require.Len(t, p.Targets, 1)
+	require.Equal(t, "zonefile", p.Targets[0].Provider)
+	require.Equal(t, template["_spf.vendor.com"], p.Targets[0].DNSAnswers["_spf.vendor.com"])
+	require.Len(t, p.Targets[0].Plan.Changes, 2)
+
+	// The plan is published as it is, even once the template has changed
+	withTemplate(t, zone{})
+	code, stdout, _ = runCLI("apply", "--plan", planPath)
+	require.Equal(t, exitOK, code)
+	require.Contains(t, stdout, "2 added, 0 modified, 0 deleted, 0 unchanged\n")
+	content, err := os.ReadFile(path)
+	require.Nil(t, err)
+	require.Contains(t, string(content), "_spf1.example.org.")
+
+	// The zone no longer holds what the plan was made against
+	code, _, stderr := runCLI("apply", "--plan", planPath)
+	require.Equal(t, exitError, code)
+	require.Equal(t, "spf-flatten apply: _spf1.example.org., example.org. changed since the plan was made, make a new plan\n", stderr)
+
+	code, _, stderr = runCLI("apply", "--plan", planPath, "--update-domain", "example.net")
+	require.Equal(t, exitError, code)
+	require.Equal(t, "spf-flatten apply: example.net is not in the plan\n", stderr)
+
+	code, _, stderr = runCLI("apply", "--plan", planPath, "--provider", "route53")
+	require.Equal(t, exitError, code)
+	require.Equal(t, "spf-flatten apply: the plan was made for the zonefile provider, not route53\n", stderr)
+
+	planContent, err := os.ReadFile(planPath)
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(planPath, bytes.Replace(planContent, []byte("example.org"), []byte("example.net"), -1), 0644))
+	code, _, stderr = runCLI("apply", "--plan", planPath)
+	require.Equal(t, exitError, code)
+	require.Equal(t, "spf-flatten apply: "+planPath+": hash does not match the plan, it was changed since it was made\n", stderr)
+}
+
+func TestJSONOutput(t *testing.T) {
+	withTemplate(t, template)
+	t.Setenv("TEMPLATE_DOMAIN", "template.example.com")
+	t.Setenv("UPDATE_DOMAIN", "example.org")
+	t.Setenv("TEST_IP", "192.0.2.10")
+	t.Setenv("PROVIDER", "zonefile")
+	t.Setenv("ZONEFILE_PATH", filepath.Join(t.TempDir(), "spf.zone"))
+
+	code, stdout, stderr := runCLI("plan", "--output", "json")
+	require.Equal(t, exitChanges, code)
+	require.Contains(t, stderr, "2 added, 0 modified, 0 deleted, 0 unchanged\n")
+	var rep report
+	require.Nil(t, json.Unmarshal([]byte(stdout), &rep))
+	require.Equal(t, reportVersion, rep.Version)
+	require.Equal(t, "plan", rep.Command)
+	require.Equal(t, exitChanges, rep.ExitCode)
+	require.Len(t, rep.Targets, 1)
+	target := rep.Targets[0]
+	require.Equal(t, "example.org", target.UpdateDomain)
+	require.Equal(t, "v=spf1 include:_spf1.example.org ~all", target.Records["example.org"])
+	require.Equal(t, 2, target.Lookups)
+	require.Equal(t, []validation{{IP: "192.0.2.10", Valid: true}}, target.Validation)
+	require.Len(t, target.Diff.Added, 2)
+	require.Len(t, target.Senders, 2)
+	require.Equal(t, exitChanges, target.ExitCode)
+
+	code, stdout, _ = runCLI("flatten", "--output", "json", "--export", "dnscontrol")
+	require.Equal(t, exitOK, code)
+	rep = report{}
+	require.Nil(t, json.Unmarshal([]byte(stdout), &rep))
+	require.Contains(t, rep.Targets[0].Export, "// BEGIN spf-flatten")
+
+	code, stdout, _ = runCLI("inspect", "--output", "json")
+	require.Equal(t, exitOK, code)
+	rep = report{}
+	require.Nil(t, json.Unmarshal([]byte(stdout), &rep))
+	require.Equal(t, "_spf.vendor.com", rep.Targets[0].Tree.Includes[0].Domain)
+	require.Equal(t, 3, rep.Targets[0].Lookups)
+
+	code, stdout, stderr = runCLI("validate", "--output", "json", "--template-domain", "missing.example.com")
+	require.Equal(t, exitError, code)
+	require.Equal(t, "spf-flatten validate: looking up the template: no such host missing.example.com\n", stderr)
+	rep = report{}
+	require.Nil(t, json.Unmarshal([]byte(stdout), &rep))
+	require.Equal(t, "looking up the template: no such host missing.example.com", rep.Targets[0].Error)
+	require.Equal(t, exitError, rep.ExitCode)
+
+	code, _, stderr = runCLI("validate", "--output", "yaml")
+	require.Equal(t, exitError, code)
+	require.Equal(t, "spf-flatten validate: OUTPUT must be text or json, not \"yaml\"\n", stderr)
+}
+
+func TestLogging(t *testing.T) {
+	withTemplate(t, template)
+	args := []string{"validate", "--template-domain", "template.example.com", "--update-domain", "example.org", "--test-ip", "192.0.2.10"}
+
+	code, _, stderr := runCLI(args...)
+	require.Equal(t, exitOK, code)
+	require.Empty(t, stderr)
+
+	code, _, stderr = runCLI(append(args, "--log-level", "debug", "--log-format", "json")...)
+	require.Equal(t, exitOK, code)
+	var chains []string
+	for _, line := range strings.Split(strings.TrimSpace(stderr), "\n") {
+		var entry map[string]interface{}
+		require.Nil(t, json.Unmarshal([]byte(line), &entry), line)
+		require.Equal(t, "DEBUG", entry["level"])
+		if entry["msg"] == "flattening include" {
+			chains = append(chains, entry["chain"].(string))
+		}
+	}
+	require.Equal(t, []string{"_spf.vendor.com", "_spf.vendor.com -> _net.vendor.com"}, chains)
+
+	code, _, stderr = runCLI(append(args, "--log-level", "loud")...)
+	require.Equal(t, exitError, code)
+	require.Equal(t, "spf-flatten validate: LOG_LEVEL must be debug, info, warn or error, not \"loud\"\n", stderr)
+}
+
+func TestSchedule(t *testing.T) {
+	now := time.Date(2024, 5, 1, 10, 20, 0, 0, time.UTC)
+	sc, err := parseSchedule("", "")
+	require.Nil(t, err)
+	require.Equal(t, now.Add(time.Hour), sc.next(now))
+
+	sc, err = parseSchedule("*/15 * * * *", "")
+	require.Nil(t, err)
+	require.Equal(t, time.Date(2024, 5, 1, 10, 30, 0, 0, time.UTC), sc.next(now))
+
+	sc, err = parseSchedule("@daily", "10m")
+	require.Nil(t, err)
+	for i := 0; i < 20; i++ {
+		next := sc.next(now)
+		midnight := time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC)
+		require.False(t, next.Before(midnight))
+		require.True(t, next.Before(midnight.Add(10*time.Minute)))
+
+		// Runs brought forward by an answer expiring are jittered too, and wait at least minTTLWait
+		expiry := sc.expiring(now, 0)
+		require.False(t, expiry.Before(now.Add(minTTLWait)))
+		require.True(t, expiry.Before(now.Add(minTTLWait+10*time.Minute)))
+	}
+	require.Equal(t, now.Add(5*time.Minute), schedule{every: time.Hour}.expiring(now, 5*time.Minute))
+
+	ttls := &ttlRecorder{}
+	ttls.note(time.Hour)
+	ttls.note(0)
+	ttls.note(time.Minute)
+	require.True(t, ttls.noted)
+	require.Equal(t, time.Duration(0), ttls.lowest)
+
+	_, err = parseSchedule("0s", "")
+	require.EqualError(t, err, `schedule "0s" must be a positive interval`)
+	_, err = parseSchedule("1h", "soon")
+	require.EqualError(t, err, `jitter "soon" must be a duration such as 5m`)
+}
+
+func TestServe(t *testing.T) {
+	withTemplate(t, template)
+	path := filepath.Join(t.TempDir(), "spf.zone")
+	t.Setenv("TEMPLATE_DOMAIN", "template.example.com")
+	t.Setenv("UPDATE_DOMAIN", "example.org")
+	t.Setenv("TEST_IP", "192.0.2.10")
+	t.Setenv("PROVIDER", "zonefile")
+	t.Setenv("ZONEFILE_PATH", path)
+	t.Setenv("LISTEN_ADDR", "127.0.0.1:0")
+	serveContext = func(ctx context.Context) (context.Context, context.CancelFunc) {
+		return context.WithTimeout(ctx, 300*time.Millisecond)
+	}
+	t.Cleanup(func() { serveContext = defaultServeContext })
+
+	code, stdout, stderr := runCLI("serve", "--schedule", "50ms")
+	require.Equal(t, exitOK, code)
+	require.Equal(t, "", stdout)
+	// Only the first run publishes, the later ones find the same senders authorized
+	require.Equal(t, 1, strings.Count(stderr, "msg=published"))
+	require.Contains(t, stderr, "msg=\"authorized senders unchanged, not publishing\" domain=example.org")
+	require.Contains(t, stderr, "msg=\"shutting down once the runs in progress finish\"")
+	content, err := os.ReadFile(path)
+	require.Nil(t, err)
+	require.Contains(t, string(content), "_spf1.example.org.")
+
+	code, _, stderr = runCLI("serve", "--schedule", "hourly")
+	require.Equal(t, exitError, code)
+	require.Contains(t, stderr, `spf-flatten serve: example.org: schedule "hourly" is neither an interval`)
+
+	// The HTTP server failing stops serve rather than leaving it running without its endpoints. Without a LISTEN_ADDR
+	// it only listens locally, as the endpoints take no credentials.
+	t.Setenv("LISTEN_ADDR", "")
+	var listened string
+	listen = func(network string, addr string) (net.Listener, error) {
+		listened = addr
+		return brokenListener{}, nil
+	}
+	t.Cleanup(func() { listen = net.Listen })
+	serveContext = func(ctx context.Context) (context.Context, context.CancelFunc) {
+		return context.WithTimeout(ctx, time.Minute)
+	}
+	code, _, stderr = runCLI("serve")
+	require.Equal(t, exitError, code)
+	require.Contains(t, stderr, "spf-flatten serve: serving HTTP: accept: connection reset\n")
+	require.Equal(t, "127.0.0.1:8080", listened)
+}
+
+// brokenListener fails to accept any connection
+type brokenListener struct{}
+
+func (brokenListener) Accept() (net.Conn, error) {
+	return nil, &net.OpError{Op: "accept", Err: errors.New("connection reset")}
+}
+func (brokenListener) Close() error   { return nil }
+func (brokenListener) Addr() net.Addr { return &net.TCPAddr{} }
+
+func TestMetrics(t *testing.T) {
+	withTemplate(t, template)
+	s := settings{
+		"TEMPLATE_DOMAIN": "template.example.com",
+		"UPDATE_DOMAIN":   "example.org",
+		"TEST_IP":         "192.0.2.10",
+		"PROVIDER":        "zonefile",
+		"ZONEFILE_PATH":   filepath.Join(t.TempDir(), "spf.zone"),
+	}
+	m := newServeMetrics()
+	r := &runner{stdout: io.Discard, logger: dns.LoggerOrDiscard(nil), result: &result{UpdateDomain: "example.org"}, metrics: m}
+	published, records, err := reflatten(context.Background(), r, s)
+	require.Nil(t, err)
+	require.True(t, published)
+	require.Len(t, records, 2)
+
+	// An include that no longer resolves fails the flatten
+	withTemplate(t, zone{"template.example.com": template["template.example.com"]})
+	_, _, err = reflatten(context.Background(), r, s)
+	require.NotNil(t, err)
+
+	// A provider that cannot be listed fails the publish
+	withTemplate(t, template)
+	s["ZONEFILE_PATH"] = filepath.Join(t.TempDir(), "missing", "spf.zone")
+	s["ZONEFILE_PATCH"] = "true"
+	_, _, err = reflatten(context.Background(), r, s)
+	require.NotNil(t, err)
+
+	rec := httptest.NewRecorder()
+	m.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+	require.Contains(t, body, `spf_flatten_records{domain="example.org"} 2`)
+	require.Contains(t, body, `spf_flatten_template_lookups{domain="example.org"} 3`)
+	require.Contains(t, body, `spf_flatten_record_bytes{domain="example.org",record="example.org"} 37`)
+	require.Contains(t, body, `spf_flatten_flatten_duration_seconds_count{domain="example.org"} 2`)
+	require.Contains(t, body, `spf_flatten_dns_errors_total{domain="example.org",include="_spf.vendor.com",rcode="error"} 1`)
+	require.Contains(t, body, `spf_flatten_publish_failures_total{domain="example.org",provider="zonefile"} 1`)
+	require.Contains(t, body, `spf_flatten_last_flatten_success_timestamp_seconds{domain="example.org"}`)
+	require.Contains(t, body, `spf_flatten_last_publish_success_timestamp_seconds{domain="example.org"}`)
+	require.Contains(t, body, `spf_flatten_last_check_success_timestamp_seconds{domain="example.org"}`)
+
+	require.Equal(t, "nxdomain", rcode(&net.DNSError{Err: "no such host", IsNotFound: true}))
+	require.Equal(t, "nodata", rcode(&net.DNSError{Err: dns.NoTXTRecords, IsNotFound: true}))
+	require.Equal(t, "nodata", rcode(fmt.Errorf("_spf.vendor.com: %w", &net.DNSError{Err: dns.NoTXTRecords, IsNotFound: true})))
+	require.Equal(t, "servfail", rcode(&net.DNSError{Err: "servfail"}))
+	require.Equal(t, "timeout", rcode(&net.DNSError{Err: "i/o timeout", IsTimeout: true}))
+	require.Equal(t, "error", rcode(fmt.Errorf("no such host _spf.vendor.com")))
+}
+
+// lookupCounter counts the TXT lookups made of a zone
+type lookupCounter struct {
+	zone
+	lookups int
+}
+
+func (c *lookupCounter) LookupTXT(ctx context.Context, host string) ([]string, error) {
+	c.lookups++
+	return c.zone.LookupTXT(ctx, host)
+}
+
+func TestReflattenUnchanged(t *testing.T) {
+	counter := &lookupCounter{zone: template}
+	newDNS = func() dns.DNS { return dns.DNS{NetworkHandler: counter} }
+	t.Cleanup(func() { newDNS = dns.New })
+	s := settings{
+		"TEMPLATE_DOMAIN": "template.example.com",
+		"UPDATE_DOMAIN":   "example.org",
+		"TEST_IP":         "192.0.2.10",
+		"PROVIDER":        "zonefile",
+		"ZONEFILE_PATH":   filepath.Join(t.TempDir(), "spf.zone"),
+	}
+	m := newServeMetrics()
+	r := &runner{stdout: io.Discard, logger: dns.LoggerOrDiscard(nil), result: &result{UpdateDomain: "example.org"}, metrics: m}
+	published, _, err := reflatten(context.Background(), r, s)
+	require.Nil(t, err)
+	require.True(t, published)
+	// The template and its two includes are looked up once, the tree coming from the same answers
+	require.Equal(t, 3, counter.lookups)
+	require.Equal(t, "_net.vendor.com", r.result.Tree.Includes[0].Includes[0].Domain)
+
+	// The vendor splitting its ranges authorizes the same senders, so nothing is published
+	counter.zone = zone{
+		"template.example.com": template["template.example.com"],
+		"_spf.vendor.com":      template["_spf.vendor.com"],
+		"_net.vendor.com":      {"v=spf1 ip4:192.0.2.128/25 ip4:192.0.2.0/25 ip6:2001:db8::/33 ip6:2001:db8:8000::/33 -all"},
+	}
+	published, records, err := reflatten(context.Background(), r, s)
+	require.Nil(t, err)
+	require.False(t, published)
+	// The records are confirmed up to date without counting as a publish
+	lastPublish := testutil.ToFloat64(m.lastPublish.WithLabelValues("example.org"))
+	require.Greater(t, testutil.ToFloat64(m.lastCheck.WithLabelValues("example.org")), lastPublish)
+	require.Equal(t, "_spf1.example.org.", records[1].Name)
+	require.Contains(t, records[1].Values[0], "ip4:192.0.2.0/24 ")
+}
+
+func TestStatusAPI(t *testing.T) {
+	withTemplate(t, template)
+	s := settings{
+		"TEMPLATE_DOMAIN": "template.example.com",
+		"UPDATE_DOMAIN":   "example.org",
+		"TEST_IP":         "192.0.2.10",
+		"PROVIDER":        "zonefile",
+		"ZONEFILE_PATH":   filepath.Join(t.TempDir(), "spf.zone"),
+	}
+	sc, err := parseSchedule("1h", "")
+	require.Nil(t, err)
+	job := &domainJob{s: s, domain: "example.org", schedule: sc, trigger: make(chan struct{}, 1), status: domainStatus{UpdateDomain: "example.org"}}
+	m := newServeMetrics()
+	handler := serveHandler(m, []*domainJob{job})
+	request := func(method string, target string) (int, string) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+		return rec.Code, rec.Body.String()
+	}
+
+	code, body := request(http.MethodGet, "/healthz")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "ok\n", body)
+	code, body = request(http.MethodGet, "/readyz")
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Equal(t, "waiting for a successful run of [example.org]\n", body)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		job.loop(ctx, &runner{logger: dns.LoggerOrDiscard(nil), metrics: m})
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	require.Eventually(t, func() bool { return job.currentStatus().LastResult == runPublished }, time.Second, 10*time.Millisecond)
+
+	code, _ = request(http.MethodGet, "/readyz")
+	require.Equal(t, http.StatusOK, code)
+	code, body = request(http.MethodGet, "/status")
+	require.Equal(t, http.StatusOK, code)
+	var status struct {
+		Domains []domainStatus `json:"domains"`
+	}
+	require.Nil(t, json.Unmarshal([]byte(body), &status))
+	require.Len(t, status.Domains, 1)
+	first := status.Domains[0]
+	require.Equal(t, "example.org", first.UpdateDomain)
+	require.Equal(t, []string{"_spf1.example.org.", "example.org."}, []string{first.Records[0].Name, first.Records[1].Name})
+	require.Equal(t, "template.example.com", first.Tree.Domain)
+	require.Equal(t, "", first.LastError)
+	require.True(t, first.NextRun.After(*first.LastRun))
+
+	code, _ = request(http.MethodGet, "/reflatten?domain=example.org")
+	require.Equal(t, http.StatusMethodNotAllowed, code)
+	code, body = request(http.MethodPost, "/reflatten?domain=example.net")
+	require.Equal(t, http.StatusNotFound, code)
+	require.Equal(t, `{"error":"\"example.net\" is not a managed domain"}`+"\n", body)
+
+	// The template breaking shows up once a triggered run fails
+	withTemplate(t, zone{})
+	code, _ = request(http.MethodPost, "/reflatten?domain=example.org.")
+	require.Equal(t, http.StatusAccepted, code)
+	require.Eventually(t, func() bool { return job.currentStatus().LastResult == runFailed }, time.Second, 10*time.Millisecond)
+	failed := job.currentStatus()
+	require.Contains(t, failed.LastError, "template.example.com")
+	require.Equal(t, first.Records, failed.Records)
+	require.True(t, first.LastSuccess.Equal(*failed.LastSuccess))
+}
+
+func TestInspect(t *testing.T) {
+	withTemplate(t, template)
+	code, stdout, _ := runCLI("inspect", "--template-domain", "template.example.com")
+	require.Equal(t, exitOK, code)
+	require.Equal(t, `template.example.com (3 lookups): 1 ip4, ~all
+  _spf.vendor.com (2 lookups): a:mail.vendor.com, -all
+    _net.vendor.com (0 lookups): 1 ip4, 1 ip6, -all
+
+3 DNS lookups, within the 10 RFC 7208 allows
+`, stdout)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	miekg "github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dns "github.com/searchspring.com/spf-flatten/dns"
+)
+
+// serveMetrics are the series serve exposes on /metrics, labelled by the domain they are about
+type serveMetrics struct {
+	registry        *prometheus.Registry
+	lastFlatten     *prometheus.GaugeVec
+	lastPublish     *prometheus.GaugeVec
+	lastCheck       *prometheus.GaugeVec
+	records         *prometheus.GaugeVec
+	templateLookups *prometheus.GaugeVec
+	recordBytes     *prometheus.GaugeVec
+	flattenDuration *prometheus.HistogramVec
+	dnsErrors       *prometheus.CounterVec
+	publishFailures *prometheus.CounterVec
+}
+
+func newServeMetrics() *serveMetrics {
+	m := &serveMetrics{
+		registry: prometheus.NewRegistry(),
+		lastFlatten: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "spf_flatten_last_flatten_success_timestamp_seconds",
+			Help: "When the template was last flattened into records that passed validation.",
+		}, []string{"domain"}),
+		lastPublish: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "spf_flatten_last_publish_success_timestamp_seconds",
+			Help: "When the flattened records were last published to the provider.",
+		}, []string{"domain"}),
+		lastCheck: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "spf_flatten_last_check_success_timestamp_seconds",
+			Help: "When the provider's records were last confirmed up to date, having been published or found to authorize the same senders.",
+		}, []string{"domain"}),
+		records: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "spf_flatten_records",
+			Help: "How many records the template was last flattened into.",
+		}, []string{"domain"}),
+		templateLookups: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "spf_flatten_template_lookups",
+			Help: "The DNS lookups evaluating the template takes, above 10 it would fail unflattened.",
+		}, []string{"domain"}),
+		recordBytes: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "spf_flatten_record_bytes",
+			Help: "The length of each flattened record.",
+		}, []string{"domain", "record"}),
+		flattenDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "spf_flatten_flatten_duration_seconds",
+			Help:    "How long resolving, flattening and validating the template took.",
+			Buckets: prometheus.ExponentialBuckets(0.05, 2, 10),
+		}, []string{"domain"}),
+		dnsErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "spf_flatten_dns_errors_total",
+			Help: "Failed TXT lookups of the template and its includes, by the name looked up and the response code.",
+		}, []string{"domain", "include", "rcode"}),
+		publishFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "spf_flatten_publish_failures_total",
+			Help: "Failures listing or publishing the records at the provider.",
+		}, []string{"domain", "provider"}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.lastFlatten, m.lastPublish, m.lastCheck, m.records, m.templateLookups, m.recordBytes, m.flattenDuration, m.dnsErrors, m.publishFailures,
+	)
+	return m
+}
+
+func (m *serveMetrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// flattened notes a flatten that passed validation
+func (m *serveMetrics) flattened(domain string, took time.Duration, txtRecs map[string]string) {
+	m.lastFlatten.WithLabelValues(domain).SetToCurrentTime()
+	m.flattenDuration.WithLabelValues(domain).Observe(took.Seconds())
+	m.records.WithLabelValues(domain).Set(float64(len(txtRecs)))
+	// Leaves no longer generated would otherwise keep their last length
+	m.recordBytes.DeletePartialMatch(prometheus.Labels{"domain": domain})
+	for name, value := range txtRecs {
+		m.recordBytes.WithLabelValues(domain, name).Set(float64(len(value)))
+	}
+}
+
+// countingNetwork counts the lookups that fail by name and response code
+type countingNetwork struct {
+	dns.NetworkInterface
+	errors *prometheus.CounterVec
+}
+
+func (n countingNetwork) LookupTXT(ctx context.Context, host string) ([]string, error) {
+	txt, err := n.NetworkInterface.LookupTXT(ctx, host)
+	if err != nil {
+		n.errors.WithLabelValues(host, rcode(err)).Inc()
+	}
+	return txt, err
+}
+
+// rcode names why a lookup failed, nxdomain, servfail and the like, nodata for a name without TXT records, or timeout
+// and error when there was no response code
+func rcode(err error) string {
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) {
+		return "error"
+	}
+	switch {
+	case dnsErr.IsTimeout:
+		return "timeout"
+	case dnsErr.IsNotFound && dnsErr.Err == dns.NoTXTRecords:
+		return "nodata"
+	case dnsErr.IsNotFound:
+		return "nxdomain"
+	}
+	for _, name := range miekg.RcodeToString {
+		if dnsErr.Err == strings.ToLower(name) {
+			return dnsErr.Err
+		}
+	}
+	return "error"
+}
@@ -0,0 +1,72 @@
+// Package oauth requests OAuth 2.0 access tokens from a token endpoint for the publishers of cloud DNS APIs
+// and caches them until shortly before they expire.
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TokenSource posts a form to a token endpoint for an access token
+type TokenSource struct {
+	URL string
+	// Form gives the parameters of a token request made at now, IE a client credentials grant or a signed assertion
+	Form   func(now time.Time) (url.Values, error)
+	Client *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// Token returns a valid access token, requesting a new one when the cached token is close to expiry
+func (t *TokenSource) Token(ctx context.Context) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	if t.token != "" && now.Add(time.Minute).Before(t.expires) {
+		return t.token, nil
+	}
+
+	form, err := t.Form(now)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.URL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	client := t.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int64  `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		return "", fmt.Errorf("token request: %v: %v", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK || body.AccessToken == "" {
+		return "", fmt.Errorf("token request: %v: %v %v", resp.Status, body.Error, body.ErrorDescription)
+	}
+	t.token = body.AccessToken
+	t.expires = now.Add(time.Duration(body.ExpiresIn) * time.Second)
+	return t.token, nil
+}
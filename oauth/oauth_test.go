@@ -0,0 +1,46 @@
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestToken(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		_ = r.ParseForm()
+		if r.Form.Get("client_secret") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client", "error_description": "Invalid client secret provided."})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "token", "expires_in": 3599})
+	}))
+	defer server.Close()
+
+	secret := "secret"
+	tokens := &TokenSource{URL: server.URL, Form: func(now time.Time) (url.Values, error) {
+		return url.Values{"client_secret": {secret}}, nil
+	}}
+	token, err := tokens.Token(context.TODO())
+	require.Nil(t, err)
+	require.Equal(t, "token", token)
+	// Cached until shortly before it expires
+	_, err = tokens.Token(context.TODO())
+	require.Nil(t, err)
+	require.Equal(t, 1, requests)
+
+	tokens = &TokenSource{URL: server.URL, Form: func(now time.Time) (url.Values, error) {
+		return url.Values{"client_secret": {"wrong"}}, nil
+	}}
+	_, err = tokens.Token(context.TODO())
+	require.EqualError(t, err, "token request: 401 Unauthorized: invalid_client Invalid client secret provided.")
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	dns "github.com/searchspring.com/spf-flatten/dns"
+	"github.com/searchspring.com/spf-flatten/provider"
+)
+
+// reportVersion is bumped whenever a field of the JSON report changes meaning or goes away, adding fields does not
+const reportVersion = 1
+
+// report is the JSON document --output json prints on stdout once the command is done
+type report struct {
+	Version int    `json:"version"`
+	Command string `json:"command"`
+	// Targets holds a result for each domain worked on, in the order they were
+	Targets []*result `json:"targets"`
+	// PlanFile is where plan --out saved the plan
+	PlanFile string `json:"plan_file,omitempty"`
+	// Error is why the command failed as a whole, IE an unreadable config or plan file
+	Error      string `json:"error,omitempty"`
+	ExitCode   int    `json:"exit_code"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+// result is what a command found for one domain
+type result struct {
+	UpdateDomain string `json:"update_domain,omitempty"`
+	// Records are the flattened records by name
+	Records map[string]string `json:"records,omitempty"`
+	// Export is the EXPORT rendering when it was not written to a file
+	Export string `json:"export,omitempty"`
+	// Lookups are the DNS lookups evaluating the records takes, or the template for inspect
+	Lookups    int          `json:"lookups"`
+	Validation []validation `json:"validation,omitempty"`
+	// Diff is how the provider's records differ from the flattened ones, the changes made for apply
+	Diff    *provider.Diff         `json:"diff,omitempty"`
+	Senders []dns.AuthorizedChange `json:"senders,omitempty"`
+	DryRun  bool                   `json:"dry_run,omitempty"`
+	// Verified is whether Route53 was confirmed to serve the records with WAIT_FOR_SYNC
+	Verified bool `json:"verified,omitempty"`
+	// Tree is the template's include tree for inspect
+	Tree       *dns.Include `json:"tree,omitempty"`
+	Warnings   []string     `json:"warnings,omitempty"`
+	Error      string       `json:"error,omitempty"`
+	ExitCode   int          `json:"exit_code"`
+	DurationMS int64        `json:"duration_ms"`
+}
+
+// validation is the outcome of checking the records with one TEST_IP
+type validation struct {
+	IP    string `json:"ip"`
+	Valid bool   `json:"valid"`
+	Error string `json:"error,omitempty"`
+}
+
+// checkOutput validates the OUTPUT setting
+func checkOutput(s settings) error {
+	switch s.get(output.env) {
+	case "", "text", "json":
+		return nil
+	}
+	return fmt.Errorf("OUTPUT must be text or json, not %q", s.get(output.env))
+}
+
+// newLogger builds the logger the packages log to, at LOG_LEVEL and in LOG_FORMAT
+func newLogger(s settings, w io.Writer) (*slog.Logger, error) {
+	var level slog.Level
+	if s.get(logLevel.env) != "" {
+		err := level.UnmarshalText([]byte(s.get(logLevel.env)))
+		if err != nil {
+			return nil, fmt.Errorf("LOG_LEVEL must be debug, info, warn or error, not %q", s.get(logLevel.env))
+		}
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	switch s.get(logFormat.env) {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("LOG_FORMAT must be text or json, not %q", s.get(logFormat.env))
+}
+
+// warn notes a problem that does not fail the target
+func (r *runner) warn(format string, args ...interface{}) {
+	warning := fmt.Sprintf(format, args...)
+	r.result.Warnings = append(r.result.Warnings, warning)
+	fmt.Fprintf(r.stdout, "Warning: %v\n", warning)
+}
+
+// writeReport prints the JSON report of the command
+func writeReport(w io.Writer, rep report, started time.Time) {
+	rep.Version = reportVersion
+	rep.DurationMS = time.Since(started).Milliseconds()
+	if rep.Targets == nil {
+		rep.Targets = []*result{}
+	}
+	content, _ := json.MarshalIndent(rep, "", "  ")
+	fmt.Fprintf(w, "%s\n", content)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	dns "github.com/searchspring.com/spf-flatten/dns"
+	"github.com/searchspring.com/spf-flatten/provider"
+)
+
+// planVersion is bumped whenever the plan file format changes in a way older releases cannot apply
+const planVersion = 1
+
+// planFile is what plan --out writes and apply --plan publishes
+type planFile struct {
+	Version int          `json:"version"`
+	Created time.Time    `json:"created"`
+	Targets []targetPlan `json:"targets"`
+	// Hash is the SHA-256 of the targets, a plan edited since it was written is refused
+	Hash string `json:"hash"`
+}
+
+// targetPlan is the plan made for one update domain
+type targetPlan struct {
+	UpdateDomain string `json:"update_domain"`
+	Provider     string `json:"provider"`
+	// Desired are the flattened records, Current what the provider held when the plan was made
+	Desired map[string]string    `json:"desired"`
+	Current []provider.Record    `json:"current"`
+	Options provider.PlanOptions `json:"options"`
+	Plan    provider.Plan        `json:"plan"`
+	// DNSAnswers are the TXT records the flattening was based on, by the name looked up
+	DNSAnswers map[string][]string `json:"dns_answers"`
+	// Senders are how the authorized senders change, by the include they come through
+	Senders []dns.AuthorizedChange `json:"senders"`
+
+	applied bool
+}
+
+func (p planFile) hash() (string, error) {
+	content, err := json.Marshal(p.Targets)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// writePlan hashes the plan and writes it to path
+func writePlan(path string, p *planFile) error {
+	p.Version = planVersion
+	p.Created = time.Now().UTC()
+	if p.Targets == nil {
+		p.Targets = []targetPlan{}
+	}
+	hash, err := p.hash()
+	if err != nil {
+		return err
+	}
+	p.Hash = hash
+	content, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(content, '\n'), 0644)
+}
+
+// readPlan loads a plan file, refusing one from another version or whose hash no longer matches
+func readPlan(path string) (*planFile, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var p planFile
+	err = json.Unmarshal(content, &p)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	if p.Version != planVersion {
+		return nil, fmt.Errorf("%v: plan version %d is not supported, make a new plan", path, p.Version)
+	}
+	hash, err := p.hash()
+	if err != nil {
+		return nil, err
+	}
+	if hash != p.Hash {
+		return nil, fmt.Errorf("%v: hash does not match the plan, it was changed since it was made", path)
+	}
+	return &p, nil
+}
+
+// target finds the plan of an update domain
+func (p *planFile) target(domain string) *targetPlan {
+	for i := range p.Targets {
+		if provider.Fqdn(p.Targets[i].UpdateDomain) == provider.Fqdn(domain) {
+			return &p.Targets[i]
+		}
+	}
+	return nil
+}
+
+// unapplied lists the update domains of the plan that were not published
+func (p *planFile) unapplied() []string {
+	var domains []string
+	for _, t := range p.Targets {
+		if !t.applied {
+			domains = append(domains, t.UpdateDomain)
+		}
+	}
+	sort.Strings(domains)
+	return domains
+}
+
+// planTargets gives a target for each domain in the plan when the command line names none
+func planTargets(targets []settings, p *planFile) []settings {
+	if len(targets) != 1 || targets[0].get(updateDomain.env) != "" {
+		return targets
+	}
+	var all []settings
+	for _, t := range p.Targets {
+		s := settings{}
+		for k, v := range targets[0] {
+			s[k] = v
+		}
+		s[updateDomain.env] = t.UpdateDomain
+		all = append(all, s)
+	}
+	return all
+}
+
+// applyPlan publishes the planned changes of a domain once the provider's records are confirmed to be those planned against
+func applyPlan(ctx context.Context, r *runner, s settings) (int, error) {
+	t := r.plan.target(s.get(updateDomain.env))
+	if t == nil {
+		return exitError, fmt.Errorf("%v is not in the plan", s.get(updateDomain.env))
+	}
+	name := t.Provider
+	if s.get("PROVIDER") != "" && providerName(s) != t.Provider {
+		return exitError, fmt.Errorf("the plan was made for the %v provider, not %v", t.Provider, providerName(s))
+	}
+	s["LEAF_NAMING"] = t.Options.Naming.Pattern
+	r.result.Records = t.Desired
+	r.result.Lookups = dns.RecordsLookups(t.Desired)
+	publisher, err := r.publisher(name, s, t.UpdateDomain, s.isTrue(dryRun.env))
+	if err != nil {
+		return exitError, err
+	}
+	current, err := publisher.ListRecords(ctx, t.UpdateDomain)
+	if err != nil {
+		return exitError, err
+	}
+	if drifted := provider.Drifted(t.Current, current); len(drifted) > 0 {
+		return exitError, fmt.Errorf("%v changed since the plan was made, make a new plan", strings.Join(drifted, ", "))
+	}
+
+	err = provider.ApplyPlan(ctx, publisher, t.Plan)
+	if err != nil {
+		return exitError, fmt.Errorf("updating records: %v", err)
+	}
+	t.applied = true
+	return published(r, s, publisher, t.Desired, t.Plan.Diff)
+}
+
+// recordingNetwork notes the TXT answers a lookup was based on
+type recordingNetwork struct {
+	dns.NetworkInterface
+	answers map[string][]string
+}
+
+func (n recordingNetwork) LookupTXT(ctx context.Context, host string) ([]string, error) {
+	txt, err := n.NetworkInterface.LookupTXT(ctx, host)
+	if err == nil {
+		n.answers[host] = txt
+	}
+	return txt, err
+}
+
+// answeredNetwork answers TXT lookups from those a run noted with recordingNetwork, a name it did not look up having none
+type answeredNetwork map[string][]string
+
+func (n answeredNetwork) LookupTXT(ctx context.Context, host string) ([]string, error) {
+	txt, ok := n[host]
+	if !ok {
+		return nil, fmt.Errorf("no TXT records for %v among the answers looked up", host)
+	}
+	return txt, nil
+}
@@ -0,0 +1,225 @@
+package powerdns
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	dns "github.com/searchspring.com/spf-flatten/dns"
+	"github.com/searchspring.com/spf-flatten/provider"
+)
+
+const DefaultServerID = "localhost"
+
+// PowerDNSUpdater publishes through the PowerDNS authoritative server's HTTP API
+type PowerDNSUpdater struct {
+	UpdateDomain string
+	// Zone is looked up from UpdateDomain among the server's zones when empty
+	Zone string
+	// Endpoint is the API's base URL including the version, IE http://127.0.0.1:8081/api/v1
+	Endpoint string
+	APIKey   string
+	ServerID string
+	// Naming picks out the leaf records of the domain, the default _spfN when empty
+	Naming dns.Naming
+	DryRun bool
+	// Logger gets what was published, or with DryRun would have been, nothing is logged when nil
+	Logger     *slog.Logger
+	HTTPClient *http.Client
+}
+
+var _ provider.BatchPublisher = &PowerDNSUpdater{}
+
+type record struct {
+	Content  string `json:"content"`
+	Disabled bool   `json:"disabled"`
+}
+
+type rrset struct {
+	Name       string   `json:"name"`
+	Type       string   `json:"type"`
+	TTL        int64    `json:"ttl,omitempty"`
+	ChangeType string   `json:"changetype,omitempty"`
+	Records    []record `json:"records"`
+}
+
+type zone struct {
+	ID     string  `json:"id"`
+	Name   string  `json:"name"`
+	RRsets []rrset `json:"rrsets,omitempty"`
+}
+
+func New(s PowerDNSUpdater) (PowerDNSUpdater, error) {
+	if s.Endpoint == "" {
+		return s, fmt.Errorf("no PowerDNS API endpoint configured")
+	}
+	if s.APIKey == "" {
+		return s, fmt.Errorf("no PowerDNS API key configured")
+	}
+	if s.ServerID == "" {
+		s.ServerID = DefaultServerID
+	}
+	if s.HTTPClient == nil {
+		s.HTTPClient = http.DefaultClient
+	}
+	return s, nil
+}
+
+// ResolveZone finds the zone with the most specific name containing UpdateDomain
+func (s *PowerDNSUpdater) ResolveZone(ctx context.Context) error {
+	if s.Zone != "" {
+		s.Zone = provider.Fqdn(s.Zone)
+		return nil
+	}
+	labels := strings.Split(strings.TrimSuffix(provider.Fqdn(s.UpdateDomain), "."), ".")
+	for i := range labels {
+		candidate := strings.Join(labels[i:], ".") + "."
+		var zones []zone
+		err := s.do(ctx, http.MethodGet, s.serverPath()+"/zones?"+url.Values{"zone": {candidate}}.Encode(), nil, &zones)
+		if err != nil {
+			return err
+		}
+		if len(zones) > 0 {
+			s.Zone = provider.Fqdn(zones[0].Name)
+			return nil
+		}
+	}
+	return fmt.Errorf("no PowerDNS zone found for %v on server %v", s.UpdateDomain, s.ServerID)
+}
+
+// ListRecords returns the TXT record sets of domain and its _spfN leaves
+func (s *PowerDNSUpdater) ListRecords(ctx context.Context, domain string) ([]provider.Record, error) {
+	existing, err := s.listTXT(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var records []provider.Record
+	for name, record := range existing {
+		if name == provider.Fqdn(domain) || s.Naming.IsLeaf(name, domain) {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+func (s *PowerDNSUpdater) Apply(ctx context.Context, changes provider.ChangeSet) error {
+	return s.ApplyBatch(ctx, changes, nil)
+}
+
+func (s *PowerDNSUpdater) DeleteRecords(ctx context.Context, records []provider.Record) error {
+	return s.ApplyBatch(ctx, nil, records)
+}
+
+// ApplyBatch sends every REPLACE and DELETE in one PATCH, which PowerDNS applies in a single transaction
+func (s *PowerDNSUpdater) ApplyBatch(ctx context.Context, changes provider.ChangeSet, stale []provider.Record) error {
+	err := s.ResolveZone(ctx)
+	if err != nil {
+		return err
+	}
+	var patch zone
+	for _, change := range changes {
+		replace := rrset{Name: provider.Fqdn(change.Record.Name), Type: "TXT", TTL: change.Record.TTL, ChangeType: "REPLACE", Records: []record{}}
+		for _, value := range change.Record.Values {
+			replace.Records = append(replace.Records, record{Content: dns.QuoteTXT(value)})
+		}
+		patch.RRsets = append(patch.RRsets, replace)
+	}
+	for _, rec := range stale {
+		patch.RRsets = append(patch.RRsets, rrset{Name: provider.Fqdn(rec.Name), Type: "TXT", ChangeType: "DELETE", Records: []record{}})
+	}
+	if len(patch.RRsets) == 0 {
+		return nil
+	}
+	if s.DryRun {
+		s.logger().Info("DryRun TXT records not updated", "domain", s.UpdateDomain, "rrsets", fmt.Sprintf("%+v", patch.RRsets))
+		return nil
+	}
+	err = s.do(ctx, http.MethodPatch, s.zonePath(), patch, nil)
+	if err != nil {
+		return err
+	}
+	s.logger().Info("TXT records updated", "domain", s.UpdateDomain, "zone", s.Zone, "rrsets", len(patch.RRsets))
+	return nil
+}
+
+// listTXT reads the zone's TXT record sets keyed by name, ignoring disabled records
+func (s *PowerDNSUpdater) listTXT(ctx context.Context) (map[string]provider.Record, error) {
+	err := s.ResolveZone(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var z zone
+	err = s.do(ctx, http.MethodGet, s.zonePath(), nil, &z)
+	if err != nil {
+		return nil, err
+	}
+	records := make(map[string]provider.Record)
+	for _, rs := range z.RRsets {
+		if rs.Type != "TXT" {
+			continue
+		}
+		record := provider.Record{Name: provider.Fqdn(rs.Name), TTL: rs.TTL}
+		for _, r := range rs.Records {
+			if !r.Disabled {
+				record.Values = append(record.Values, dns.UnquoteTXT(r.Content))
+			}
+		}
+		if len(record.Values) > 0 {
+			records[record.Name] = record
+		}
+	}
+	return records, nil
+}
+
+func (s *PowerDNSUpdater) serverPath() string {
+	return "/servers/" + url.PathEscape(s.ServerID)
+}
+
+func (s *PowerDNSUpdater) zonePath() string {
+	return s.serverPath() + "/zones/" + url.PathEscape(s.Zone)
+}
+
+// do sends a request with the API key and decodes the response into out
+func (s *PowerDNSUpdater) do(ctx context.Context, method string, path string, body interface{}, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(s.Endpoint, "/")+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-API-Key", s.APIKey)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&apiErr)
+		return fmt.Errorf("powerdns %v %v: %v: %v", method, path, resp.Status, apiErr.Error)
+	}
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (s *PowerDNSUpdater) logger() *slog.Logger {
+	return dns.LoggerOrDiscard(s.Logger)
+}
@@ -0,0 +1,243 @@
+package powerdns
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	dns "github.com/searchspring.com/spf-flatten/dns"
+	"github.com/searchspring.com/spf-flatten/provider"
+	"github.com/searchspring.com/spf-flatten/provider/providertest"
+	"github.com/stretchr/testify/require"
+)
+
+// FakePowerDNS is a local stand-in for the PowerDNS authoritative HTTP API
+type FakePowerDNS struct {
+	APIKey   string
+	ServerID string
+	Patches  []zone
+	mu       sync.Mutex
+	zones    map[string]map[string]rrset
+}
+
+func NewFakePowerDNS(apiKey string, serverID string, zones ...string) *FakePowerDNS {
+	fake := &FakePowerDNS{APIKey: apiKey, ServerID: serverID, zones: map[string]map[string]rrset{}}
+	for _, name := range zones {
+		fake.zones[name] = map[string]rrset{
+			name + "/SOA": {Name: name, Type: "SOA", TTL: 3600, Records: []record{{Content: "ns1." + name + " hostmaster." + name + " 1 10800 3600 604800 3600"}}},
+		}
+	}
+	return fake
+}
+
+func (s *FakePowerDNS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.Header.Get("X-API-Key") != s.APIKey {
+		writeError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	path, found := strings.CutPrefix(r.URL.Path, "/api/v1/servers/"+s.ServerID+"/zones")
+	if !found {
+		writeError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	if path == "" {
+		zones := []zone{}
+		if _, ok := s.zones[r.URL.Query().Get("zone")]; ok {
+			zones = append(zones, zone{ID: r.URL.Query().Get("zone"), Name: r.URL.Query().Get("zone")})
+		}
+		_ = json.NewEncoder(w).Encode(zones)
+		return
+	}
+	name := strings.TrimPrefix(path, "/")
+	rrsets, ok := s.zones[name]
+	if !ok {
+		writeError(w, http.StatusNotFound, "Could not find domain '"+name+"'")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		z := zone{ID: name, Name: name, RRsets: []rrset{}}
+		for _, rs := range rrsets {
+			z.RRsets = append(z.RRsets, rs)
+		}
+		_ = json.NewEncoder(w).Encode(z)
+	case http.MethodPatch:
+		var patch zone
+		_ = json.NewDecoder(r.Body).Decode(&patch)
+		s.patch(w, name, rrsets, patch)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+	}
+}
+
+// patch validates every change before applying any, like PowerDNS does inside its transaction
+func (s *FakePowerDNS) patch(w http.ResponseWriter, name string, rrsets map[string]rrset, patch zone) {
+	for _, rs := range patch.RRsets {
+		if !strings.HasSuffix(rs.Name, "."+name) && rs.Name != name {
+			writeError(w, http.StatusUnprocessableEntity, fmt.Sprintf("RRset %v IN %v: Name is out of zone", rs.Name, rs.Type))
+			return
+		}
+		switch rs.ChangeType {
+		case "REPLACE":
+			for _, rec := range rs.Records {
+				if !strings.HasPrefix(rec.Content, `"`) {
+					writeError(w, http.StatusUnprocessableEntity, fmt.Sprintf("Record %v/TXT '%v': Not in expected format", rs.Name, rec.Content))
+					return
+				}
+			}
+		case "DELETE":
+		default:
+			writeError(w, http.StatusUnprocessableEntity, "Changetype not understood")
+			return
+		}
+	}
+	for _, rs := range patch.RRsets {
+		key := rs.Name + "/" + rs.Type
+		if rs.ChangeType == "DELETE" || len(rs.Records) == 0 {
+			delete(rrsets, key)
+			continue
+		}
+		rs.ChangeType = ""
+		rrsets[key] = rs
+	}
+	s.Patches = append(s.Patches, patch)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *FakePowerDNS) Seed(records ...provider.Record) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, rec := range records {
+		rs := rrset{Name: rec.Name, Type: "TXT", TTL: rec.TTL}
+		for _, value := range rec.Values {
+			rs.Records = append(rs.Records, record{Content: dns.QuoteTXT(value)})
+		}
+		s.zones[providertest.Domain][rec.Name+"/TXT"] = rs
+	}
+}
+
+func (s *FakePowerDNS) Records() []provider.Record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var records []provider.Record
+	for _, rs := range s.zones[providertest.Domain] {
+		if rs.Type != "TXT" {
+			continue
+		}
+		rec := provider.Record{Name: rs.Name, TTL: rs.TTL}
+		for _, r := range rs.Records {
+			rec.Values = append(rec.Values, dns.UnquoteTXT(r.Content))
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+func newTestUpdater(t *testing.T, fake *FakePowerDNS) PowerDNSUpdater {
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	updater, err := New(PowerDNSUpdater{
+		UpdateDomain: providertest.Domain,
+		Endpoint:     server.URL + "/api/v1",
+		APIKey:       "secret",
+		ServerID:     fake.ServerID,
+	})
+	require.Nil(t, err)
+	return updater
+}
+
+func TestPublisherConformance(t *testing.T) {
+	providertest.Run(t, func(t *testing.T) providertest.Harness {
+		fake := NewFakePowerDNS("secret", "localhost", "example.com.")
+		updater := newTestUpdater(t, fake)
+		return providertest.Harness{Publisher: &updater, Seed: fake.Seed, Records: fake.Records}
+	})
+}
+
+func TestPublishIsOnePatch(t *testing.T) {
+	fake := NewFakePowerDNS("secret", "ns1", "example.com.")
+	fake.Seed(
+		provider.Record{Name: "example.com.", TTL: 300, Values: []string{"v=spf1 include:_spf1.example.com include:_spf2.example.com ~all"}},
+		provider.Record{Name: "_spf1.example.com.", TTL: 300, Values: []string{"v=spf1 ip4:192.0.2.1 ~all"}},
+		provider.Record{Name: "_spf2.example.com.", TTL: 300, Values: []string{"v=spf1 ip4:192.0.2.2 ~all"}},
+	)
+	updater := newTestUpdater(t, fake)
+	_, err := provider.Publish(context.TODO(), &updater, "example.com", map[string]string{
+		"example.com":       "v=spf1 include:_spf1.example.com ~all",
+		"_spf1.example.com": "v=spf1 ip4:192.0.2.3 ~all",
+	}, provider.PlanOptions{})
+	require.Nil(t, err)
+	require.Len(t, fake.Patches, 1)
+	var changeTypes []string
+	for _, rs := range fake.Patches[0].RRsets {
+		changeTypes = append(changeTypes, rs.Name+" "+rs.ChangeType)
+	}
+	require.Equal(t, []string{"_spf1.example.com. REPLACE", "example.com. REPLACE", "_spf2.example.com. DELETE"}, changeTypes)
+}
+
+func TestListRecordsSkipsDisabled(t *testing.T) {
+	fake := NewFakePowerDNS("secret", "localhost", "example.com.")
+	fake.zones["example.com."]["example.com./TXT"] = rrset{Name: "example.com.", Type: "TXT", TTL: 300, Records: []record{
+		{Content: `"v=spf1 -all"`},
+		{Content: `"v=spf1 ip4:192.0.2.1 -all"`, Disabled: true},
+	}}
+	fake.zones["example.com."]["_spf1.example.com./TXT"] = rrset{Name: "_spf1.example.com.", Type: "TXT", TTL: 300, Records: []record{
+		{Content: `"v=spf1 ip4:192.0.2.1 -all"`, Disabled: true},
+	}}
+	updater := newTestUpdater(t, fake)
+	records, err := updater.ListRecords(context.TODO(), "example.com")
+	require.Nil(t, err)
+	require.Equal(t, []provider.Record{{Name: "example.com.", TTL: 300, Values: []string{"v=spf1 -all"}}}, records)
+}
+
+func TestResolveZone(t *testing.T) {
+	fake := NewFakePowerDNS("secret", "localhost", "example.com.", "mail.example.com.")
+	updater := newTestUpdater(t, fake)
+	updater.UpdateDomain = "news.mail.example.com"
+	err := updater.ResolveZone(context.TODO())
+	require.Nil(t, err)
+	require.Equal(t, "mail.example.com.", updater.Zone)
+
+	updater.Zone = ""
+	updater.UpdateDomain = "example.org"
+	err = updater.ResolveZone(context.TODO())
+	require.EqualError(t, err, "no PowerDNS zone found for example.org on server localhost")
+}
+
+func TestAPIErrors(t *testing.T) {
+	fake := NewFakePowerDNS("secret", "localhost", "example.com.")
+	updater := newTestUpdater(t, fake)
+	updater.APIKey = "wrong"
+	_, err := updater.ListRecords(context.TODO(), "example.com")
+	require.EqualError(t, err, "powerdns GET /servers/localhost/zones?zone=example.com.: 401 Unauthorized: Unauthorized")
+
+	updater.APIKey = "secret"
+	updater.ServerID = "other"
+	_, err = updater.ListRecords(context.TODO(), "example.com")
+	require.ErrorContains(t, err, "404 Not Found")
+}
+
+func TestNew(t *testing.T) {
+	_, err := New(PowerDNSUpdater{APIKey: "secret"})
+	require.EqualError(t, err, "no PowerDNS API endpoint configured")
+
+	_, err = New(PowerDNSUpdater{Endpoint: "http://127.0.0.1:8081/api/v1"})
+	require.EqualError(t, err, "no PowerDNS API key configured")
+
+	updater, err := New(PowerDNSUpdater{Endpoint: "http://127.0.0.1:8081/api/v1", APIKey: "secret"})
+	require.Nil(t, err)
+	require.Equal(t, DefaultServerID, updater.ServerID)
+	require.Equal(t, http.DefaultClient, updater.HTTPClient)
+}
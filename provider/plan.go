@@ -0,0 +1,191 @@
+package provider
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	dns "github.com/searchspring.com/spf-flatten/dns"
+)
+
+// PlanOptions controls the TTLs of the records a plan writes
+type PlanOptions struct {
+	// TTL applies to every record written, RootTTL overrides it for the domain itself.
+	// When unset existing records keep their TTL and new ones get DefaultTTL.
+	TTL     int64 `json:"ttl"`
+	RootTTL int64 `json:"root_ttl"`
+	// Naming picks out the leaves of the domain that may become stale, the default _spfN when empty
+	Naming dns.Naming `json:"naming"`
+}
+
+// Plan is what it takes to move a zone from its current SPF tree to the desired one
+type Plan struct {
+	Diff    Diff      `json:"diff"`
+	Changes ChangeSet `json:"changes"`
+	Stale   []Record  `json:"stale"`
+}
+
+// Diff describes how the desired TXT records differ from what is already in the zone
+type Diff struct {
+	Added     []RecordChange `json:"added"`
+	Modified  []RecordChange `json:"modified"`
+	Deleted   []RecordChange `json:"deleted"`
+	Unchanged []RecordChange `json:"unchanged"`
+}
+
+// RecordChange holds the unquoted TXT values of a single record set before and after an update
+type RecordChange struct {
+	Name   string   `json:"name"`
+	Old    []string `json:"old,omitempty"`
+	New    []string `json:"new,omitempty"`
+	OldTTL int64    `json:"old_ttl,omitempty"`
+	NewTTL int64    `json:"new_ttl,omitempty"`
+}
+
+// HasChanges reports whether applying the diff would change the zone
+func (d Diff) HasChanges() bool {
+	return len(d.Added)+len(d.Modified)+len(d.Deleted) > 0
+}
+
+func (d Diff) String() string {
+	var b strings.Builder
+	for _, rec := range d.Added {
+		fmt.Fprintf(&b, "+ %v\t%d\tTXT\t%v\n", rec.Name, rec.NewTTL, strings.Join(rec.New, " | "))
+	}
+	for _, rec := range d.Modified {
+		fmt.Fprintf(&b, "- %v\t%d\tTXT\t%v\n", rec.Name, rec.OldTTL, strings.Join(rec.Old, " | "))
+		fmt.Fprintf(&b, "+ %v\t%d\tTXT\t%v\n", rec.Name, rec.NewTTL, strings.Join(rec.New, " | "))
+	}
+	for _, rec := range d.Deleted {
+		fmt.Fprintf(&b, "- %v\t%d\tTXT\t%v\n", rec.Name, rec.OldTTL, strings.Join(rec.Old, " | "))
+	}
+	fmt.Fprintf(&b, "%d added, %d modified, %d deleted, %d unchanged\n", len(d.Added), len(d.Modified), len(d.Deleted), len(d.Unchanged))
+	return b.String()
+}
+
+// NewPlan compares the desired SPF records with the current SPF tree of domain. Non-SPF values sharing
+// a name are preserved, and any current _spfN leaf of domain that is no longer wanted becomes stale.
+func NewPlan(domain string, current []Record, txtRecs map[string]string, opts PlanOptions) Plan {
+	var plan Plan
+	domain = Fqdn(domain)
+
+	existing := make(map[string]Record, len(current))
+	for _, rec := range current {
+		existing[Fqdn(rec.Name)] = rec
+	}
+	desired := make(map[string]string, len(txtRecs))
+	for name, value := range txtRecs {
+		desired[Fqdn(name)] = value
+	}
+
+	// Leaves sort before the root so they exist by the time the root points at them
+	names := make([]string, 0, len(desired))
+	for name := range desired {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if (names[i] == domain) != (names[j] == domain) {
+			return names[j] == domain
+		}
+		return names[i] < names[j]
+	})
+
+	for _, name := range names {
+		old, found := existing[name]
+		newValues := []string{desired[name]}
+		for _, value := range old.Values {
+			if !IsSPF(value) {
+				newValues = append(newValues, value)
+			}
+		}
+		newTTL := opts.recordTTL(name == domain, old.TTL)
+
+		change := RecordChange{Name: name, Old: old.Values, New: newValues, OldTTL: old.TTL, NewTTL: newTTL}
+		action := Update
+		switch {
+		case !found:
+			plan.Diff.Added = append(plan.Diff.Added, change)
+			action = Create
+		case sameValues(old.Values, newValues) && old.TTL == newTTL:
+			plan.Diff.Unchanged = append(plan.Diff.Unchanged, change)
+			continue
+		default:
+			plan.Diff.Modified = append(plan.Diff.Modified, change)
+		}
+		plan.Changes = append(plan.Changes, Change{
+			Action: action,
+			Record: Record{Name: name, TTL: newTTL, Values: newValues},
+		})
+	}
+
+	stale := make([]string, 0)
+	for name := range existing {
+		if _, ok := desired[name]; !ok && opts.Naming.IsLeaf(name, domain) {
+			stale = append(stale, name)
+		}
+	}
+	sort.Strings(stale)
+	for _, name := range stale {
+		rec := existing[name]
+		rec.Name = name
+		plan.Diff.Deleted = append(plan.Diff.Deleted, RecordChange{Name: name, Old: rec.Values, OldTTL: rec.TTL})
+		plan.Stale = append(plan.Stale, rec)
+	}
+	return plan
+}
+
+func (o PlanOptions) recordTTL(root bool, current int64) int64 {
+	ttl := o.TTL
+	if root && o.RootTTL != 0 {
+		ttl = o.RootTTL
+	}
+	if ttl != 0 {
+		return ttl
+	}
+	if current != 0 {
+		return current
+	}
+	return DefaultTTL
+}
+
+func sameValues(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string{}, a...)
+	b = append([]string{}, b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Drifted lists the names whose records differ between two listings of a zone, ignoring the order records and values come in
+func Drifted(planned []Record, current []Record) []string {
+	byName := func(records []Record) map[string]Record {
+		m := make(map[string]Record, len(records))
+		for _, rec := range records {
+			m[Fqdn(rec.Name)] = rec
+		}
+		return m
+	}
+	before, after := byName(planned), byName(current)
+	var drifted []string
+	for name, rec := range before {
+		now, ok := after[name]
+		if !ok || now.TTL != rec.TTL || !sameValues(now.Values, rec.Values) {
+			drifted = append(drifted, name)
+		}
+	}
+	for name := range after {
+		if _, ok := before[name]; !ok {
+			drifted = append(drifted, name)
+		}
+	}
+	sort.Strings(drifted)
+	return drifted
+}
@@ -0,0 +1,103 @@
+// Package provider defines what a DNS backend has to implement to publish a flattened SPF tree,
+// and the provider neutral planning that decides what to change.
+package provider
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// TTL given to new records when none is configured
+const DefaultTTL = 300
+
+// Publisher is implemented by every DNS backend the SPF tree can be published to
+type Publisher interface {
+	// ListRecords returns the TXT record sets of the SPF tree for domain: the domain itself and its _spfN leaves
+	ListRecords(ctx context.Context, domain string) ([]Record, error)
+	// Apply creates or replaces record sets, in the order given
+	Apply(ctx context.Context, changes ChangeSet) error
+	// DeleteRecords removes record sets that are no longer part of the tree
+	DeleteRecords(ctx context.Context, records []Record) error
+}
+
+// BatchPublisher is implemented by backends that can apply a change set and delete stale records
+// in a single atomic operation, Publish prefers it when available
+type BatchPublisher interface {
+	Publisher
+	ApplyBatch(ctx context.Context, changes ChangeSet, stale []Record) error
+}
+
+// Record is a TXT record set
+type Record struct {
+	// Name is lower case and fully qualified with a trailing dot
+	Name string `json:"name"`
+	TTL  int64  `json:"ttl"`
+	// Values are unquoted, one per TXT record in the set
+	Values []string `json:"values"`
+}
+
+type Action string
+
+const (
+	Create Action = "CREATE"
+	Update Action = "UPDATE"
+)
+
+// Change replaces whatever is at Record.Name with Record
+type Change struct {
+	Action Action `json:"action"`
+	Record Record `json:"record"`
+}
+
+// ChangeSet is applied in order: leaves first so the root never references a record that does not exist yet
+type ChangeSet []Change
+
+// Publish brings the SPF tree of domain in line with txtRecs, as produced by dns.SplitSPFRecords
+func Publish(ctx context.Context, p Publisher, domain string, txtRecs map[string]string, opts PlanOptions) (Diff, error) {
+	current, err := p.ListRecords(ctx, domain)
+	if err != nil {
+		return Diff{}, err
+	}
+	plan := NewPlan(domain, current, txtRecs, opts)
+	return plan.Diff, ApplyPlan(ctx, p, plan)
+}
+
+// ApplyPlan makes the changes of a plan and deletes its stale records
+func ApplyPlan(ctx context.Context, p Publisher, plan Plan) error {
+	if batch, ok := p.(BatchPublisher); ok {
+		if len(plan.Changes) > 0 || len(plan.Stale) > 0 {
+			return batch.ApplyBatch(ctx, plan.Changes, plan.Stale)
+		}
+		return nil
+	}
+	if len(plan.Changes) > 0 {
+		err := p.Apply(ctx, plan.Changes)
+		if err != nil {
+			return err
+		}
+	}
+	// Stale leaves go last, once the root no longer references them
+	if len(plan.Stale) > 0 {
+		return p.DeleteRecords(ctx, plan.Stale)
+	}
+	return nil
+}
+
+// Fqdn lower cases name and makes sure it ends with a dot
+func Fqdn(name string) string {
+	name = strings.ToLower(name)
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
+
+// IsSPF reports whether a TXT value is an SPF record
+func IsSPF(value string) bool {
+	return strings.HasPrefix(strings.ToLower(value), "v=spf1")
+}
+
+func (r Record) String() string {
+	return fmt.Sprintf("%v\t%d\tTXT\t%v", r.Name, r.TTL, strings.Join(r.Values, " | "))
+}
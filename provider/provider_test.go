@@ -0,0 +1,126 @@
+package provider_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/searchspring.com/spf-flatten/provider"
+	"github.com/searchspring.com/spf-flatten/provider/providertest"
+	"github.com/stretchr/testify/require"
+)
+
+type FailingPublisher struct {
+	*providertest.MemoryPublisher
+	ApplyErr  error
+	DeleteErr error
+}
+
+func (s FailingPublisher) Apply(ctx context.Context, changes provider.ChangeSet) error {
+	if s.ApplyErr != nil {
+		return s.ApplyErr
+	}
+	return s.MemoryPublisher.Apply(ctx, changes)
+}
+
+func (s FailingPublisher) DeleteRecords(ctx context.Context, records []provider.Record) error {
+	if s.DeleteErr != nil {
+		return s.DeleteErr
+	}
+	return s.MemoryPublisher.DeleteRecords(ctx, records)
+}
+
+func TestMemoryPublisher(t *testing.T) {
+	providertest.Run(t, func(t *testing.T) providertest.Harness {
+		m := providertest.NewMemoryPublisher()
+		return providertest.Harness{Publisher: m, Seed: m.Seed, Records: m.Records}
+	})
+}
+
+func TestNewPlan(t *testing.T) {
+	current := []provider.Record{
+		{Name: "example.com.", TTL: 300, Values: []string{"google-site-verification=abc", "v=spf1 include:_spf1.example.com include:_spf2.example.com ~all"}},
+		{Name: "_spf1.example.com.", TTL: 300, Values: []string{"v=spf1 ip4:192.168.1.1 ~all"}},
+		{Name: "_spf2.example.com.", TTL: 300, Values: []string{"v=spf1 ip4:192.168.1.2 ~all"}},
+		{Name: "_spf3.other.com.", TTL: 300, Values: []string{"v=spf1 ip4:192.168.1.3 ~all"}},
+	}
+
+	// Nothing to do when the zone already matches
+	plan := provider.NewPlan("example.com", current, map[string]string{
+		"example.com":       "v=spf1 include:_spf1.example.com include:_spf2.example.com ~all",
+		"_spf1.example.com": "v=spf1 ip4:192.168.1.1 ~all",
+		"_spf2.example.com": "v=spf1 ip4:192.168.1.2 ~all",
+	}, provider.PlanOptions{})
+	require.False(t, plan.Diff.HasChanges())
+	require.Len(t, plan.Diff.Unchanged, 3)
+	require.Empty(t, plan.Changes)
+	require.Empty(t, plan.Stale)
+
+	// Root shrinks, _spf1 changes, _spf2 goes stale and a new leaf appears
+	plan = provider.NewPlan("example.com", current, map[string]string{
+		"example.com":       "v=spf1 include:_spf1.example.com include:_spf4.example.com ~all",
+		"_spf1.example.com": "v=spf1 ip4:192.168.1.4 ~all",
+		"_spf4.example.com": "v=spf1 -all",
+	}, provider.PlanOptions{})
+	require.True(t, plan.Diff.HasChanges())
+	require.Equal(t, []provider.RecordChange{{Name: "_spf4.example.com.", New: []string{"v=spf1 -all"}, NewTTL: provider.DefaultTTL}}, plan.Diff.Added)
+	require.Equal(t, []provider.RecordChange{
+		{Name: "_spf1.example.com.", Old: []string{"v=spf1 ip4:192.168.1.1 ~all"}, New: []string{"v=spf1 ip4:192.168.1.4 ~all"}, OldTTL: 300, NewTTL: 300},
+		{Name: "example.com.", Old: []string{"google-site-verification=abc", "v=spf1 include:_spf1.example.com include:_spf2.example.com ~all"}, New: []string{"v=spf1 include:_spf1.example.com include:_spf4.example.com ~all", "google-site-verification=abc"}, OldTTL: 300, NewTTL: 300},
+	}, plan.Diff.Modified)
+	require.Equal(t, []provider.RecordChange{{Name: "_spf2.example.com.", Old: []string{"v=spf1 ip4:192.168.1.2 ~all"}, OldTTL: 300}}, plan.Diff.Deleted)
+	require.Equal(t, []provider.Record{current[2]}, plan.Stale)
+
+	// Leaves are written before the root
+	require.Len(t, plan.Changes, 3)
+	require.Equal(t, provider.Update, plan.Changes[0].Action)
+	require.Equal(t, "_spf1.example.com.", plan.Changes[0].Record.Name)
+	require.Equal(t, provider.Create, plan.Changes[1].Action)
+	require.Equal(t, "_spf4.example.com.", plan.Changes[1].Record.Name)
+	require.Equal(t, "example.com.", plan.Changes[2].Record.Name)
+	require.Contains(t, plan.Diff.String(), "1 added, 2 modified, 1 deleted, 0 unchanged")
+
+	// Configured TTLs apply to created and updated records, the root can differ from the leaves
+	plan = provider.NewPlan("example.com", current, map[string]string{
+		"example.com":       "v=spf1 include:_spf1.example.com include:_spf2.example.com ~all",
+		"_spf1.example.com": "v=spf1 ip4:192.168.1.1 ~all",
+		"_spf2.example.com": "v=spf1 ip4:192.168.1.2 ~all",
+	}, provider.PlanOptions{TTL: 60, RootTTL: 3600})
+	require.Len(t, plan.Diff.Modified, 3)
+	require.Equal(t, int64(60), plan.Changes[0].Record.TTL)
+	require.Equal(t, int64(60), plan.Changes[1].Record.TTL)
+	require.Equal(t, int64(3600), plan.Changes[2].Record.TTL)
+}
+
+func TestPublish(t *testing.T) {
+	ctx := context.Background()
+	m := providertest.NewMemoryPublisher(provider.Record{Name: "_spf2.example.com", TTL: 300, Values: []string{"v=spf1 -all"}})
+
+	_, err := provider.Publish(ctx, FailingPublisher{MemoryPublisher: m, ApplyErr: fmt.Errorf("apply failed")}, "example.com", map[string]string{"example.com": "v=spf1 -all"}, provider.PlanOptions{})
+	require.EqualError(t, err, "apply failed")
+
+	// Stale leaves are only deleted after the new records are in place
+	_, err = provider.Publish(ctx, FailingPublisher{MemoryPublisher: m, DeleteErr: fmt.Errorf("delete failed")}, "example.com", map[string]string{"example.com": "v=spf1 -all"}, provider.PlanOptions{})
+	require.EqualError(t, err, "delete failed")
+	require.Len(t, m.Records(), 2)
+
+	diff, err := provider.Publish(ctx, m, "example.com", map[string]string{"example.com": "v=spf1 -all"}, provider.PlanOptions{})
+	require.Nil(t, err)
+	require.Len(t, diff.Deleted, 1)
+	require.Equal(t, []provider.Record{{Name: "example.com.", TTL: provider.DefaultTTL, Values: []string{"v=spf1 -all"}}}, m.Records())
+}
+
+func TestDrifted(t *testing.T) {
+	planned := []provider.Record{
+		{Name: "example.com.", TTL: 300, Values: []string{"google-site-verification=abc", "v=spf1 -all"}},
+		{Name: "_spf1.example.com.", TTL: 300, Values: []string{"v=spf1 ip4:192.0.2.1 ~all"}},
+	}
+	require.Empty(t, provider.Drifted(planned, []provider.Record{
+		{Name: "_spf1.example.com", TTL: 300, Values: []string{"v=spf1 ip4:192.0.2.1 ~all"}},
+		{Name: "example.com.", TTL: 300, Values: []string{"v=spf1 -all", "google-site-verification=abc"}},
+	}))
+	require.Equal(t, []string{"_spf1.example.com.", "_spf2.example.com.", "example.com."}, provider.Drifted(planned, []provider.Record{
+		{Name: "example.com.", TTL: 60, Values: []string{"google-site-verification=abc", "v=spf1 -all"}},
+		{Name: "_spf2.example.com.", TTL: 300, Values: []string{"v=spf1 ip4:192.0.2.1 ~all"}},
+	}))
+}
@@ -0,0 +1,74 @@
+package providertest
+
+import (
+	"context"
+	"sync"
+
+	dns "github.com/searchspring.com/spf-flatten/dns"
+	"github.com/searchspring.com/spf-flatten/provider"
+)
+
+// MemoryPublisher is a provider.Publisher that keeps its zone in memory
+type MemoryPublisher struct {
+	mu      sync.Mutex
+	records map[string]provider.Record
+}
+
+func NewMemoryPublisher(records ...provider.Record) *MemoryPublisher {
+	m := &MemoryPublisher{records: map[string]provider.Record{}}
+	m.Seed(records...)
+	return m
+}
+
+// Seed puts record sets straight into the zone
+func (m *MemoryPublisher) Seed(records ...provider.Record) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, rec := range records {
+		rec.Name = provider.Fqdn(rec.Name)
+		m.records[rec.Name] = rec
+	}
+}
+
+// Records returns every record set in the zone
+func (m *MemoryPublisher) Records() []provider.Record {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	records := make([]provider.Record, 0, len(m.records))
+	for _, rec := range m.records {
+		records = append(records, rec)
+	}
+	return sorted(records)
+}
+
+func (m *MemoryPublisher) ListRecords(ctx context.Context, domain string) ([]provider.Record, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var records []provider.Record
+	for name, rec := range m.records {
+		if name == provider.Fqdn(domain) || dns.IsSPFLeaf(name, domain) {
+			records = append(records, rec)
+		}
+	}
+	return records, nil
+}
+
+func (m *MemoryPublisher) Apply(ctx context.Context, changes provider.ChangeSet) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, change := range changes {
+		rec := change.Record
+		rec.Name = provider.Fqdn(rec.Name)
+		m.records[rec.Name] = rec
+	}
+	return nil
+}
+
+func (m *MemoryPublisher) DeleteRecords(ctx context.Context, records []provider.Record) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, rec := range records {
+		delete(m.records, provider.Fqdn(rec.Name))
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+// Package providertest holds the conformance suite every provider.Publisher has to pass,
+// along with an in-memory publisher for exercising the publish pipeline without a real backend.
+package providertest
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/searchspring.com/spf-flatten/provider"
+	"github.com/stretchr/testify/require"
+)
+
+// Domain the conformance suite publishes to
+const Domain = "example.com."
+
+// Harness wraps a publisher backed by an in-memory fake of the provider's API
+type Harness struct {
+	Publisher provider.Publisher
+	// Seed puts TXT record sets straight into the fake zone
+	Seed func(records ...provider.Record)
+	// Records returns every TXT record set in the fake zone
+	Records func() []provider.Record
+}
+
+// Run runs the conformance suite, newHarness must return a harness around an empty zone for Domain
+func Run(t *testing.T, newHarness func(t *testing.T) Harness) {
+	ctx := context.Background()
+	opts := provider.PlanOptions{TTL: 60, RootTTL: 3600}
+
+	t.Run("PublishToEmptyZone", func(t *testing.T) {
+		h := newHarness(t)
+		diff, err := provider.Publish(ctx, h.Publisher, Domain, tree(2), opts)
+		require.Nil(t, err)
+		require.Len(t, diff.Added, 3)
+		require.Equal(t, []provider.Record{
+			{Name: "_spf1.example.com.", TTL: 60, Values: []string{"v=spf1 ip4:192.0.2.1 ~all"}},
+			{Name: "_spf2.example.com.", TTL: 60, Values: []string{"v=spf1 ip4:192.0.2.2 ~all"}},
+			{Name: "example.com.", TTL: 3600, Values: []string{"v=spf1 include:_spf1.example.com include:_spf2.example.com ~all"}},
+		}, sorted(h.Records()))
+	})
+
+	t.Run("ListRecordsOnlyReturnsTheTree", func(t *testing.T) {
+		h := newHarness(t)
+		h.Seed(
+			provider.Record{Name: "example.com.", TTL: 300, Values: []string{"v=spf1 -all"}},
+			provider.Record{Name: "_spf1.example.com.", TTL: 300, Values: []string{"v=spf1 ip4:192.0.2.1 ~all"}},
+			provider.Record{Name: "www.example.com.", TTL: 300, Values: []string{"v=spf1 -all"}},
+			provider.Record{Name: "_spf1.example.org.", TTL: 300, Values: []string{"v=spf1 -all"}},
+		)
+		records, err := h.Publisher.ListRecords(ctx, Domain)
+		require.Nil(t, err)
+		require.Equal(t, []provider.Record{
+			{Name: "_spf1.example.com.", TTL: 300, Values: []string{"v=spf1 ip4:192.0.2.1 ~all"}},
+			{Name: "example.com.", TTL: 300, Values: []string{"v=spf1 -all"}},
+		}, sorted(records))
+	})
+
+	t.Run("RepublishIsNoop", func(t *testing.T) {
+		h := newHarness(t)
+		_, err := provider.Publish(ctx, h.Publisher, Domain, tree(2), opts)
+		require.Nil(t, err)
+		diff, err := provider.Publish(ctx, h.Publisher, Domain, tree(2), opts)
+		require.Nil(t, err)
+		require.False(t, diff.HasChanges())
+		require.Len(t, diff.Unchanged, 3)
+	})
+
+	t.Run("PreservesOtherValuesAndRecords", func(t *testing.T) {
+		h := newHarness(t)
+		h.Seed(
+			provider.Record{Name: "example.com.", TTL: 3600, Values: []string{"google-site-verification=abc", "v=spf1 -all"}},
+			provider.Record{Name: "www.example.com.", TTL: 300, Values: []string{"hello"}},
+		)
+		_, err := provider.Publish(ctx, h.Publisher, Domain, tree(1), opts)
+		require.Nil(t, err)
+		require.Equal(t, []provider.Record{
+			{Name: "_spf1.example.com.", TTL: 60, Values: []string{"v=spf1 ip4:192.0.2.1 ~all"}},
+			{Name: "example.com.", TTL: 3600, Values: []string{"google-site-verification=abc", "v=spf1 include:_spf1.example.com ~all"}},
+			{Name: "www.example.com.", TTL: 300, Values: []string{"hello"}},
+		}, sorted(h.Records()))
+	})
+
+	t.Run("DeletesStaleLeaves", func(t *testing.T) {
+		h := newHarness(t)
+		_, err := provider.Publish(ctx, h.Publisher, Domain, tree(3), opts)
+		require.Nil(t, err)
+		diff, err := provider.Publish(ctx, h.Publisher, Domain, tree(1), opts)
+		require.Nil(t, err)
+		require.Len(t, diff.Deleted, 2)
+		require.Len(t, diff.Modified, 1)
+		require.Equal(t, []provider.Record{
+			{Name: "_spf1.example.com.", TTL: 60, Values: []string{"v=spf1 ip4:192.0.2.1 ~all"}},
+			{Name: "example.com.", TTL: 3600, Values: []string{"v=spf1 include:_spf1.example.com ~all"}},
+		}, sorted(h.Records()))
+	})
+
+	t.Run("ApplyAndDeleteRecords", func(t *testing.T) {
+		h := newHarness(t)
+		h.Seed(provider.Record{Name: "_spf2.example.com.", TTL: 300, Values: []string{"v=spf1 ip4:192.0.2.2 ~all"}})
+		err := h.Publisher.Apply(ctx, provider.ChangeSet{
+			{Action: provider.Create, Record: provider.Record{Name: "_spf1.example.com.", TTL: 60, Values: []string{"v=spf1 ip4:192.0.2.1 ~all"}}},
+			{Action: provider.Update, Record: provider.Record{Name: "_spf2.example.com.", TTL: 120, Values: []string{"v=spf1 ip4:192.0.2.3 ~all"}}},
+		})
+		require.Nil(t, err)
+		require.Equal(t, []provider.Record{
+			{Name: "_spf1.example.com.", TTL: 60, Values: []string{"v=spf1 ip4:192.0.2.1 ~all"}},
+			{Name: "_spf2.example.com.", TTL: 120, Values: []string{"v=spf1 ip4:192.0.2.3 ~all"}},
+		}, sorted(h.Records()))
+
+		err = h.Publisher.DeleteRecords(ctx, []provider.Record{{Name: "_spf2.example.com.", TTL: 120, Values: []string{"v=spf1 ip4:192.0.2.3 ~all"}}})
+		require.Nil(t, err)
+		require.Equal(t, []provider.Record{
+			{Name: "_spf1.example.com.", TTL: 60, Values: []string{"v=spf1 ip4:192.0.2.1 ~all"}},
+		}, sorted(h.Records()))
+	})
+
+	t.Run("LongValues", func(t *testing.T) {
+		h := newHarness(t)
+		long := "v=spf1"
+		for len(long) < 400 {
+			long += " ip4:198.51.100.0/24"
+		}
+		long += " ~all"
+		_, err := provider.Publish(ctx, h.Publisher, Domain, map[string]string{"example.com": long}, opts)
+		require.Nil(t, err)
+		records, err := h.Publisher.ListRecords(ctx, Domain)
+		require.Nil(t, err)
+		require.Equal(t, []provider.Record{{Name: "example.com.", TTL: 3600, Values: []string{long}}}, sorted(records))
+	})
+}
+
+// tree builds the records dns.SplitSPFRecords would for n leaves
+func tree(n int) map[string]string {
+	txtRecs := map[string]string{}
+	root := "v=spf1"
+	for i := 1; i <= n; i++ {
+		leaf := fmt.Sprintf("_spf%d.example.com", i)
+		txtRecs[leaf] = fmt.Sprintf("v=spf1 ip4:192.0.2.%d ~all", i)
+		root = fmt.Sprintf("%s include:%s", root, leaf)
+	}
+	txtRecs["example.com"] = root + " ~all"
+	return txtRecs
+}
+
+// sorted orders record sets by name and their values, so results from any backend compare equal
+func sorted(records []provider.Record) []provider.Record {
+	out := make([]provider.Record, 0, len(records))
+	for _, rec := range records {
+		values := append([]string{}, rec.Values...)
+		sort.Strings(values)
+		out = append(out, provider.Record{Name: provider.Fqdn(rec.Name), TTL: rec.TTL, Values: values})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/searchspring.com/spf-flatten/azuredns"
+	"github.com/searchspring.com/spf-flatten/clouddns"
+	cf "github.com/searchspring.com/spf-flatten/cloudflare"
+	"github.com/searchspring.com/spf-flatten/hook"
+	"github.com/searchspring.com/spf-flatten/powerdns"
+	"github.com/searchspring.com/spf-flatten/provider"
+	"github.com/searchspring.com/spf-flatten/rfc2136"
+	r53 "github.com/searchspring.com/spf-flatten/route53"
+	"github.com/searchspring.com/spf-flatten/zonefile"
+)
+
+// providers builds the publisher for each DNS provider, zone being the setting a config file's zone sets
+var providers = map[string]struct {
+	zone string
+	new  func(s settings, updateDomain string, dryRun bool, logger *slog.Logger) (provider.Publisher, error)
+}{
+	"route53":    {zone: "ZONEID", new: newRoute53Publisher},
+	"cloudflare": {zone: "CLOUDFLARE_ZONE_ID", new: newCloudflarePublisher},
+	"clouddns":   {zone: "CLOUDDNS_MANAGED_ZONE", new: newCloudDNSPublisher},
+	"azuredns":   {zone: "AZURE_DNS_ZONE", new: newAzureDNSPublisher},
+	"rfc2136":    {zone: "RFC2136_ZONE", new: newRFC2136Publisher},
+	"powerdns":   {zone: "POWERDNS_ZONE", new: newPowerDNSPublisher},
+	"zonefile":   {new: newZoneFilePublisher},
+	"hook":       {new: newHookPublisher},
+}
+
+// Build the publisher for the named DNS provider from its settings
+func newPublisher(name string, s settings, updateDomain string, dryRun bool, logger *slog.Logger) (provider.Publisher, error) {
+	p, ok := providers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown PROVIDER %q", name)
+	}
+	return p.new(s, updateDomain, dryRun, logger)
+}
+
+func newRoute53Publisher(s settings, updateDomain string, dryRun bool, logger *slog.Logger) (provider.Publisher, error) {
+	updater, err := route53Updater(s, updateDomain, dryRun, logger)
+	if err != nil {
+		return nil, err
+	}
+	r53updater, err := r53.New(updater)
+	if err != nil {
+		return nil, err
+	}
+	err = r53updater.ResolveZone()
+	if err != nil {
+		return nil, err
+	}
+	return &r53updater, nil
+}
+
+// route53Updater reads the Route53 settings, the session being created from them by r53.New
+func route53Updater(s settings, updateDomain string, dryRun bool, logger *slog.Logger) (r53.Route53Updater, error) {
+	if s.get("AWS_REGION") == "" {
+		return r53.Route53Updater{}, fmt.Errorf("you must set the AWS_REGION ENV variable for the route53 provider")
+	}
+
+	// Optionally wait for Route53 to sync and verify against the authoritative servers
+	var syncTimeout time.Duration
+	if v := s.get("SYNC_TIMEOUT"); v != "" {
+		var err error
+		syncTimeout, err = time.ParseDuration(v)
+		if err != nil {
+			return r53.Route53Updater{}, fmt.Errorf("SYNC_TIMEOUT: %s", err)
+		}
+	}
+
+	return r53.Route53Updater{
+		Region:          s.get("AWS_REGION"),
+		UpdateDomain:    updateDomain,
+		Zoneid:          s.get("ZONEID"),
+		PrivateZone:     s.isTrue("PRIVATE_ZONE"),
+		Profile:         s.get("AWS_PROFILE"),
+		AccessKeyID:     s.get("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: s.get("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    s.get("AWS_SESSION_TOKEN"),
+		RoleARN:         s.get("ROLE_ARN"),
+		ExternalID:      s.get("EXTERNAL_ID"),
+		RoleSessionName: s.get("ROLE_SESSION_NAME"),
+		Endpoint:        s.get("ROUTE53_ENDPOINT"),
+		Naming:          naming(s),
+		DryRun:          dryRun,
+		Logger:          logger,
+		WaitForSync:     s.isTrue("WAIT_FOR_SYNC"),
+		SyncTimeout:     syncTimeout,
+	}, nil
+}
+
+func newCloudflarePublisher(s settings, updateDomain string, dryRun bool, logger *slog.Logger) (provider.Publisher, error) {
+	cfupdater, err := cf.New(cf.CloudflareUpdater{
+		UpdateDomain: updateDomain,
+		ZoneID:       s.get("CLOUDFLARE_ZONE_ID"),
+		APIToken:     s.get("CLOUDFLARE_API_TOKEN"),
+		Endpoint:     s.get("CLOUDFLARE_ENDPOINT"),
+		Naming:       naming(s),
+		DryRun:       dryRun,
+		Logger:       logger,
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = cfupdater.ResolveZone(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	return &cfupdater, nil
+}
+
+func newCloudDNSPublisher(s settings, updateDomain string, dryRun bool, logger *slog.Logger) (provider.Publisher, error) {
+	gcpupdater, err := clouddns.New(clouddns.CloudDNSUpdater{
+		UpdateDomain:    updateDomain,
+		Project:         s.get("GCP_PROJECT"),
+		ManagedZone:     s.get("CLOUDDNS_MANAGED_ZONE"),
+		CredentialsFile: s.get("GOOGLE_APPLICATION_CREDENTIALS"),
+		Endpoint:        s.get("CLOUDDNS_ENDPOINT"),
+		Naming:          naming(s),
+		DryRun:          dryRun,
+		Logger:          logger,
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = gcpupdater.ResolveZone(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	return &gcpupdater, nil
+}
+
+func newAzureDNSPublisher(s settings, updateDomain string, dryRun bool, logger *slog.Logger) (provider.Publisher, error) {
+	azupdater, err := azuredns.New(azuredns.AzureDNSUpdater{
+		UpdateDomain:      updateDomain,
+		SubscriptionID:    s.get("AZURE_SUBSCRIPTION_ID"),
+		ResourceGroup:     s.get("AZURE_RESOURCE_GROUP"),
+		ZoneName:          s.get("AZURE_DNS_ZONE"),
+		TenantID:          s.get("AZURE_TENANT_ID"),
+		ClientID:          s.get("AZURE_CLIENT_ID"),
+		ClientSecret:      s.get("AZURE_CLIENT_SECRET"),
+		Endpoint:          s.get("AZURE_ENDPOINT"),
+		AuthorityEndpoint: s.get("AZURE_AUTHORITY_ENDPOINT"),
+		Naming:            naming(s),
+		DryRun:            dryRun,
+		Logger:            logger,
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = azupdater.ResolveZone(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	return &azupdater, nil
+}
+
+func newRFC2136Publisher(s settings, updateDomain string, dryRun bool, logger *slog.Logger) (provider.Publisher, error) {
+	dnsupdater, err := rfc2136.New(rfc2136.RFC2136Updater{
+		UpdateDomain:  updateDomain,
+		Zone:          s.get("RFC2136_ZONE"),
+		Server:        s.get("RFC2136_SERVER"),
+		TSIGKeyName:   s.get("TSIG_KEY_NAME"),
+		TSIGSecret:    s.get("TSIG_SECRET"),
+		TSIGAlgorithm: s.get("TSIG_ALGORITHM"),
+		Naming:        naming(s),
+		DryRun:        dryRun,
+		Logger:        logger,
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = dnsupdater.ResolveZone(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	return &dnsupdater, nil
+}
+
+func newPowerDNSPublisher(s settings, updateDomain string, dryRun bool, logger *slog.Logger) (provider.Publisher, error) {
+	pdnsupdater, err := powerdns.New(powerdns.PowerDNSUpdater{
+		UpdateDomain: updateDomain,
+		Zone:         s.get("POWERDNS_ZONE"),
+		Endpoint:     s.get("POWERDNS_ENDPOINT"),
+		APIKey:       s.get("POWERDNS_API_KEY"),
+		ServerID:     s.get("POWERDNS_SERVER_ID"),
+		Naming:       naming(s),
+		DryRun:       dryRun,
+		Logger:       logger,
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = pdnsupdater.ResolveZone(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	return &pdnsupdater, nil
+}
+
+func newZoneFilePublisher(s settings, updateDomain string, dryRun bool, logger *slog.Logger) (provider.Publisher, error) {
+	zfupdater, err := zonefile.New(zonefile.ZoneFileUpdater{
+		UpdateDomain: updateDomain,
+		Path:         s.get("ZONEFILE_PATH"),
+		Patch:        s.isTrue("ZONEFILE_PATCH"),
+		Naming:       naming(s),
+		DryRun:       dryRun,
+		Logger:       logger,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &zfupdater, nil
+}
+
+func newHookPublisher(s settings, updateDomain string, dryRun bool, logger *slog.Logger) (provider.Publisher, error) {
+	var timeout time.Duration
+	if v := s.get("HOOK_TIMEOUT"); v != "" {
+		var err error
+		timeout, err = time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("HOOK_TIMEOUT: %s", err)
+		}
+	}
+	hookupdater, err := hook.New(hook.HookUpdater{
+		UpdateDomain: updateDomain,
+		URL:          s.get("HOOK_URL"),
+		Token:        s.get("HOOK_TOKEN"),
+		Command:      strings.Fields(s.get("HOOK_COMMAND")),
+		Timeout:      timeout,
+		Naming:       naming(s),
+		DryRun:       dryRun,
+		Logger:       logger,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &hookupdater, nil
+}
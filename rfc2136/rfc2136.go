@@ -0,0 +1,272 @@
+package rfc2136
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	miekg "github.com/miekg/dns"
+	dns "github.com/searchspring.com/spf-flatten/dns"
+	"github.com/searchspring.com/spf-flatten/provider"
+)
+
+const (
+	DefaultTimeout = 10 * time.Second
+	// How long a TSIG signature stays valid, the RFC 8945 recommended fudge
+	DefaultFudge = 300
+)
+
+// RFC2136Updater publishes with signed DNS UPDATE messages to a primary server such as BIND or Knot.
+// The current records are read with a zone transfer, so the TSIG key needs transfer rights as well as update rights.
+type RFC2136Updater struct {
+	UpdateDomain string
+	// Zone is found from the SOA the server returns for UpdateDomain when empty
+	Zone string
+	// Server is the host:port of the primary accepting updates
+	Server string
+	// TSIG key, the secret is base64 encoded and the algorithm is hmac-sha256 (default) or hmac-sha512
+	TSIGKeyName   string
+	TSIGSecret    string
+	TSIGAlgorithm string
+	// Naming picks out the leaf records of the domain, the default _spfN when empty
+	Naming dns.Naming
+	DryRun bool
+	// Logger gets what was published, or with DryRun would have been, nothing is logged when nil
+	Logger  *slog.Logger
+	Timeout time.Duration
+	seen    *snapshot
+}
+
+// snapshot is the tree as last listed, updates require the zone to still hold exactly these record sets
+type snapshot struct {
+	mu      sync.Mutex
+	records map[string]provider.Record
+}
+
+var _ provider.BatchPublisher = &RFC2136Updater{}
+
+func New(s RFC2136Updater) (RFC2136Updater, error) {
+	if s.Server == "" {
+		return s, fmt.Errorf("no DNS server configured for RFC 2136 updates")
+	}
+	if s.TSIGKeyName == "" || s.TSIGSecret == "" {
+		return s, fmt.Errorf("a TSIG key name and secret must be configured for RFC 2136 updates")
+	}
+	switch strings.ToLower(strings.TrimSuffix(s.TSIGAlgorithm, ".")) {
+	case "", "hmac-sha256":
+		s.TSIGAlgorithm = miekg.HmacSHA256
+	case "hmac-sha512":
+		s.TSIGAlgorithm = miekg.HmacSHA512
+	default:
+		return s, fmt.Errorf("unsupported TSIG algorithm %q, use hmac-sha256 or hmac-sha512", s.TSIGAlgorithm)
+	}
+	s.TSIGKeyName = miekg.Fqdn(strings.ToLower(s.TSIGKeyName))
+	if s.Timeout == 0 {
+		s.Timeout = DefaultTimeout
+	}
+	s.seen = &snapshot{}
+	return s, nil
+}
+
+// ResolveZone asks the server for the SOA of UpdateDomain to learn which zone it belongs to
+func (s *RFC2136Updater) ResolveZone(ctx context.Context) error {
+	if s.seen == nil {
+		return fmt.Errorf("RFC2136Updater must be created with New")
+	}
+	if s.Zone != "" {
+		return nil
+	}
+	m := new(miekg.Msg)
+	m.SetQuestion(provider.Fqdn(s.UpdateDomain), miekg.TypeSOA)
+	resp, err := s.exchange(ctx, m)
+	if err != nil {
+		return err
+	}
+	for _, rr := range append(resp.Answer, resp.Ns...) {
+		if soa, ok := rr.(*miekg.SOA); ok {
+			s.Zone = provider.Fqdn(soa.Hdr.Name)
+			return nil
+		}
+	}
+	return fmt.Errorf("%v did not return an SOA for %v", s.Server, s.UpdateDomain)
+}
+
+// ListRecords transfers the zone and returns the TXT record sets of domain and its _spfN leaves
+func (s *RFC2136Updater) ListRecords(ctx context.Context, domain string) ([]provider.Record, error) {
+	existing, err := s.transfer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]provider.Record)
+	var records []provider.Record
+	for name, record := range existing {
+		if name == provider.Fqdn(domain) || s.Naming.IsLeaf(name, domain) {
+			seen[name] = record
+			records = append(records, record)
+		}
+	}
+	s.seen.mu.Lock()
+	s.seen.records = seen
+	s.seen.mu.Unlock()
+	return records, nil
+}
+
+func (s *RFC2136Updater) Apply(ctx context.Context, changes provider.ChangeSet) error {
+	return s.ApplyBatch(ctx, changes, nil)
+}
+
+func (s *RFC2136Updater) DeleteRecords(ctx context.Context, records []provider.Record) error {
+	return s.ApplyBatch(ctx, nil, records)
+}
+
+// ApplyBatch sends a single UPDATE, its prerequisites make the server refuse it if any record set it
+// touches is no longer what ListRecords saw
+func (s *RFC2136Updater) ApplyBatch(ctx context.Context, changes provider.ChangeSet, stale []provider.Record) error {
+	err := s.ResolveZone(ctx)
+	if err != nil {
+		return err
+	}
+	s.seen.mu.Lock()
+	seen := s.seen.records
+	s.seen.mu.Unlock()
+	if seen == nil {
+		seen, err = s.transfer(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	m := new(miekg.Msg)
+	m.SetUpdate(s.Zone)
+	for _, change := range changes {
+		name := provider.Fqdn(change.Record.Name)
+		s.prerequisite(m, name, seen)
+		m.RemoveRRset([]miekg.RR{&miekg.TXT{Hdr: miekg.RR_Header{Name: name, Rrtype: miekg.TypeTXT}}})
+		m.Insert(txtRRs(name, change.Record.TTL, change.Record.Values))
+	}
+	for _, record := range stale {
+		name := provider.Fqdn(record.Name)
+		s.prerequisite(m, name, seen)
+		m.RemoveRRset([]miekg.RR{&miekg.TXT{Hdr: miekg.RR_Header{Name: name, Rrtype: miekg.TypeTXT}}})
+	}
+	if len(m.Ns) == 0 {
+		return nil
+	}
+	if s.DryRun {
+		s.logger().Info("DryRun TXT records not updated", "domain", s.UpdateDomain, "update", m.String())
+		return nil
+	}
+
+	resp, err := s.exchange(ctx, m)
+	if err != nil {
+		return err
+	}
+	if resp.Rcode != miekg.RcodeSuccess {
+		return fmt.Errorf("update of %v refused by %v: %v", s.Zone, s.Server, miekg.RcodeToString[resp.Rcode])
+	}
+
+	// What was just written is now the state later updates have to match
+	s.seen.mu.Lock()
+	if s.seen.records != nil {
+		for _, change := range changes {
+			record := change.Record
+			record.Name = provider.Fqdn(record.Name)
+			s.seen.records[record.Name] = record
+		}
+		for _, record := range stale {
+			delete(s.seen.records, provider.Fqdn(record.Name))
+		}
+	}
+	s.seen.mu.Unlock()
+	s.logger().Info("TXT records updated", "domain", s.UpdateDomain, "zone", s.Zone, "server", s.Server)
+	return nil
+}
+
+// prerequisite requires name to hold exactly the TXT values seen, or no TXT record at all if none were seen
+func (s *RFC2136Updater) prerequisite(m *miekg.Msg, name string, seen map[string]provider.Record) {
+	current, ok := seen[name]
+	if !ok {
+		m.RRsetNotUsed([]miekg.RR{&miekg.TXT{Hdr: miekg.RR_Header{Name: name, Rrtype: miekg.TypeTXT}}})
+		return
+	}
+	m.Used(txtRRs(name, 0, current.Values))
+}
+
+// transfer reads every TXT record set in the zone with a signed AXFR
+func (s *RFC2136Updater) transfer(ctx context.Context) (map[string]provider.Record, error) {
+	err := s.ResolveZone(ctx)
+	if err != nil {
+		return nil, err
+	}
+	m := new(miekg.Msg)
+	m.SetAxfr(s.Zone)
+	m.SetTsig(s.TSIGKeyName, s.TSIGAlgorithm, DefaultFudge, time.Now().Unix())
+
+	tr := &miekg.Transfer{
+		DialTimeout:  s.Timeout,
+		ReadTimeout:  s.Timeout,
+		WriteTimeout: s.Timeout,
+		TsigSecret:   map[string]string{s.TSIGKeyName: s.TSIGSecret},
+	}
+	envelopes, err := tr.In(m, s.Server)
+	if err != nil {
+		return nil, err
+	}
+	records := make(map[string]provider.Record)
+	for envelope := range envelopes {
+		if envelope.Error != nil {
+			return nil, fmt.Errorf("zone transfer of %v from %v: %v", s.Zone, s.Server, envelope.Error)
+		}
+		for _, rr := range envelope.RR {
+			txt, ok := rr.(*miekg.TXT)
+			if !ok {
+				continue
+			}
+			name := provider.Fqdn(txt.Hdr.Name)
+			record := records[name]
+			record.Name = name
+			record.TTL = int64(txt.Hdr.Ttl)
+			record.Values = append(record.Values, dns.JoinTXT(txt.Txt))
+			records[name] = record
+		}
+	}
+	return records, nil
+}
+
+// exchange sends a TSIG signed message over TCP and verifies the signed response
+func (s *RFC2136Updater) exchange(ctx context.Context, m *miekg.Msg) (*miekg.Msg, error) {
+	m.SetTsig(s.TSIGKeyName, s.TSIGAlgorithm, DefaultFudge, time.Now().Unix())
+	client := &miekg.Client{
+		Net:        "tcp",
+		Timeout:    s.Timeout,
+		TsigSecret: map[string]string{s.TSIGKeyName: s.TSIGSecret},
+	}
+	resp, _, err := client.ExchangeContext(ctx, m, s.Server)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", s.Server, err)
+	}
+	return resp, nil
+}
+
+// txtRRs builds the TXT records for values, miekg holds character-strings in escaped presentation format
+func txtRRs(name string, ttl int64, values []string) []miekg.RR {
+	rrs := make([]miekg.RR, 0, len(values))
+	for _, value := range values {
+		chunks := dns.SplitTXT(value)
+		for i, chunk := range chunks {
+			chunks[i] = dns.EscapeTXT(chunk)
+		}
+		rrs = append(rrs, &miekg.TXT{
+			Hdr: miekg.RR_Header{Name: name, Rrtype: miekg.TypeTXT, Class: miekg.ClassINET, Ttl: uint32(ttl)},
+			Txt: chunks,
+		})
+	}
+	return rrs
+}
+
+func (s *RFC2136Updater) logger() *slog.Logger {
+	return dns.LoggerOrDiscard(s.Logger)
+}
@@ -0,0 +1,297 @@
+package rfc2136
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	miekg "github.com/miekg/dns"
+	dns "github.com/searchspring.com/spf-flatten/dns"
+	"github.com/searchspring.com/spf-flatten/provider"
+	"github.com/searchspring.com/spf-flatten/provider/providertest"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testKeyName = "spf-flatten."
+	testSecret  = "c3BmLWZsYXR0ZW4tdGVzdC1zZWNyZXQtMzItYnl0ZXMhIQ=="
+)
+
+// FakeNameServer is an in-process primary for one zone that answers SOA queries and AXFR and accepts
+// TSIG signed updates, evaluating their prerequisites the way RFC 2136 section 3.2 describes
+type FakeNameServer struct {
+	Zone    string
+	Updates int
+	mu      sync.Mutex
+	records map[string]provider.Record
+}
+
+func NewFakeNameServer(zone string) *FakeNameServer {
+	return &FakeNameServer{Zone: zone, records: map[string]provider.Record{}}
+}
+
+// Start serves on a local TCP port until the test ends and returns its address
+func (s *FakeNameServer) Start(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	started := make(chan struct{})
+	server := &miekg.Server{
+		Listener:          listener,
+		Handler:           s,
+		TsigSecret:        map[string]string{testKeyName: testSecret},
+		NotifyStartedFunc: func() { close(started) },
+		MsgAcceptFunc: func(dh miekg.Header) miekg.MsgAcceptAction {
+			return miekg.MsgAccept
+		},
+	}
+	go func() { _ = server.ActivateAndServe() }()
+	<-started
+	t.Cleanup(func() { _ = server.Shutdown() })
+	return listener.Addr().String()
+}
+
+func (s *FakeNameServer) ServeDNS(w miekg.ResponseWriter, r *miekg.Msg) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	resp := new(miekg.Msg)
+	resp.SetReply(r)
+	if r.IsTsig() == nil || w.TsigStatus() != nil {
+		resp.Rcode = miekg.RcodeNotAuth
+		_ = w.WriteMsg(resp)
+		return
+	}
+	switch {
+	case r.Opcode == miekg.OpcodeUpdate:
+		resp.Rcode = s.update(r)
+	case r.Question[0].Qtype == miekg.TypeSOA:
+		resp.Authoritative = true
+		if miekg.IsSubDomain(s.Zone, r.Question[0].Name) {
+			resp.Ns = append(resp.Ns, s.soa())
+		} else {
+			resp.Rcode = miekg.RcodeRefused
+		}
+	case r.Question[0].Qtype == miekg.TypeAXFR:
+		resp.Answer = append(resp.Answer, s.soa())
+		for _, name := range s.names() {
+			resp.Answer = append(resp.Answer, txtRRs(name, s.records[name].TTL, s.records[name].Values)...)
+		}
+		resp.Answer = append(resp.Answer, s.soa())
+	default:
+		resp.Rcode = miekg.RcodeRefused
+	}
+	resp.SetTsig(testKeyName, miekg.HmacSHA256, DefaultFudge, int64(r.IsTsig().TimeSigned))
+	_ = w.WriteMsg(resp)
+}
+
+// update checks every prerequisite before touching the zone, so a failed update changes nothing
+func (s *FakeNameServer) update(r *miekg.Msg) int {
+	if !strings.EqualFold(r.Question[0].Name, s.Zone) {
+		return miekg.RcodeNotZone
+	}
+	used := map[string][]string{}
+	for _, rr := range r.Answer {
+		name := strings.ToLower(rr.Header().Name)
+		switch rr.Header().Class {
+		case miekg.ClassNONE:
+			if _, ok := s.records[name]; ok {
+				return miekg.RcodeYXRrset
+			}
+		case miekg.ClassINET:
+			used[name] = append(used[name], dns.JoinTXT(rr.(*miekg.TXT).Txt))
+		default:
+			return miekg.RcodeFormatError
+		}
+	}
+	for name, values := range used {
+		if !sameValues(s.records[name].Values, values) {
+			return miekg.RcodeNXRrset
+		}
+	}
+	for _, rr := range r.Ns {
+		name := strings.ToLower(rr.Header().Name)
+		switch rr.Header().Class {
+		case miekg.ClassANY:
+			delete(s.records, name)
+		case miekg.ClassINET:
+			record := s.records[name]
+			record.Name = name
+			record.TTL = int64(rr.Header().Ttl)
+			record.Values = append(record.Values, dns.JoinTXT(rr.(*miekg.TXT).Txt))
+			s.records[name] = record
+		}
+	}
+	s.Updates++
+	return miekg.RcodeSuccess
+}
+
+func (s *FakeNameServer) soa() miekg.RR {
+	return &miekg.SOA{
+		Hdr:    miekg.RR_Header{Name: s.Zone, Rrtype: miekg.TypeSOA, Class: miekg.ClassINET, Ttl: 3600},
+		Ns:     "ns1." + s.Zone,
+		Mbox:   "hostmaster." + s.Zone,
+		Serial: 1,
+	}
+}
+
+func (s *FakeNameServer) names() []string {
+	var names []string
+	for name := range s.records {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *FakeNameServer) Seed(records ...provider.Record) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, record := range records {
+		record.Name = provider.Fqdn(record.Name)
+		s.records[record.Name] = record
+	}
+}
+
+func (s *FakeNameServer) Records() []provider.Record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var records []provider.Record
+	for _, name := range s.names() {
+		records = append(records, s.records[name])
+	}
+	return records
+}
+
+func sameValues(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func newTestUpdater(t *testing.T, fake *FakeNameServer, secret string) RFC2136Updater {
+	updater, err := New(RFC2136Updater{
+		UpdateDomain: providertest.Domain,
+		Server:       fake.Start(t),
+		TSIGKeyName:  testKeyName,
+		TSIGSecret:   secret,
+	})
+	require.Nil(t, err)
+	return updater
+}
+
+func TestPublisherConformance(t *testing.T) {
+	providertest.Run(t, func(t *testing.T) providertest.Harness {
+		fake := NewFakeNameServer("example.com.")
+		updater := newTestUpdater(t, fake, testSecret)
+		return providertest.Harness{Publisher: &updater, Seed: fake.Seed, Records: fake.Records}
+	})
+}
+
+func TestPublishIsOneUpdate(t *testing.T) {
+	fake := NewFakeNameServer("example.com.")
+	fake.Seed(
+		provider.Record{Name: "example.com.", TTL: 300, Values: []string{"v=spf1 include:_spf1.example.com include:_spf2.example.com ~all"}},
+		provider.Record{Name: "_spf1.example.com.", TTL: 300, Values: []string{"v=spf1 ip4:192.0.2.1 ~all"}},
+		provider.Record{Name: "_spf2.example.com.", TTL: 300, Values: []string{"v=spf1 ip4:192.0.2.2 ~all"}},
+	)
+	updater := newTestUpdater(t, fake, testSecret)
+	_, err := provider.Publish(context.TODO(), &updater, "example.com", map[string]string{
+		"example.com":       "v=spf1 include:_spf1.example.com ~all",
+		"_spf1.example.com": "v=spf1 ip4:192.0.2.3 ~all",
+	}, provider.PlanOptions{})
+	require.Nil(t, err)
+	require.Equal(t, 1, fake.Updates)
+	require.Equal(t, "example.com.", updater.Zone)
+	require.Len(t, fake.Records(), 2)
+}
+
+func TestZoneChangedUnderneath(t *testing.T) {
+	fake := NewFakeNameServer("example.com.")
+	fake.Seed(provider.Record{Name: "_spf1.example.com.", TTL: 300, Values: []string{"v=spf1 ip4:192.0.2.1 ~all"}})
+	updater := newTestUpdater(t, fake, testSecret)
+	_, err := updater.ListRecords(context.TODO(), "example.com")
+	require.Nil(t, err)
+
+	// Someone else edits the leaf after we listed it
+	fake.Seed(
+		provider.Record{Name: "_spf1.example.com.", TTL: 300, Values: []string{"v=spf1 ip4:198.51.100.1 ~all"}},
+	)
+	err = updater.Apply(context.TODO(), provider.ChangeSet{
+		{Action: provider.Update, Record: provider.Record{Name: "_spf1.example.com.", TTL: 300, Values: []string{"v=spf1 ip4:192.0.2.3 ~all"}}},
+	})
+	require.EqualError(t, err, "update of example.com. refused by "+updater.Server+": NXRRSET")
+
+	// and creates the root we believe is missing
+	fake.Seed(provider.Record{Name: "example.com.", TTL: 300, Values: []string{"v=spf1 include:_spf1.example.com ~all"}})
+	err = updater.Apply(context.TODO(), provider.ChangeSet{
+		{Action: provider.Create, Record: provider.Record{Name: "example.com.", TTL: 300, Values: []string{"v=spf1 include:_spf1.example.com -all"}}},
+	})
+	require.EqualError(t, err, "update of example.com. refused by "+updater.Server+": YXRRSET")
+	require.Equal(t, 0, fake.Updates)
+	require.Equal(t, []string{"v=spf1 ip4:198.51.100.1 ~all"}, fake.Records()[0].Values)
+}
+
+func TestEscapedValues(t *testing.T) {
+	fake := NewFakeNameServer("example.com.")
+	updater := newTestUpdater(t, fake, testSecret)
+	value := `v=spf1 exp=%{i}.explain.example.com "quoted" back\slash ~all`
+	err := updater.Apply(context.TODO(), provider.ChangeSet{
+		{Action: provider.Create, Record: provider.Record{Name: "example.com.", TTL: 300, Values: []string{value}}},
+	})
+	require.Nil(t, err)
+	require.Equal(t, []string{value}, fake.Records()[0].Values)
+	records, err := updater.ListRecords(context.TODO(), "example.com")
+	require.Nil(t, err)
+	require.Equal(t, []string{value}, records[0].Values)
+}
+
+func TestBadTSIGSecret(t *testing.T) {
+	fake := NewFakeNameServer("example.com.")
+	updater := newTestUpdater(t, fake, "d3Jvbmctc2VjcmV0")
+	updater.Zone = "example.com."
+	_, err := updater.ListRecords(context.TODO(), "example.com")
+	require.ErrorContains(t, err, "zone transfer of example.com.")
+}
+
+func TestResolveZone(t *testing.T) {
+	fake := NewFakeNameServer("example.com.")
+	updater := newTestUpdater(t, fake, testSecret)
+	updater.UpdateDomain = "mail.example.com"
+	err := updater.ResolveZone(context.TODO())
+	require.Nil(t, err)
+	require.Equal(t, "example.com.", updater.Zone)
+
+	updater.Zone = ""
+	updater.UpdateDomain = "example.org"
+	err = updater.ResolveZone(context.TODO())
+	require.EqualError(t, err, updater.Server+" did not return an SOA for example.org")
+}
+
+func TestNew(t *testing.T) {
+	_, err := New(RFC2136Updater{TSIGKeyName: testKeyName, TSIGSecret: testSecret})
+	require.EqualError(t, err, "no DNS server configured for RFC 2136 updates")
+
+	_, err = New(RFC2136Updater{Server: "127.0.0.1:53"})
+	require.EqualError(t, err, "a TSIG key name and secret must be configured for RFC 2136 updates")
+
+	_, err = New(RFC2136Updater{Server: "127.0.0.1:53", TSIGKeyName: testKeyName, TSIGSecret: testSecret, TSIGAlgorithm: "hmac-md5"})
+	require.EqualError(t, err, `unsupported TSIG algorithm "hmac-md5", use hmac-sha256 or hmac-sha512`)
+
+	updater, err := New(RFC2136Updater{Server: "127.0.0.1:53", TSIGKeyName: "Spf-Flatten", TSIGSecret: testSecret, TSIGAlgorithm: "HMAC-SHA512"})
+	require.Nil(t, err)
+	require.Equal(t, "spf-flatten.", updater.TSIGKeyName)
+	require.Equal(t, miekg.HmacSHA512, updater.TSIGAlgorithm)
+	require.Equal(t, DefaultTimeout, updater.Timeout)
+}
@@ -0,0 +1,178 @@
+package route53
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/route53"
+	dns "github.com/searchspring.com/spf-flatten/dns"
+	"github.com/searchspring.com/spf-flatten/provider"
+)
+
+// Route53Updater publishes to a single hosted zone
+var _ provider.BatchPublisher = &Route53Updater{}
+
+// UpdateTXTRecords publishes the SPF records, submitting only the record sets that differ from the zone
+// and deleting stale _spfN leaves of UpdateDomain
+func (s *Route53Updater) UpdateTXTRecords(txtRecs map[string]string) (provider.Diff, error) {
+	return provider.Publish(context.TODO(), s, s.UpdateDomain, txtRecs, s.planOptions())
+}
+
+// UpdateTXTRecord sets the SPF value of a single record, leaving any other TXT values on it in place
+func (s *Route53Updater) UpdateTXTRecord(recordName, newValue string) error {
+	existing, err := s.listTXTRecords(context.TODO())
+	if err != nil {
+		return err
+	}
+	var current []provider.Record
+	if rrset, ok := existing[provider.Fqdn(recordName)]; ok {
+		current = append(current, toRecord(rrset))
+	}
+	opts := s.planOptions()
+	if provider.Fqdn(recordName) != provider.Fqdn(s.UpdateDomain) {
+		opts.RootTTL = 0
+	}
+	plan := provider.NewPlan(recordName, current, map[string]string{recordName: newValue}, opts)
+	return s.Apply(context.TODO(), plan.Changes)
+}
+
+// ListRecords returns the TXT record sets of domain and its _spfN leaves
+func (s *Route53Updater) ListRecords(ctx context.Context, domain string) ([]provider.Record, error) {
+	existing, err := s.listTXTRecords(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var records []provider.Record
+	for name, rrset := range existing {
+		if name == provider.Fqdn(domain) || s.Naming.IsLeaf(name, domain) {
+			records = append(records, toRecord(rrset))
+		}
+	}
+	return records, nil
+}
+
+// Apply upserts every record set in a single, atomic, change batch
+func (s *Route53Updater) Apply(ctx context.Context, changes provider.ChangeSet) error {
+	return s.ApplyBatch(ctx, changes, nil)
+}
+
+// DeleteRecords deletes the record sets in a single change batch
+func (s *Route53Updater) DeleteRecords(ctx context.Context, records []provider.Record) error {
+	return s.ApplyBatch(ctx, nil, records)
+}
+
+// ApplyBatch upserts the changes and deletes the stale record sets in one atomic change batch
+func (s *Route53Updater) ApplyBatch(ctx context.Context, changes provider.ChangeSet, stale []provider.Record) error {
+	var batch []*route53.Change
+	for _, change := range changes {
+		rrset := &route53.ResourceRecordSet{
+			Name: aws.String(provider.Fqdn(change.Record.Name)),
+			Type: aws.String(route53.RRTypeTxt),
+			TTL:  aws.Int64(change.Record.TTL),
+		}
+		for _, value := range change.Record.Values {
+			rrset.ResourceRecords = append(rrset.ResourceRecords, &route53.ResourceRecord{
+				Value: aws.String(dns.QuoteTXT(value)),
+			})
+		}
+		err := rrset.Validate()
+		if err != nil {
+			return err
+		}
+		batch = append(batch, &route53.Change{
+			Action:            aws.String(route53.ChangeActionUpsert),
+			ResourceRecordSet: rrset,
+		})
+	}
+	if len(stale) == 0 {
+		return s.applyChanges(ctx, batch)
+	}
+
+	// A DELETE has to match the record set exactly as Route53 currently holds it
+	existing, err := s.listTXTRecords(ctx)
+	if err != nil {
+		return err
+	}
+	for _, record := range stale {
+		rrset, ok := existing[provider.Fqdn(record.Name)]
+		if !ok {
+			continue
+		}
+		batch = append(batch, &route53.Change{
+			Action:            aws.String(route53.ChangeActionDelete),
+			ResourceRecordSet: rrset,
+		})
+	}
+	return s.applyChanges(ctx, batch)
+}
+
+// listTXTRecords returns every TXT record set in the zone keyed by lower case fully qualified name
+func (s *Route53Updater) listTXTRecords(ctx context.Context) (map[string]*route53.ResourceRecordSet, error) {
+	records := make(map[string]*route53.ResourceRecordSet)
+	input := &route53.ListResourceRecordSetsInput{
+		HostedZoneId: aws.String(s.Zoneid),
+	}
+	for {
+		output, err := s.Route53.ListResourceRecordSetsWithContext(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range output.ResourceRecordSets {
+			// Weighted, latency and other routed record sets are not managed here
+			if aws.StringValue(record.Type) != route53.RRTypeTxt || record.SetIdentifier != nil {
+				continue
+			}
+			records[provider.Fqdn(aws.StringValue(record.Name))] = record
+		}
+		if !aws.BoolValue(output.IsTruncated) {
+			break
+		}
+		input.StartRecordName = output.NextRecordName
+		input.StartRecordType = output.NextRecordType
+		input.StartRecordIdentifier = output.NextRecordIdentifier
+	}
+	return records, nil
+}
+
+func (s *Route53Updater) applyChanges(ctx context.Context, changes []*route53.Change) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	input := &route53.ChangeResourceRecordSetsInput{
+		ChangeBatch:  &route53.ChangeBatch{Changes: changes},
+		HostedZoneId: aws.String(s.Zoneid),
+	}
+	if s.DryRun {
+		s.logger().Info("DryRun TXT records not updated", "domain", s.UpdateDomain, "zone", s.Zoneid, "changes", input.String())
+		return nil
+	}
+	output, err := s.Route53.ChangeResourceRecordSetsWithContext(ctx, input)
+	if err != nil {
+		return err
+	}
+
+	if s.WaitForSync {
+		err = s.WaitForChange(output.ChangeInfo)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.logger().Info("TXT records updated", "domain", s.UpdateDomain, "zone", s.Zoneid, "changes", len(changes))
+	return nil
+}
+
+func (s *Route53Updater) planOptions() provider.PlanOptions {
+	return provider.PlanOptions{TTL: s.TTL, RootTTL: s.RootTTL, Naming: s.Naming}
+}
+
+func toRecord(rrset *route53.ResourceRecordSet) provider.Record {
+	record := provider.Record{
+		Name: provider.Fqdn(aws.StringValue(rrset.Name)),
+		TTL:  aws.Int64Value(rrset.TTL),
+	}
+	for _, rr := range rrset.ResourceRecords {
+		record.Values = append(record.Values, dns.UnquoteTXT(aws.StringValue(rr.Value)))
+	}
+	return record
+}
@@ -2,25 +2,62 @@ package route53
 
 import (
 	"context"
-	"fmt"
+	"log/slog"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/route53"
+
+	dns "github.com/searchspring.com/spf-flatten/dns"
 )
 
 type Route53Updater struct {
 	Region       string
 	UpdateDomain string
 	Zoneid       string
-	DryRun       bool
-	Route53      Route53Interface
+	// PrivateZone selects a private hosted zone when looking up the zone for UpdateDomain
+	PrivateZone bool
+	// Naming picks out the leaf records of the domain, the default _spfN when empty
+	Naming dns.Naming
+	DryRun bool
+	// Logger gets what was published, or with DryRun would have been, nothing is logged when nil
+	Logger *slog.Logger
+	// TTL applies to every record written, RootTTL overrides it for UpdateDomain itself
+	TTL     int64
+	RootTTL int64
+	// WaitForSync blocks each update until Route53 reports the change INSYNC
+	WaitForSync      bool
+	SyncTimeout      time.Duration
+	SyncPollInterval time.Duration
+	// Profile selects a named profile from the shared AWS config instead of the default one
+	Profile string
+	// Static credentials, used instead of the default credential chain when AccessKeyID is set
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// RoleARN is assumed on top of the base credentials, IE to reach a zone in another account
+	RoleARN         string
+	ExternalID      string
+	RoleSessionName string
+	// Endpoint overrides the Route53 API endpoint, IE for a local Route53 compatible server
+	Endpoint string
+	Route53  Route53Interface
+	Resolver AuthoritativeResolver
 }
 
+// Session name used when assuming RoleARN without an explicit RoleSessionName
+const DefaultRoleSessionName = "spf-flatten"
+
 type Route53Interface interface {
 	ListResourceRecordSetsWithContext(context.Context, *route53.ListResourceRecordSetsInput, ...request.Option) (*route53.ListResourceRecordSetsOutput, error)
 	ChangeResourceRecordSetsWithContext(context.Context, *route53.ChangeResourceRecordSetsInput, ...request.Option) (*route53.ChangeResourceRecordSetsOutput, error)
+	GetChangeWithContext(context.Context, *route53.GetChangeInput, ...request.Option) (*route53.GetChangeOutput, error)
+	GetHostedZoneWithContext(context.Context, *route53.GetHostedZoneInput, ...request.Option) (*route53.GetHostedZoneOutput, error)
+	ListHostedZonesByNameWithContext(context.Context, *route53.ListHostedZonesByNameInput, ...request.Option) (*route53.ListHostedZonesByNameOutput, error)
 }
 
 type DefaultRoute53Interface struct {
@@ -33,80 +70,53 @@ func New(s Route53Updater) (Route53Updater, error) {
 		return s, err
 	}
 	s.Route53 = r53interface
+	if s.Resolver == nil {
+		s.Resolver = DefaultAuthoritativeResolver{}
+	}
 	return s, nil
 }
 
+// NewDefaultRoute53Interface builds a dedicated session for this updater, so updaters for zones in
+// different accounts can be used side by side
 func (s Route53Updater) NewDefaultRoute53Interface() (Route53Interface, error) {
+	config := aws.Config{}
+	if s.Region != "" {
+		config.Region = aws.String(s.Region)
+	}
+	if s.AccessKeyID != "" {
+		config.Credentials = credentials.NewStaticCredentials(s.AccessKeyID, s.SecretAccessKey, s.SessionToken)
+	}
 	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            config,
+		Profile:           s.Profile,
 		SharedConfigState: session.SharedConfigEnable,
 	})
 	if err != nil {
 		return nil, err
 	}
-	// Create a Route 53 client
-	return route53.New(sess), nil
-
-}
-
-func (s *Route53Updater) UpdateTXTRecord(recordName, newValue string) error {
-
-	// Retrieve the existing record
-	existingRecord, err := s.Route53.ListResourceRecordSetsWithContext(context.TODO(), &route53.ListResourceRecordSetsInput{
-		HostedZoneId: aws.String(s.Zoneid),
-	})
-	if err != nil {
-		return err
-	}
 
-	// Find the TXT record
-	var targetRecord *route53.ResourceRecordSet
-	for _, record := range existingRecord.ResourceRecordSets {
-		if aws.StringValue(record.Name) == recordName && aws.StringValue(record.Type) == "TXT" {
-			targetRecord = record
-			break
+	// The endpoint override only applies to Route53, STS is still reached as normal to assume the role
+	clientConfig := aws.NewConfig()
+	if s.RoleARN != "" {
+		sessionName := s.RoleSessionName
+		if sessionName == "" {
+			sessionName = DefaultRoleSessionName
 		}
+		clientConfig.Credentials = stscreds.NewCredentials(sess, s.RoleARN, func(p *stscreds.AssumeRoleProvider) {
+			p.RoleSessionName = sessionName
+			if s.ExternalID != "" {
+				p.ExternalID = aws.String(s.ExternalID)
+			}
+		})
 	}
-	if targetRecord == nil {
-		targetRecord = &route53.ResourceRecordSet{
-			Name: aws.String(recordName),
-			Type: aws.String(route53.RRTypeTxt),
-		}
-	}
-
-	err = targetRecord.Validate()
-	if err != nil {
-		return err
-	}
-
-	// If the TXT record is found, update it; otherwise, create a new record
-	targetRecord.ResourceRecords = []*route53.ResourceRecord{
-		{
-			Value: aws.String(newValue),
-		},
-	}
-
-	changeBatch := &route53.ChangeBatch{
-		Changes: []*route53.Change{
-			{
-				Action:            aws.String("UPSERT"),
-				ResourceRecordSet: targetRecord,
-			},
-		},
-	}
-	input := &route53.ChangeResourceRecordSetsInput{
-		ChangeBatch:  changeBatch,
-		HostedZoneId: aws.String(s.Zoneid),
-	}
-	if s.DryRun {
-		fmt.Printf("DryRun TXT record not updated\n: %v\n", input)
-		return nil
-	}
-	_, err = s.Route53.ChangeResourceRecordSetsWithContext(context.TODO(), input)
-	if err != nil {
-		return err
+	if s.Endpoint != "" {
+		clientConfig.Endpoint = aws.String(s.Endpoint)
 	}
+	// Create a Route 53 client
+	return route53.New(sess, clientConfig), nil
 
-	fmt.Println("TXT record updated successfully")
+}
 
-	return nil
+func (s *Route53Updater) logger() *slog.Logger {
+	return dns.LoggerOrDiscard(s.Logger)
 }
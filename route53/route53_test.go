@@ -3,12 +3,18 @@ package route53
 import (
 	"context"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/route53"
+	dns "github.com/searchspring.com/spf-flatten/dns"
+	"github.com/searchspring.com/spf-flatten/provider"
+	"github.com/searchspring.com/spf-flatten/provider/providertest"
 	"github.com/stretchr/testify/require"
 )
 
@@ -18,6 +24,21 @@ type MockRoute53Interface struct {
 	ListResourceRecordSetsOutput   *route53.ListResourceRecordSetsOutput
 	ChangeResourceRecordSetsInput  *route53.ChangeResourceRecordSetsInput
 	ChangeResourceRecordSetsOutput *route53.ChangeResourceRecordSetsOutput
+	GetChangeOutput                *route53.GetChangeOutput
+	GetHostedZoneOutput            *route53.GetHostedZoneOutput
+	HostedZones                    []*route53.HostedZone
+}
+
+type MockAuthoritativeResolver struct {
+	Answers map[string]map[string][]string
+}
+
+func (s MockAuthoritativeResolver) LookupTXT(ctx context.Context, server string, name string) ([]string, error) {
+	txt, ok := s.Answers[server][name]
+	if !ok {
+		return nil, fmt.Errorf("lookup %v on %v: no such host", name, server)
+	}
+	return txt, nil
 }
 
 func (s MockRoute53Interface) ListResourceRecordSetsWithContext(cxt context.Context, input *route53.ListResourceRecordSetsInput, option ...request.Option) (*route53.ListResourceRecordSetsOutput, error) {
@@ -34,6 +55,17 @@ func (s MockRoute53Interface) ChangeResourceRecordSetsWithContext(cxt context.Co
 	return s.ChangeResourceRecordSetsOutput, nil
 }
 
+func (s MockRoute53Interface) GetChangeWithContext(cxt context.Context, input *route53.GetChangeInput, option ...request.Option) (*route53.GetChangeOutput, error) {
+	return s.GetChangeOutput, nil
+}
+
+func (s MockRoute53Interface) GetHostedZoneWithContext(cxt context.Context, input *route53.GetHostedZoneInput, option ...request.Option) (*route53.GetHostedZoneOutput, error) {
+	if s.Zoneid != *input.Id {
+		return nil, fmt.Errorf("Zone not found.")
+	}
+	return s.GetHostedZoneOutput, nil
+}
+
 func TestUpdateTXTRecord(t *testing.T) {
 	zoneid := "ZONEID"
 	route53updater := Route53Updater{
@@ -56,6 +88,9 @@ func TestUpdateTXTRecord(t *testing.T) {
 					SubmittedAt: aws.Time(time.Now()),
 				},
 			},
+			GetChangeOutput: &route53.GetChangeOutput{
+				ChangeInfo: &route53.ChangeInfo{Id: aws.String("bogus"), Status: aws.String(route53.ChangeStatusPending)},
+			},
 		},
 	}
 	err := route53updater.UpdateTXTRecord("example.com.", "v=spf1 ip:192.168.1.1 ~all")
@@ -66,6 +101,83 @@ func TestUpdateTXTRecord(t *testing.T) {
 	err = route53updater.UpdateTXTRecord("example.com.", "v=spf1 ip:192.168.1.1 ~all")
 	require.Error(t, err, fmt.Errorf("Zone not found."))
 
+	// Waiting for the change to go INSYNC
+	route53updater.Zoneid = zoneid
+	route53updater.WaitForSync = true
+	route53updater.SyncTimeout = 50 * time.Millisecond
+	route53updater.SyncPollInterval = time.Millisecond
+	err = route53updater.UpdateTXTRecord("example.com.", "v=spf1 ip:192.168.1.1 ~all")
+	require.ErrorContains(t, err, "not in sync")
+
+}
+
+func (s MockRoute53Interface) ListHostedZonesByNameWithContext(cxt context.Context, input *route53.ListHostedZonesByNameInput, option ...request.Option) (*route53.ListHostedZonesByNameOutput, error) {
+	return &route53.ListHostedZonesByNameOutput{HostedZones: s.HostedZones, DNSName: input.DNSName}, nil
+}
+
+func TestWaitForChange(t *testing.T) {
+	route53updater := Route53Updater{
+		SyncTimeout:      50 * time.Millisecond,
+		SyncPollInterval: time.Millisecond,
+		Route53: MockRoute53Interface{
+			GetChangeOutput: &route53.GetChangeOutput{
+				ChangeInfo: &route53.ChangeInfo{Id: aws.String("C1"), Status: aws.String(route53.ChangeStatusInsync)},
+			},
+		},
+	}
+	err := route53updater.WaitForChange(&route53.ChangeInfo{Id: aws.String("C1"), Status: aws.String(route53.ChangeStatusPending)})
+	require.Nil(t, err)
+
+	route53updater.Route53 = MockRoute53Interface{
+		GetChangeOutput: &route53.GetChangeOutput{
+			ChangeInfo: &route53.ChangeInfo{Id: aws.String("C1"), Status: aws.String(route53.ChangeStatusPending)},
+		},
+	}
+	err = route53updater.WaitForChange(&route53.ChangeInfo{Id: aws.String("C1"), Status: aws.String(route53.ChangeStatusPending)})
+	require.ErrorContains(t, err, "not in sync")
+}
+
+func TestVerifyTXTRecords(t *testing.T) {
+	zoneid := "ZONEID"
+	txtRecs := map[string]string{
+		"example.com.":       "v=spf1 include:_spf1.example.com. ~all",
+		"_spf1.example.com.": "v=spf1 ip4:192.168.1.1 ~all",
+	}
+	resolver := MockAuthoritativeResolver{Answers: map[string]map[string][]string{
+		"ns-1.awsdns-01.org": {
+			"example.com.":       {"google-site-verification=abc", "v=spf1 include:_spf1.example.com. ~all"},
+			"_spf1.example.com.": {"v=spf1 ip4:192.168.1.1 ~all"},
+		},
+		"ns-2.awsdns-02.com": {
+			"example.com.":       {"v=spf1 include:_spf1.example.com. ~all"},
+			"_spf1.example.com.": {"v=spf1 ip4:192.168.1.2 ~all"},
+		},
+	}}
+	route53updater := Route53Updater{
+		Zoneid:   zoneid,
+		Resolver: resolver,
+		Route53: MockRoute53Interface{
+			Zoneid: zoneid,
+			GetHostedZoneOutput: &route53.GetHostedZoneOutput{
+				DelegationSet: &route53.DelegationSet{NameServers: aws.StringSlice([]string{"ns-1.awsdns-01.org"})},
+			},
+		},
+	}
+	err := route53updater.VerifyTXTRecords(txtRecs)
+	require.Nil(t, err)
+
+	route53updater.Route53 = MockRoute53Interface{
+		Zoneid: zoneid,
+		GetHostedZoneOutput: &route53.GetHostedZoneOutput{
+			DelegationSet: &route53.DelegationSet{NameServers: aws.StringSlice([]string{"ns-1.awsdns-01.org", "ns-2.awsdns-02.com"})},
+		},
+	}
+	err = route53updater.VerifyTXTRecords(txtRecs)
+	require.ErrorContains(t, err, "_spf1.example.com.@ns-2.awsdns-02.com")
+
+	route53updater.Route53 = MockRoute53Interface{Zoneid: zoneid, GetHostedZoneOutput: &route53.GetHostedZoneOutput{}}
+	err = route53updater.VerifyTXTRecords(txtRecs)
+	require.ErrorContains(t, err, "no delegation set")
 }
 
 func TestNew(t *testing.T) {
@@ -87,3 +199,273 @@ func TestNewDefaultRoute53Interface(t *testing.T) {
 	require.Nil(t, err)
 	route53updater.Region = "bogus"
 }
+
+// FakeRoute53 keeps a single hosted zone in memory and applies change batches the way Route53 does
+type FakeRoute53 struct {
+	MockRoute53Interface
+	rrsets map[string]*route53.ResourceRecordSet
+}
+
+func NewFakeRoute53(zoneid string) *FakeRoute53 {
+	return &FakeRoute53{
+		MockRoute53Interface: MockRoute53Interface{Zoneid: zoneid},
+		rrsets:               map[string]*route53.ResourceRecordSet{},
+	}
+}
+
+func (s *FakeRoute53) ListResourceRecordSetsWithContext(cxt context.Context, input *route53.ListResourceRecordSetsInput, option ...request.Option) (*route53.ListResourceRecordSetsOutput, error) {
+	if s.Zoneid != *input.HostedZoneId {
+		return nil, fmt.Errorf("Zone not found.")
+	}
+	output := &route53.ListResourceRecordSetsOutput{IsTruncated: aws.Bool(false)}
+	for _, rrset := range s.rrsets {
+		output.ResourceRecordSets = append(output.ResourceRecordSets, rrset)
+	}
+	return output, nil
+}
+
+func (s *FakeRoute53) ChangeResourceRecordSetsWithContext(cxt context.Context, input *route53.ChangeResourceRecordSetsInput, option ...request.Option) (*route53.ChangeResourceRecordSetsOutput, error) {
+	if s.Zoneid != *input.HostedZoneId {
+		return nil, fmt.Errorf("Zone not found.")
+	}
+	err := input.Validate()
+	if err != nil {
+		return nil, err
+	}
+	for _, change := range input.ChangeBatch.Changes {
+		name := aws.StringValue(change.ResourceRecordSet.Name)
+		switch aws.StringValue(change.Action) {
+		case route53.ChangeActionUpsert:
+			if change.ResourceRecordSet.TTL == nil {
+				return nil, fmt.Errorf("InvalidInput: TTL is required for %v", name)
+			}
+			s.rrsets[name] = change.ResourceRecordSet
+		case route53.ChangeActionDelete:
+			if !reflect.DeepEqual(s.rrsets[name], change.ResourceRecordSet) {
+				return nil, fmt.Errorf("InvalidChangeBatch: %v does not match the current record set", name)
+			}
+			delete(s.rrsets, name)
+		}
+	}
+	return &route53.ChangeResourceRecordSetsOutput{
+		ChangeInfo: &route53.ChangeInfo{Id: aws.String("C1"), Status: aws.String(route53.ChangeStatusPending)},
+	}, nil
+}
+
+func (s *FakeRoute53) Seed(records ...provider.Record) {
+	for _, record := range records {
+		rrset := &route53.ResourceRecordSet{Name: aws.String(record.Name), Type: aws.String(route53.RRTypeTxt), TTL: aws.Int64(record.TTL)}
+		for _, value := range record.Values {
+			// Route53 may hand back values split differently to how they were written
+			rrset.ResourceRecords = append(rrset.ResourceRecords, &route53.ResourceRecord{Value: aws.String(dns.QuoteTXT(value) + ` ""`)})
+		}
+		s.rrsets[record.Name] = rrset
+	}
+}
+
+func (s *FakeRoute53) Records() []provider.Record {
+	var records []provider.Record
+	for _, rrset := range s.rrsets {
+		records = append(records, toRecord(rrset))
+	}
+	return records
+}
+
+func TestPublisherConformance(t *testing.T) {
+	providertest.Run(t, func(t *testing.T) providertest.Harness {
+		fake := NewFakeRoute53("ZONEID")
+		return providertest.Harness{
+			Publisher: &Route53Updater{UpdateDomain: providertest.Domain, Zoneid: "ZONEID", Route53: fake},
+			Seed:      fake.Seed,
+			Records:   fake.Records,
+		}
+	})
+}
+
+func TestUpdateTXTRecords(t *testing.T) {
+	fake := NewFakeRoute53("ZONEID")
+	fake.Seed(
+		provider.Record{Name: "example.com.", TTL: 300, Values: []string{"v=spf1 include:_spf1.example.com include:_spf2.example.com ~all"}},
+		provider.Record{Name: "_spf2.example.com.", TTL: 300, Values: []string{"v=spf1 ip4:192.168.1.2 ~all"}},
+	)
+	route53updater := Route53Updater{
+		UpdateDomain: "example.com",
+		Zoneid:       "ZONEID",
+		TTL:          60,
+		RootTTL:      300,
+		Route53:      fake,
+	}
+	txtRecs := map[string]string{
+		"example.com":       "v=spf1 include:_spf1.example.com ~all",
+		"_spf1.example.com": "v=spf1 ip4:192.168.1.1 ~all",
+	}
+	diff, err := route53updater.UpdateTXTRecords(txtRecs)
+	require.Nil(t, err)
+	require.Len(t, diff.Added, 1)
+	require.Len(t, diff.Modified, 1)
+	require.Len(t, diff.Deleted, 1)
+	require.Equal(t, `"v=spf1 ip4:192.168.1.1 ~all"`, *fake.rrsets["_spf1.example.com."].ResourceRecords[0].Value)
+	require.Equal(t, int64(60), *fake.rrsets["_spf1.example.com."].TTL)
+
+	diff, err = route53updater.UpdateTXTRecords(txtRecs)
+	require.Nil(t, err)
+	require.False(t, diff.HasChanges())
+
+	// A single record only gets the root TTL when it is the root
+	err = route53updater.UpdateTXTRecord("www.example.com", "v=spf1 -all")
+	require.Nil(t, err)
+	require.Equal(t, int64(60), *fake.rrsets["www.example.com."].TTL)
+}
+
+func TestUpdateTXTRecordsLeafNaming(t *testing.T) {
+	fake := NewFakeRoute53("ZONEID")
+	fake.Seed(
+		provider.Record{Name: "example.com.", TTL: 300, Values: []string{"v=spf1 include:1._spf.example.com include:2._spf.example.com ~all"}},
+		provider.Record{Name: "1._spf.example.com.", TTL: 300, Values: []string{"v=spf1 ip4:192.168.1.1 ~all"}},
+		provider.Record{Name: "2._spf.example.com.", TTL: 300, Values: []string{"v=spf1 ip4:192.168.1.2 ~all"}},
+		provider.Record{Name: "_spf2.example.com.", TTL: 300, Values: []string{"v=spf1 ip4:192.168.1.3 ~all"}},
+	)
+	route53updater := Route53Updater{
+		UpdateDomain: "example.com",
+		Zoneid:       "ZONEID",
+		Naming:       dns.Naming{Pattern: "{n}._spf"},
+		Route53:      fake,
+	}
+	diff, err := route53updater.UpdateTXTRecords(map[string]string{
+		"example.com":        "v=spf1 include:1._spf.example.com ~all",
+		"1._spf.example.com": "v=spf1 ip4:192.168.1.1 ~all",
+	})
+	require.Nil(t, err)
+	require.Len(t, diff.Modified, 1)
+	require.Len(t, diff.Deleted, 1)
+	require.Equal(t, "2._spf.example.com.", diff.Deleted[0].Name)
+	require.NotContains(t, fake.rrsets, "2._spf.example.com.")
+	// Records outside the naming scheme are not the updater's to delete
+	require.Contains(t, fake.rrsets, "_spf2.example.com.")
+}
+
+func TestResolveZone(t *testing.T) {
+	zones := []*route53.HostedZone{
+		{Id: aws.String("/hostedzone/ZPUBLIC"), Name: aws.String("example.com."), Config: &route53.HostedZoneConfig{PrivateZone: aws.Bool(false)}},
+		{Id: aws.String("/hostedzone/ZPRIVATE"), Name: aws.String("example.com."), Config: &route53.HostedZoneConfig{PrivateZone: aws.Bool(true)}},
+		{Id: aws.String("/hostedzone/ZMAIL"), Name: aws.String("mail.example.com."), Config: &route53.HostedZoneConfig{PrivateZone: aws.Bool(false)}},
+	}
+	route53updater := Route53Updater{
+		UpdateDomain: "mail.example.com",
+		Route53:      MockRoute53Interface{HostedZones: zones},
+	}
+
+	// Most specific public zone wins
+	err := route53updater.ResolveZone()
+	require.Nil(t, err)
+	require.Equal(t, "ZMAIL", route53updater.Zoneid)
+
+	route53updater.Zoneid = ""
+	route53updater.UpdateDomain = "news.example.com."
+	err = route53updater.ResolveZone()
+	require.Nil(t, err)
+	require.Equal(t, "ZPUBLIC", route53updater.Zoneid)
+
+	route53updater.Zoneid = ""
+	route53updater.PrivateZone = true
+	err = route53updater.ResolveZone()
+	require.Nil(t, err)
+	require.Equal(t, "ZPRIVATE", route53updater.Zoneid)
+
+	route53updater.Zoneid = ""
+	route53updater.UpdateDomain = "example.org"
+	err = route53updater.ResolveZone()
+	require.EqualError(t, err, "no private hosted zone found for example.org")
+
+	// Two zones with the same name are ambiguous
+	route53updater.PrivateZone = false
+	route53updater.UpdateDomain = "example.com"
+	route53updater.Route53 = MockRoute53Interface{HostedZones: append(zones, &route53.HostedZone{Id: aws.String("/hostedzone/ZOTHER"), Name: aws.String("example.com.")})}
+	err = route53updater.ResolveZone()
+	require.ErrorContains(t, err, "found 2 public hosted zones")
+}
+
+func TestResolveZoneValidatesZoneID(t *testing.T) {
+	route53updater := Route53Updater{
+		UpdateDomain: "mail.example.com",
+		Zoneid:       "ZONEID",
+		Route53: MockRoute53Interface{
+			Zoneid:              "ZONEID",
+			GetHostedZoneOutput: &route53.GetHostedZoneOutput{HostedZone: &route53.HostedZone{Name: aws.String("example.com.")}},
+		},
+	}
+	err := route53updater.ResolveZone()
+	require.Nil(t, err)
+
+	route53updater.UpdateDomain = "mail.example.org"
+	err = route53updater.ResolveZone()
+	require.EqualError(t, err, "hosted zone ZONEID (example.com.) does not contain mail.example.org.")
+
+	route53updater.UpdateDomain = "badexample.com"
+	err = route53updater.ResolveZone()
+	require.ErrorContains(t, err, "does not contain")
+
+	route53updater.UpdateDomain = "example.com"
+	route53updater.PrivateZone = true
+	err = route53updater.ResolveZone()
+	require.EqualError(t, err, "hosted zone ZONEID (example.com.) is not a private zone")
+}
+
+func TestNewWithEndpoint(t *testing.T) {
+	var authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		if r.URL.Path != "/2013-04-01/hostedzone/ZONEID/rrset" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?>
+<ListResourceRecordSetsResponse xmlns="https://route53.amazonaws.com/doc/2013-04-01/">
+  <ResourceRecordSets>
+    <ResourceRecordSet>
+      <Name>example.com.</Name>
+      <Type>TXT</Type>
+      <TTL>300</TTL>
+      <ResourceRecords><ResourceRecord><Value>"v=spf1 -all"</Value></ResourceRecord></ResourceRecords>
+    </ResourceRecordSet>
+  </ResourceRecordSets>
+  <IsTruncated>false</IsTruncated>
+  <MaxItems>100</MaxItems>
+</ListResourceRecordSetsResponse>`)
+	}))
+	defer server.Close()
+
+	route53updater, err := New(Route53Updater{
+		Region:          "us-east-1",
+		UpdateDomain:    "example.com.",
+		Zoneid:          "ZONEID",
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "secret",
+		Endpoint:        server.URL,
+	})
+	require.Nil(t, err)
+	records, err := route53updater.ListRecords(context.TODO(), "example.com")
+	require.Nil(t, err)
+	require.Contains(t, authorization, "Credential=AKIDEXAMPLE/")
+	require.Equal(t, []provider.Record{{Name: "example.com.", TTL: 300, Values: []string{"v=spf1 -all"}}}, records)
+}
+
+func TestNewWithRole(t *testing.T) {
+	static := Route53Updater{
+		Region:          "us-east-1",
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "secret",
+	}
+	direct, err := static.NewDefaultRoute53Interface()
+	require.Nil(t, err)
+
+	// Assumed role credentials replace the static ones on the Route53 client
+	static.RoleARN = "arn:aws:iam::123456789012:role/spf-flatten"
+	static.ExternalID = "external"
+	assumed, err := static.NewDefaultRoute53Interface()
+	require.Nil(t, err)
+	directCreds, err := direct.(*route53.Route53).Config.Credentials.Get()
+	require.Nil(t, err)
+	require.Equal(t, "AKIDEXAMPLE", directCreds.AccessKeyID)
+	require.NotSame(t, direct.(*route53.Route53).Config.Credentials, assumed.(*route53.Route53).Config.Credentials)
+}
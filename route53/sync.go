@@ -0,0 +1,136 @@
+package route53
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/searchspring.com/spf-flatten/provider"
+)
+
+const (
+	DefaultSyncTimeout      = 5 * time.Minute
+	DefaultSyncPollInterval = 5 * time.Second
+)
+
+// AuthoritativeResolver queries a single nameserver directly, bypassing any recursive cache
+type AuthoritativeResolver interface {
+	LookupTXT(ctx context.Context, server string, name string) ([]string, error)
+}
+
+type DefaultAuthoritativeResolver struct{}
+
+func (s DefaultAuthoritativeResolver) LookupTXT(ctx context.Context, server string, name string) ([]string, error) {
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			d := net.Dialer{}
+			return d.DialContext(ctx, network, net.JoinHostPort(strings.TrimSuffix(server, "."), "53"))
+		},
+	}
+	return resolver.LookupTXT(ctx, provider.Fqdn(name))
+}
+
+// WaitForChange polls Route53 until the change is INSYNC or SyncTimeout elapses
+func (s *Route53Updater) WaitForChange(changeInfo *route53.ChangeInfo) error {
+	if changeInfo == nil {
+		return fmt.Errorf("no change info returned from Route53")
+	}
+	timeout := s.SyncTimeout
+	if timeout == 0 {
+		timeout = DefaultSyncTimeout
+	}
+	interval := s.SyncPollInterval
+	if interval == 0 {
+		interval = DefaultSyncPollInterval
+	}
+	ctx, cancel := context.WithTimeout(context.TODO(), timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	status := aws.StringValue(changeInfo.Status)
+	for status != route53.ChangeStatusInsync {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("change %v not in sync after %v: last status %v", aws.StringValue(changeInfo.Id), timeout, status)
+		case <-ticker.C:
+		}
+		output, err := s.Route53.GetChangeWithContext(ctx, &route53.GetChangeInput{
+			Id: changeInfo.Id,
+		})
+		if err != nil {
+			return err
+		}
+		status = aws.StringValue(output.ChangeInfo.Status)
+	}
+	return nil
+}
+
+// NameServers returns the authoritative nameservers delegated to the hosted zone
+func (s *Route53Updater) NameServers() ([]string, error) {
+	output, err := s.Route53.GetHostedZoneWithContext(context.TODO(), &route53.GetHostedZoneInput{
+		Id: aws.String(s.Zoneid),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if output.DelegationSet == nil || len(output.DelegationSet.NameServers) == 0 {
+		return nil, fmt.Errorf("hosted zone %v has no delegation set", s.Zoneid)
+	}
+	return aws.StringValueSlice(output.DelegationSet.NameServers), nil
+}
+
+// VerifyTXTRecords queries every authoritative nameserver of the zone directly and
+// checks that the SPF value served for each name matches the intended record
+func (s *Route53Updater) VerifyTXTRecords(txtRecs map[string]string) error {
+	resolver := s.Resolver
+	if resolver == nil {
+		resolver = DefaultAuthoritativeResolver{}
+	}
+	servers, err := s.NameServers()
+	if err != nil {
+		return err
+	}
+
+	domains := make([]string, 0, len(txtRecs))
+	for domain := range txtRecs {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+
+	var mismatches []string
+	for _, server := range servers {
+		for _, domain := range domains {
+			txt, err := resolver.LookupTXT(context.TODO(), server, domain)
+			if err != nil {
+				mismatches = append(mismatches, fmt.Sprintf("%v@%v: %v", domain, server, err))
+				continue
+			}
+			served := spfValue(txt)
+			if served != txtRecs[domain] {
+				mismatches = append(mismatches, fmt.Sprintf("%v@%v: served %q, want %q", domain, server, served, txtRecs[domain]))
+			}
+		}
+	}
+	if len(mismatches) > 0 {
+		return fmt.Errorf("authoritative verification failed:\n%v", strings.Join(mismatches, "\n"))
+	}
+	return nil
+}
+
+// spfValue picks the SPF record out of a TXT answer that may hold unrelated values
+func spfValue(txt []string) string {
+	for _, value := range txt {
+		if provider.IsSPF(value) {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,95 @@
+package route53
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/searchspring.com/spf-flatten/provider"
+)
+
+// ResolveZone finds the hosted zone for UpdateDomain when Zoneid is empty, otherwise it checks that
+// the given zone really contains UpdateDomain before anything is written to it
+func (s *Route53Updater) ResolveZone() error {
+	if s.UpdateDomain == "" {
+		return fmt.Errorf("no update domain configured")
+	}
+	if s.Zoneid != "" {
+		return s.validateZone()
+	}
+	zoneid, err := s.FindHostedZone()
+	if err != nil {
+		return err
+	}
+	s.Zoneid = zoneid
+	return nil
+}
+
+// FindHostedZone returns the id of the most specific public, or private when PrivateZone is set,
+// hosted zone that contains UpdateDomain
+func (s *Route53Updater) FindHostedZone() (string, error) {
+	labels := strings.Split(strings.TrimSuffix(provider.Fqdn(s.UpdateDomain), "."), ".")
+	for i := range labels {
+		candidate := strings.Join(labels[i:], ".") + "."
+		output, err := s.Route53.ListHostedZonesByNameWithContext(context.TODO(), &route53.ListHostedZonesByNameInput{
+			DNSName: aws.String(candidate),
+		})
+		if err != nil {
+			return "", err
+		}
+
+		var matches []*route53.HostedZone
+		for _, zone := range output.HostedZones {
+			// Results start at candidate but carry on through the following zones
+			if provider.Fqdn(aws.StringValue(zone.Name)) != candidate {
+				continue
+			}
+			if s.isPrivate(zone) != s.PrivateZone {
+				continue
+			}
+			matches = append(matches, zone)
+		}
+		if len(matches) > 1 {
+			return "", fmt.Errorf("found %d %v hosted zones named %v, set the zone id explicitly", len(matches), s.zoneKind(), candidate)
+		}
+		if len(matches) == 1 {
+			return trimZoneID(aws.StringValue(matches[0].Id)), nil
+		}
+	}
+	return "", fmt.Errorf("no %v hosted zone found for %v", s.zoneKind(), s.UpdateDomain)
+}
+
+func (s *Route53Updater) validateZone() error {
+	output, err := s.Route53.GetHostedZoneWithContext(context.TODO(), &route53.GetHostedZoneInput{
+		Id: aws.String(s.Zoneid),
+	})
+	if err != nil {
+		return err
+	}
+	zoneName := provider.Fqdn(aws.StringValue(output.HostedZone.Name))
+	domain := provider.Fqdn(s.UpdateDomain)
+	if domain != zoneName && !strings.HasSuffix(domain, "."+zoneName) {
+		return fmt.Errorf("hosted zone %v (%v) does not contain %v", s.Zoneid, zoneName, domain)
+	}
+	if s.isPrivate(output.HostedZone) != s.PrivateZone {
+		return fmt.Errorf("hosted zone %v (%v) is not a %v zone", s.Zoneid, zoneName, s.zoneKind())
+	}
+	return nil
+}
+
+func (s *Route53Updater) isPrivate(zone *route53.HostedZone) bool {
+	return zone.Config != nil && aws.BoolValue(zone.Config.PrivateZone)
+}
+
+func (s *Route53Updater) zoneKind() string {
+	if s.PrivateZone {
+		return "private"
+	}
+	return "public"
+}
+
+func trimZoneID(id string) string {
+	return strings.TrimPrefix(id, "/hostedzone/")
+}
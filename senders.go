@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	dns "github.com/searchspring.com/spf-flatten/dns"
+	"github.com/searchspring.com/spf-flatten/provider"
+)
+
+// authorizedChanges compares the senders the provider's records authorize with those of the template, grouped by
+// the template's include they come through
+func authorizedChanges(r *runner, s settings, current []provider.Record) ([]dns.AuthorizedChange, error) {
+	template, err := includeTree(r.newDNS(), s)
+	if err != nil {
+		return nil, err
+	}
+	return authorizedChangesFrom(r, s, template, current)
+}
+
+// authorizedChangesFrom is authorizedChanges for a template already resolved
+func authorizedChangesFrom(r *runner, s settings, template *dns.Include, current []provider.Record) ([]dns.AuthorizedChange, error) {
+	domain := s.get(updateDomain.env)
+	before := map[string]string{}
+	if hasRecord(current, domain) {
+		d := r.newDNS()
+		d.NetworkHandler = recordsNetwork{NetworkInterface: d.NetworkHandler, records: current}
+		tree, err := d.IncludeTree(domain)
+		if err != nil {
+			return nil, err
+		}
+		before = tree.Authorized()
+	}
+
+	// What was flattened into the records can no longer be traced to the include it came through. It is put down to the
+	// include whose answers held it last run, or else to one of the template's that authorizes some of the same senders,
+	// its origin being unknown when neither does.
+	after := template.Authorized()
+	var previous map[string]string
+	if r.previous != nil {
+		previous = r.previous.Authorized()
+	}
+	for term, source := range before {
+		if provider.Fqdn(source) != provider.Fqdn(domain) && !naming(s).IsLeaf(source, domain) {
+			continue
+		}
+		before[term] = dns.Overlapping(term, previous)
+		if before[term] == "" {
+			before[term] = dns.Overlapping(term, after)
+		}
+	}
+	return dns.DiffAuthorized(before, after), nil
+}
+
+// previousTree rebuilds the template's tree from the answers the previous plan recorded for the domain, nil when it
+// has none or they do not hold the whole tree
+func previousTree(r *runner, s settings) *dns.Include {
+	if r.previousPlan == nil {
+		return nil
+	}
+	t := r.previousPlan.target(s.get(updateDomain.env))
+	if t == nil || len(t.DNSAnswers) == 0 {
+		return nil
+	}
+	tree, err := includeTree(dns.DNS{NetworkHandler: answeredNetwork(t.DNSAnswers), Logger: r.logger}, s)
+	if err != nil {
+		r.logger.Debug("the previous plan's answers do not hold the template's tree", "error", err)
+		return nil
+	}
+	return tree
+}
+
+// hasRecord reports whether the records hold one named name
+func hasRecord(records []provider.Record, name string) bool {
+	for _, rec := range records {
+		if provider.Fqdn(rec.Name) == provider.Fqdn(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// printAuthorized writes how the authorized senders change, by the include they come through
+func printAuthorized(w io.Writer, changes []dns.AuthorizedChange) {
+	if len(changes) == 0 {
+		fmt.Fprintln(w, "The same senders stay authorized")
+		return
+	}
+	fmt.Fprintln(w, "Authorized senders:")
+	for _, change := range changes {
+		source := change.Source
+		if source == "" {
+			source = "origin unknown"
+		}
+		fmt.Fprintf(w, "  %v: %d added, %d removed\n", source, len(change.Added), len(change.Removed))
+		for _, term := range change.Added {
+			fmt.Fprintf(w, "    + %v\n", term)
+		}
+		for _, term := range change.Removed {
+			fmt.Fprintf(w, "    - %v\n", term)
+		}
+	}
+}
+
+// recordsNetwork answers TXT lookups from the provider's records, asking the network for names they do not hold
+type recordsNetwork struct {
+	dns.NetworkInterface
+	records []provider.Record
+}
+
+func (n recordsNetwork) LookupTXT(ctx context.Context, host string) ([]string, error) {
+	for _, rec := range n.records {
+		if provider.Fqdn(rec.Name) == provider.Fqdn(host) {
+			return rec.Values, nil
+		}
+	}
+	return n.NetworkInterface.LookupTXT(ctx, host)
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	dns "github.com/searchspring.com/spf-flatten/dns"
+	"github.com/searchspring.com/spf-flatten/provider"
+)
+
+// defaultSchedule is how often serve re-flattens a domain without a SCHEDULE
+const defaultSchedule = "1h"
+
+// defaultListenAddr is where the HTTP endpoints listen without a LISTEN_ADDR, only locally as /reflatten takes no credentials
+const defaultListenAddr = "127.0.0.1:8080"
+
+// minTTLWait keeps a template with very short TTLs from having its domain re-flattened back to back
+const minTTLWait = time.Minute
+
+// serveContext is cancelled once serve is asked to stop
+var serveContext = defaultServeContext
+
+// listen opens the listener the HTTP endpoints are served on
+var listen = net.Listen
+
+func defaultServeContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(ctx, syscall.SIGTERM, os.Interrupt)
+}
+
+// schedule is when serve re-flattens a domain, every so often or on a cron schedule, each run delayed by up to jitter
+type schedule struct {
+	every  time.Duration
+	cron   cron.Schedule
+	jitter time.Duration
+}
+
+// parseSchedule reads an interval such as 1h or a cron expression such as "0 * * * *" or "@daily", and a jitter duration
+func parseSchedule(spec string, jitter string) (schedule, error) {
+	var sc schedule
+	if spec == "" {
+		spec = defaultSchedule
+	}
+	if every, err := time.ParseDuration(spec); err == nil {
+		if every <= 0 {
+			return sc, fmt.Errorf("schedule %q must be a positive interval", spec)
+		}
+		sc.every = every
+	} else {
+		sc.cron, err = cron.ParseStandard(spec)
+		if err != nil {
+			return sc, fmt.Errorf("schedule %q is neither an interval such as 1h nor a cron expression: %v", spec, err)
+		}
+	}
+	if jitter != "" {
+		d, err := time.ParseDuration(jitter)
+		if err != nil || d < 0 {
+			return sc, fmt.Errorf("jitter %q must be a duration such as 5m", jitter)
+		}
+		sc.jitter = d
+	}
+	return sc, nil
+}
+
+// next is when the run after one at now is due
+func (sc schedule) next(now time.Time) time.Time {
+	var next time.Time
+	if sc.cron != nil {
+		next = sc.cron.Next(now)
+	} else {
+		next = now.Add(sc.every)
+	}
+	return next.Add(sc.delay())
+}
+
+// expiring is when a run is due once an answer with ttl expires, no sooner than minTTLWait and delayed by up to jitter
+// like a scheduled one, so domains sharing an include do not all re-flatten at once
+func (sc schedule) expiring(now time.Time, ttl time.Duration) time.Time {
+	if ttl < minTTLWait {
+		ttl = minTTLWait
+	}
+	return now.Add(ttl).Add(sc.delay())
+}
+
+// delay is how long a run is put off by, up to jitter
+func (sc schedule) delay() time.Duration {
+	if sc.jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(sc.jitter)))
+}
+
+// ttlRecorder notes the lowest TTL of the answers a run was based on
+type ttlRecorder struct {
+	// server is the nameserver to ask, from /etc/resolv.conf when empty
+	server string
+
+	mu     sync.Mutex
+	lowest time.Duration
+	// noted is whether there is a lowest, a TTL of 0 being a real one
+	noted bool
+}
+
+func (t *ttlRecorder) note(ttl time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.noted || ttl < t.lowest {
+		t.lowest = ttl
+		t.noted = true
+	}
+}
+
+// ttlNetwork passes the TTL of each answer to a ttlRecorder, when the network it wraps knows them
+type ttlNetwork struct {
+	dns.NetworkInterface
+	ttls *ttlRecorder
+}
+
+func (n ttlNetwork) LookupTXT(ctx context.Context, host string) ([]string, error) {
+	network, ok := n.NetworkInterface.(dns.TTLNetworkInterface)
+	if !ok {
+		return n.NetworkInterface.LookupTXT(ctx, host)
+	}
+	txt, ttl, err := network.LookupTXTWithTTL(ctx, host)
+	if err == nil {
+		n.ttls.note(ttl)
+	}
+	return txt, err
+}
+
+// domainJob keeps one domain flattened on its schedule
+type domainJob struct {
+	s        settings
+	domain   string
+	schedule schedule
+	// trigger asks for a run straight away, one already asked for being enough
+	trigger chan struct{}
+
+	mu     sync.Mutex
+	status domainStatus
+}
+
+func runServe(ctx context.Context, r *runner, targets []settings) (int, error) {
+	var jobs []*domainJob
+	for _, s := range targets {
+		err := s.require(updateDomain)
+		if err != nil {
+			return exitError, err
+		}
+		sc, err := parseSchedule(s.get(scheduleSetting.env), s.get(jitterSetting.env))
+		if err != nil {
+			return exitError, fmt.Errorf("%v: %v", s.get(updateDomain.env), err)
+		}
+		domain := s.get(updateDomain.env)
+		jobs = append(jobs, &domainJob{s: s, domain: domain, schedule: sc, trigger: make(chan struct{}, 1), status: domainStatus{UpdateDomain: domain}})
+	}
+
+	// Every target has the command's LISTEN_ADDR, a config file cannot set one per target
+	addr := targets[0].get(listenAddr.env)
+	if addr == "" {
+		addr = defaultListenAddr
+	}
+	listener, err := listen("tcp", addr)
+	if err != nil {
+		return exitError, err
+	}
+
+	ctx, stop := serveContext(ctx)
+	defer stop()
+	// The HTTP server failing stops the runs too, as serve is no use without its endpoints
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	r.metrics = newServeMetrics()
+	server := &http.Server{Handler: serveHandler(r.metrics, jobs), ReadHeaderTimeout: 10 * time.Second}
+	failed := make(chan error, 1)
+	go func() {
+		err := server.Serve(listener)
+		if !errors.Is(err, http.ErrServerClosed) {
+			failed <- err
+			cancel()
+		}
+	}()
+	r.logger.Info("listening", "addr", listener.Addr().String())
+
+	var wg sync.WaitGroup
+	for _, job := range jobs {
+		wg.Add(1)
+		go func(job *domainJob) {
+			defer wg.Done()
+			job.loop(ctx, r)
+		}(job)
+	}
+	r.logger.Info("serving", "domains", len(jobs))
+	<-ctx.Done()
+	r.logger.Info("shutting down once the runs in progress finish")
+	wg.Wait()
+	select {
+	case err := <-failed:
+		return exitError, fmt.Errorf("serving HTTP: %v", err)
+	default:
+	}
+	shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return exitOK, server.Shutdown(shutdown)
+}
+
+// loop re-flattens the domain straight away and then whenever it is next due, or one of the answers it was based on expires
+func (j *domainJob) loop(ctx context.Context, r *runner) {
+	logger := r.logger.With("domain", j.domain)
+	for {
+		ttls := &ttlRecorder{server: j.s.get(dnsServer.env)}
+		jr := &runner{stdout: io.Discard, logger: logger, result: &result{UpdateDomain: j.domain}, ttls: ttls, metrics: r.metrics, previous: j.currentStatus().Tree}
+		// A run in progress finishes publishing even when asked to stop
+		ran := time.Now()
+		published, records, err := reflatten(context.WithoutCancel(ctx), jr, j.s)
+		if err != nil {
+			logger.Error("run failed", "error", err)
+		}
+
+		now := time.Now()
+		next := j.schedule.next(now)
+		if ttls.noted {
+			if expiry := j.schedule.expiring(now, ttls.lowest); expiry.Before(next) {
+				logger.Debug("an answer expires before the next scheduled run", "ttl", ttls.lowest)
+				next = expiry
+			}
+		}
+		logger.Debug("next run scheduled", "at", next)
+		j.ran(ran, jr.result.Tree, published, records, err, next)
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-j.trigger:
+			timer.Stop()
+			logger.Info("run triggered")
+		case <-timer.C:
+		}
+	}
+}
+
+// reflatten flattens the domain and publishes the records, unless the senders they authorize are those already published,
+// giving what the provider holds once it is done
+func reflatten(ctx context.Context, r *runner, s settings) (bool, []provider.Record, error) {
+	domain := s.get(updateDomain.env)
+	started := time.Now()
+	answers := map[string][]string{}
+	txtRecs, err := flattenValid(r, s, answers)
+	if err != nil {
+		return false, nil, err
+	}
+	// The tree is built from the answers the records were flattened from rather than looking them up again
+	template, err := includeTree(dns.DNS{NetworkHandler: answeredNetwork(answers), Logger: r.logger}, s)
+	if err != nil {
+		return false, nil, err
+	}
+	r.result.Tree = template
+	r.metrics.flattened(domain, time.Since(started), txtRecs)
+	r.metrics.templateLookups.WithLabelValues(domain).Set(float64(template.Lookups()))
+
+	opts, err := planOptions(s)
+	if err != nil {
+		return false, nil, err
+	}
+	name := providerName(s)
+	publisher, err := r.publisher(name, s, domain, s.isTrue(dryRun.env))
+	if err != nil {
+		return false, nil, err
+	}
+	current, err := publisher.ListRecords(ctx, domain)
+	if err != nil {
+		r.metrics.publishFailures.WithLabelValues(domain, name).Inc()
+		return false, nil, err
+	}
+
+	senders, err := authorizedChangesFrom(r, s, template, current)
+	if err != nil {
+		r.logger.Warn("publishing as the published senders could not be compared", "error", err)
+	} else if len(senders) == 0 {
+		r.logger.Info("authorized senders unchanged, not publishing")
+		r.metrics.lastCheck.WithLabelValues(domain).SetToCurrentTime()
+		return false, current, nil
+	}
+	plan := provider.NewPlan(domain, current, txtRecs, opts)
+	err = provider.ApplyPlan(ctx, publisher, plan)
+	if err != nil {
+		r.metrics.publishFailures.WithLabelValues(domain, name).Inc()
+		return false, nil, fmt.Errorf("updating records: %v", err)
+	}
+	r.metrics.lastPublish.WithLabelValues(domain).SetToCurrentTime()
+	r.metrics.lastCheck.WithLabelValues(domain).SetToCurrentTime()
+	r.logger.Info("published", "added", len(plan.Diff.Added), "modified", len(plan.Diff.Modified), "deleted", len(plan.Diff.Deleted))
+	if s.isTrue(dryRun.env) {
+		return true, current, nil
+	}
+	return true, appliedRecords(current, plan), nil
+}
+
+// appliedRecords is what the provider holds once the plan is applied to the current records
+func appliedRecords(current []provider.Record, plan provider.Plan) []provider.Record {
+	records := map[string]provider.Record{}
+	for _, rec := range current {
+		records[provider.Fqdn(rec.Name)] = rec
+	}
+	for _, change := range plan.Changes {
+		records[provider.Fqdn(change.Record.Name)] = change.Record
+	}
+	for _, rec := range plan.Stale {
+		delete(records, provider.Fqdn(rec.Name))
+	}
+	var applied []provider.Record
+	for _, rec := range records {
+		applied = append(applied, rec)
+	}
+	sort.Slice(applied, func(i, j int) bool { return applied[i].Name < applied[j].Name })
+	return applied
+}
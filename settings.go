@@ -0,0 +1,207 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// setting is an ENV variable a command reads, which a flag of the same name can override
+type setting struct {
+	env   string
+	usage string
+	// name is the flag's name when it differs from the ENV variable's
+	name    string
+	boolean bool
+	// list settings hold values separated by spaces, their flag can be repeated to add more
+	list bool
+}
+
+// flag names the setting's flag, by default the ENV variable lower cased with dashes, IE --update-domain for UPDATE_DOMAIN
+func (s setting) flag() string {
+	if s.name != "" {
+		return s.name
+	}
+	return strings.ReplaceAll(strings.ToLower(s.env), "_", "-")
+}
+
+var (
+	configPath      = setting{env: "CONFIG", usage: "YAML or JSON file listing the domains to manage"}
+	output          = setting{env: "OUTPUT", usage: "text (default), or json to print a JSON report on stdout and the text on stderr"}
+	logLevel        = setting{env: "LOG_LEVEL", usage: "log debug, info (default), warn or error messages and above to stderr"}
+	logFormat       = setting{env: "LOG_FORMAT", usage: "log as text (default) or json"}
+	templateDomain  = setting{env: "TEMPLATE_DOMAIN", usage: "resolvable existing SPF record to flatten"}
+	updateDomain    = setting{env: "UPDATE_DOMAIN", usage: "domain to create the SPF records for"}
+	testIP          = setting{env: "TEST_IP", usage: "space separated IP addresses the SPF records must pass"}
+	dryRun          = setting{env: "DRY_RUN", usage: "print the changes instead of making them", boolean: true}
+	planOut         = setting{env: "PLAN_OUT", name: "out", usage: "file to save the plan to for apply --plan"}
+	planPath        = setting{env: "PLAN_FILE", name: "plan", usage: "plan file saved by plan --out to publish as it is, instead of flattening again"}
+	previousPlan    = setting{env: "PREVIOUS_PLAN_FILE", name: "previous-plan", usage: "plan file the published records were applied from, whose answers trace the senders no longer authorized to their include"}
+	scheduleSetting = setting{env: "SCHEDULE", usage: "how often serve re-flattens, an interval such as 1h (default) or a cron expression such as \"0 * * * *\""}
+	jitterSetting   = setting{env: "JITTER", usage: "delay each serve run by a random duration up to this, IE 5m"}
+	listenAddr      = setting{env: "LISTEN_ADDR", usage: "address serve's HTTP endpoints such as /metrics listen on (default 127.0.0.1:8080)"}
+	dnsServer       = setting{env: "DNS_SERVER", usage: "nameserver serve resolves the template with, host:port, the first in /etc/resolv.conf when unset"}
+)
+
+// The template's mechanisms given inline, flattened instead of looking up TEMPLATE_DOMAIN
+var inlineSettings = []setting{
+	{env: "TEMPLATE_INCLUDE", name: "include", usage: "domain whose SPF record to include, repeat for more", list: true},
+	{env: "TEMPLATE_IP4", name: "ip4", usage: "IPv4 address or CIDR range to allow, repeat for more", list: true},
+	{env: "TEMPLATE_IP6", name: "ip6", usage: "IPv6 address or CIDR range to allow, repeat for more", list: true},
+	{env: "TEMPLATE_A", name: "a", usage: "domain whose addresses to allow, @ for the update domain, with an optional /cidr, repeat for more", list: true},
+	{env: "TEMPLATE_MX", name: "mx", usage: "domain whose mail exchangers to allow, @ for the update domain, with an optional /cidr, repeat for more", list: true},
+}
+
+// What to flatten and how to name and end the generated records
+var recordSettings = concat([]setting{templateDomain}, inlineSettings, []setting{
+	updateDomain,
+	{env: "ALL_QUALIFIER", usage: "term ending every generated record, ~all (default), -all or ?all"},
+	{env: "LEAF_NAMING", usage: "name of the leaf records below UPDATE_DOMAIN, {n} being their number (default _spf{n})"},
+})
+
+// TTLs of the generated records
+var ttlSettings = []setting{
+	{env: "TTL", usage: "TTL in seconds for every generated record"},
+	{env: "ROOT_TTL", usage: "TTL in seconds for the UPDATE_DOMAIN record itself"},
+}
+
+// Rendering the records as infrastructure as code
+var exportSettings = []setting{
+	{env: "EXPORT", usage: "render the records as terraform, terraform-json, cloudformation, octodns or dnscontrol"},
+	{env: "EXPORT_PATH", usage: "file to write the export to, stdout when unset or -"},
+	{env: "EXPORT_MERGE", usage: "merge octodns or dnscontrol output into the existing EXPORT_PATH", boolean: true},
+	{env: "EXPORT_ZONE", usage: "zone octoDNS and DNSControl names are relative to"},
+	{env: "ZONEID", usage: "hosted zone written into Terraform and CloudFormation exports"},
+}
+
+// Choosing and configuring the DNS provider the records are published to
+var providerSettings = []setting{
+	{env: "PROVIDER", usage: "route53, cloudflare, clouddns, azuredns, rfc2136, powerdns, zonefile or hook (default route53)"},
+	{env: "AWS_REGION", usage: "Route53 region"},
+	{env: "ZONEID", usage: "Route53 hosted zone, looked up from UPDATE_DOMAIN when unset"},
+	{env: "PRIVATE_ZONE", usage: "look up a private Route53 hosted zone", boolean: true},
+	{env: "AWS_PROFILE", usage: "named profile of the shared AWS config to use for Route53"},
+	{env: "AWS_ACCESS_KEY_ID", usage: "static Route53 access key, instead of the default credential chain"},
+	{env: "AWS_SECRET_ACCESS_KEY", usage: "secret of AWS_ACCESS_KEY_ID"},
+	{env: "AWS_SESSION_TOKEN", usage: "session token of temporary AWS_ACCESS_KEY_ID credentials"},
+	{env: "ROLE_ARN", usage: "IAM role to assume for Route53"},
+	{env: "EXTERNAL_ID", usage: "external ID for assuming ROLE_ARN"},
+	{env: "ROLE_SESSION_NAME", usage: "session name for assuming ROLE_ARN (default spf-flatten)"},
+	{env: "ROUTE53_ENDPOINT", usage: "Route53 API endpoint"},
+	{env: "WAIT_FOR_SYNC", usage: "wait for Route53 to sync and verify against the authoritative nameservers", boolean: true},
+	{env: "SYNC_TIMEOUT", usage: "how long to wait for Route53 to sync"},
+	{env: "CLOUDFLARE_ZONE_ID", usage: "Cloudflare zone, looked up from UPDATE_DOMAIN when unset"},
+	{env: "CLOUDFLARE_API_TOKEN", usage: "Cloudflare API token"},
+	{env: "CLOUDFLARE_ENDPOINT", usage: "Cloudflare API endpoint"},
+	{env: "GCP_PROJECT", usage: "Google Cloud project"},
+	{env: "CLOUDDNS_MANAGED_ZONE", usage: "Cloud DNS managed zone, looked up from UPDATE_DOMAIN when unset"},
+	{env: "GOOGLE_APPLICATION_CREDENTIALS", usage: "Google service account key file"},
+	{env: "CLOUDDNS_ENDPOINT", usage: "Cloud DNS API endpoint"},
+	{env: "AZURE_SUBSCRIPTION_ID", usage: "Azure subscription"},
+	{env: "AZURE_RESOURCE_GROUP", usage: "Azure resource group"},
+	{env: "AZURE_DNS_ZONE", usage: "Azure DNS zone, looked up from UPDATE_DOMAIN when unset"},
+	{env: "AZURE_TENANT_ID", usage: "Azure tenant"},
+	{env: "AZURE_CLIENT_ID", usage: "Azure service principal"},
+	{env: "AZURE_CLIENT_SECRET", usage: "Azure service principal secret"},
+	{env: "AZURE_ENDPOINT", usage: "Azure Resource Manager endpoint"},
+	{env: "AZURE_AUTHORITY_ENDPOINT", usage: "Azure AD authority endpoint"},
+	{env: "RFC2136_SERVER", usage: "primary nameserver to send updates to, host:port"},
+	{env: "RFC2136_ZONE", usage: "zone to update, looked up from UPDATE_DOMAIN when unset"},
+	{env: "TSIG_KEY_NAME", usage: "TSIG key name"},
+	{env: "TSIG_SECRET", usage: "base64 TSIG secret"},
+	{env: "TSIG_ALGORITHM", usage: "hmac-sha256 or hmac-sha512"},
+	{env: "POWERDNS_ENDPOINT", usage: "PowerDNS API URL including the version"},
+	{env: "POWERDNS_API_KEY", usage: "PowerDNS API key"},
+	{env: "POWERDNS_SERVER_ID", usage: "PowerDNS server"},
+	{env: "POWERDNS_ZONE", usage: "PowerDNS zone, looked up from UPDATE_DOMAIN when unset"},
+	{env: "ZONEFILE_PATH", usage: "zone file to write, stdout when unset or -"},
+	{env: "ZONEFILE_PATCH", usage: "patch the records into ZONEFILE_PATH and bump its SOA serial", boolean: true},
+	{env: "HOOK_URL", usage: "webhook to POST the records to"},
+	{env: "HOOK_TOKEN", usage: "bearer token sent to HOOK_URL"},
+	{env: "HOOK_COMMAND", usage: "command to pipe the records to instead of a webhook"},
+	{env: "HOOK_TIMEOUT", usage: "how long to wait for each hook call"},
+}
+
+// settings holds a command's configuration keyed by ENV variable
+type settings map[string]string
+
+func (s settings) get(env string) string {
+	return s[env]
+}
+
+func (s settings) isTrue(env string) bool {
+	return s[env] == "true"
+}
+
+// require checks each of the settings is set
+func (s settings) require(required ...setting) error {
+	for _, r := range required {
+		if s.get(r.env) == "" {
+			return fmt.Errorf("you must set --%v or the %v ENV variable", r.flag(), r.env)
+		}
+	}
+	return nil
+}
+
+// Read a TTL in seconds from an optional setting
+func (s settings) optionalTTL(env string) (int64, error) {
+	v := s.get(env)
+	if v == "" {
+		return 0, nil
+	}
+	ttl, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || ttl <= 0 {
+		return 0, fmt.Errorf("%s must be a positive number of seconds: %q", env, v)
+	}
+	return ttl, nil
+}
+
+// settingValue is the flag.Value writing a flag into settings
+type settingValue struct {
+	settings settings
+	setting  setting
+	// set is whether the flag was given, after which a list flag adds to its values instead of replacing the ENV variable's
+	set bool
+}
+
+// String is always empty so ENV values, which may be secrets, are not shown as defaults in --help
+func (v *settingValue) String() string {
+	return ""
+}
+
+func (v *settingValue) Set(value string) error {
+	if v.setting.boolean {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		value = strconv.FormatBool(b)
+	}
+	if v.setting.list && v.set {
+		value = v.settings[v.setting.env] + " " + value
+	}
+	v.settings[v.setting.env] = value
+	v.set = true
+	return nil
+}
+
+func (v *settingValue) IsBoolFlag() bool {
+	return v.setting.boolean
+}
+
+// newFlagSet registers a flag for each setting, starting every setting from its ENV variable
+func newFlagSet(name string, list []setting, s settings) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	for _, st := range list {
+		if fs.Lookup(st.flag()) != nil {
+			continue
+		}
+		if v := os.Getenv(st.env); v != "" {
+			s[st.env] = v
+		}
+		fs.Var(&settingValue{settings: s, setting: st}, st.flag(), fmt.Sprintf("%v ($%v)", st.usage, st.env))
+	}
+	return fs
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	dns "github.com/searchspring.com/spf-flatten/dns"
+	"github.com/searchspring.com/spf-flatten/provider"
+)
+
+// Results of a serve run
+const (
+	runPublished = "published"
+	runUnchanged = "unchanged"
+	runFailed    = "failed"
+)
+
+// domainStatus is what /status tells of a domain
+type domainStatus struct {
+	UpdateDomain string `json:"update_domain"`
+	// Records are those the provider holds as of the last run that got as far as listing them
+	Records []provider.Record `json:"records"`
+	// Tree is the template's include tree as last resolved
+	Tree *dns.Include `json:"tree,omitempty"`
+	// LastRun is when the last run started, LastResult being published, unchanged or failed
+	LastRun    *time.Time `json:"last_run,omitempty"`
+	LastResult string     `json:"last_result,omitempty"`
+	LastError  string     `json:"last_error,omitempty"`
+	// LastSuccess is when the last run that did not fail started
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	NextRun     *time.Time `json:"next_run,omitempty"`
+}
+
+// ran notes how a run that started at started went
+func (j *domainJob) ran(started time.Time, tree *dns.Include, published bool, records []provider.Record, err error, next time.Time) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.status.LastRun = &started
+	j.status.NextRun = &next
+	if tree != nil {
+		j.status.Tree = tree
+	}
+	if err != nil {
+		j.status.LastResult = runFailed
+		j.status.LastError = err.Error()
+		return
+	}
+	j.status.LastResult = runUnchanged
+	if published {
+		j.status.LastResult = runPublished
+	}
+	j.status.LastError = ""
+	j.status.LastSuccess = &started
+	sort.Slice(records, func(i, k int) bool { return records[i].Name < records[k].Name })
+	j.status.Records = records
+}
+
+func (j *domainJob) currentStatus() domainStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.status
+}
+
+// serveHandler routes serve's HTTP endpoints
+func serveHandler(m *serveMetrics, jobs []*domainJob) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m.handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, req *http.Request) {
+		// Ready once every domain has been flattened and its records found or made up to date
+		var waiting []string
+		for _, j := range jobs {
+			if j.currentStatus().LastSuccess == nil {
+				waiting = append(waiting, j.domain)
+			}
+		}
+		if len(waiting) > 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "waiting for a successful run of %v\n", waiting)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, req *http.Request) {
+		var domains []domainStatus
+		for _, j := range jobs {
+			domains = append(domains, j.currentStatus())
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"domains": domains})
+	})
+	mux.HandleFunc("/reflatten", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "POST to trigger a run"})
+			return
+		}
+		domain := req.URL.Query().Get("domain")
+		for _, j := range jobs {
+			if provider.Fqdn(j.domain) != provider.Fqdn(domain) {
+				continue
+			}
+			select {
+			case j.trigger <- struct{}{}:
+			default:
+				// A run is already waiting to start
+			}
+			writeJSON(w, http.StatusAccepted, map[string]string{"update_domain": j.domain})
+			return
+		}
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("%q is not a managed domain", domain)})
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,373 @@
+package zonefile
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	miekg "github.com/miekg/dns"
+	dns "github.com/searchspring.com/spf-flatten/dns"
+	"github.com/searchspring.com/spf-flatten/provider"
+)
+
+// Marker comments around the generated lines when patching a zone file in place
+const (
+	BeginMarker = "; BEGIN spf-flatten"
+	EndMarker   = "; END spf-flatten"
+)
+
+// ZoneFileUpdater writes the records as RFC 1035 zone file lines instead of publishing them to a DNS provider.
+// Owner names are always absolute so the output can be $INCLUDEd from any zone file.
+type ZoneFileUpdater struct {
+	UpdateDomain string
+	// Path is the file to write, stdout when empty or -
+	Path string
+	// Patch only replaces the lines between BeginMarker and EndMarker of the zone file at Path, appending them
+	// when the markers are missing, and bumps the SOA serial
+	Patch bool
+	// Naming picks out the leaf records of the domain, the default _spfN when empty
+	Naming dns.Naming
+	DryRun bool
+	// Out is where stdout and DryRun output goes, os.Stdout when nil
+	Out io.Writer
+	// Logger gets the files written, nothing is logged when nil
+	Logger *slog.Logger
+	// Now is used to build date based SOA serials, time.Now when nil
+	Now func() time.Time
+}
+
+var _ provider.BatchPublisher = &ZoneFileUpdater{}
+
+func New(s ZoneFileUpdater) (ZoneFileUpdater, error) {
+	if s.Path == "-" {
+		s.Path = ""
+	}
+	if s.Patch && s.Path == "" {
+		return s, fmt.Errorf("a zone file path is needed to patch it in place")
+	}
+	if s.Out == nil {
+		s.Out = os.Stdout
+	}
+	if s.Now == nil {
+		s.Now = time.Now
+	}
+	return s, nil
+}
+
+// ListRecords reads the records previously written to Path, stdout never has any
+func (s *ZoneFileUpdater) ListRecords(ctx context.Context, domain string) ([]provider.Record, error) {
+	existing, err := s.existing()
+	if err != nil {
+		return nil, err
+	}
+	var records []provider.Record
+	for _, record := range existing {
+		if record.Name == provider.Fqdn(domain) || s.Naming.IsLeaf(record.Name, domain) {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+func (s *ZoneFileUpdater) Apply(ctx context.Context, changes provider.ChangeSet) error {
+	return s.ApplyBatch(ctx, changes, nil)
+}
+
+func (s *ZoneFileUpdater) DeleteRecords(ctx context.Context, records []provider.Record) error {
+	return s.ApplyBatch(ctx, nil, records)
+}
+
+// ApplyBatch merges the changes into the records already in the file and rewrites it in one go
+func (s *ZoneFileUpdater) ApplyBatch(ctx context.Context, changes provider.ChangeSet, stale []provider.Record) error {
+	current, err := s.existing()
+	if err != nil {
+		return err
+	}
+	records := make(map[string]provider.Record)
+	for _, record := range current {
+		records[record.Name] = record
+	}
+	for _, change := range changes {
+		record := change.Record
+		record.Name = provider.Fqdn(record.Name)
+		records[record.Name] = record
+	}
+	for _, record := range stale {
+		delete(records, provider.Fqdn(record.Name))
+	}
+	lines := Format(sortedRecords(records, s.Naming, s.UpdateDomain))
+
+	if s.Path == "" {
+		_, err = io.WriteString(s.Out, lines)
+		return err
+	}
+	content := []byte(fmt.Sprintf("; Generated by spf-flatten for %v, do not edit\n%v", provider.Fqdn(s.UpdateDomain), lines))
+	if s.Patch {
+		content, err = s.patch(lines)
+		if err != nil {
+			return err
+		}
+	}
+	if s.DryRun {
+		fmt.Fprintf(s.Out, "DryRun %v not written\n: %s\n", s.Path, content)
+		return nil
+	}
+	err = writeFile(s.Path, content)
+	if err != nil {
+		return err
+	}
+	s.logger().Info("zone file written", "domain", s.UpdateDomain, "path", s.Path)
+	return nil
+}
+
+// patch swaps the generated section of the zone file for lines and bumps the SOA serial
+func (s *ZoneFileUpdater) patch(lines string) ([]byte, error) {
+	content, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	before, _, after, found := splitSection(content)
+	if !found {
+		before = content
+		if len(before) > 0 && !bytes.HasSuffix(before, []byte("\n")) {
+			before = append(before, '\n')
+		}
+	}
+	var patched bytes.Buffer
+	patched.Write(before)
+	patched.WriteString(BeginMarker + "\n")
+	patched.WriteString(lines)
+	patched.WriteString(EndMarker + "\n")
+	patched.Write(after)
+	return BumpSerial(patched.Bytes(), s.Now())
+}
+
+// existing parses every TXT record of the file, or of its generated section when patching
+func (s *ZoneFileUpdater) existing() ([]provider.Record, error) {
+	if s.Path == "" {
+		return nil, nil
+	}
+	content, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	if s.Patch {
+		_, content, _, _ = splitSection(content)
+	}
+	return parseTXT(content, s.Path)
+}
+
+func (s *ZoneFileUpdater) read() ([]byte, error) {
+	content, err := os.ReadFile(s.Path)
+	if os.IsNotExist(err) && !s.Patch {
+		return nil, nil
+	}
+	return content, err
+}
+
+// Format renders records as zone file lines with absolute owner names and quoted, chunked values
+func Format(records []provider.Record) string {
+	var b strings.Builder
+	for _, record := range records {
+		values := append([]string(nil), record.Values...)
+		sort.Strings(values)
+		for _, value := range values {
+			fmt.Fprintf(&b, "%v\t%d\tIN\tTXT\t%v\n", provider.Fqdn(record.Name), record.TTL, dns.QuoteTXT(value))
+		}
+	}
+	return b.String()
+}
+
+// BumpSerial increases the serial of the first SOA record in a zone file, leaving the rest of the text alone.
+// Date based serials (YYYYMMDDnn) move to today's date when they are older.
+func BumpSerial(content []byte, now time.Time) ([]byte, error) {
+	start, end, err := findSerial(content)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := strconv.ParseUint(string(content[start:end]), 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("SOA serial %q: %v", content[start:end], err)
+	}
+	next := serial + 1
+	today, _ := strconv.ParseUint(now.UTC().Format("20060102")+"00", 10, 32)
+	if serial >= 1970010100 && serial < today {
+		next = today
+	}
+	if next > 0xFFFFFFFF {
+		return nil, fmt.Errorf("SOA serial %v cannot be increased", serial)
+	}
+	patched := append([]byte(nil), content[:start]...)
+	patched = append(patched, strconv.FormatUint(next, 10)...)
+	return append(patched, content[end:]...), nil
+}
+
+// findSerial returns the byte range of the serial, the third field after the SOA type
+func findSerial(content []byte) (int, int, error) {
+	fields := -1
+	for i := 0; i < len(content); {
+		c := content[i]
+		switch {
+		case c == ';':
+			for i < len(content) && content[i] != '\n' {
+				i++
+			}
+		case c == '"':
+			for i++; i < len(content) && content[i] != '"'; i++ {
+				if content[i] == '\\' {
+					i++
+				}
+			}
+			i++
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == '(' || c == ')':
+			i++
+		default:
+			start := i
+			for i < len(content) && !strings.ContainsRune(" \t\r\n();\"", rune(content[i])) {
+				i++
+			}
+			token := string(content[start:i])
+			switch {
+			case fields < 0 && strings.EqualFold(token, "SOA"):
+				fields = 0
+			case fields >= 0:
+				fields++
+				if fields == 3 {
+					return start, i, nil
+				}
+			}
+		}
+	}
+	return 0, 0, fmt.Errorf("no SOA record found to bump the serial of")
+}
+
+// splitSection cuts a zone file around the generated section, found reports whether both markers were there
+func splitSection(content []byte) (before []byte, section []byte, after []byte, found bool) {
+	begin := markerLine(content, BeginMarker, 0)
+	if begin < 0 {
+		return content, nil, nil, false
+	}
+	sectionStart := lineEnd(content, begin)
+	end := markerLine(content, EndMarker, sectionStart)
+	if end < 0 {
+		return content, nil, nil, false
+	}
+	return content[:begin], content[sectionStart:end], content[lineEnd(content, end):], true
+}
+
+// markerLine finds the start of the first line from offset that is exactly marker
+func markerLine(content []byte, marker string, offset int) int {
+	for i := offset; i < len(content); i = lineEnd(content, i) {
+		line := content[i:lineEnd(content, i)]
+		if strings.TrimSpace(string(line)) == marker {
+			return i
+		}
+	}
+	return -1
+}
+
+func lineEnd(content []byte, i int) int {
+	n := bytes.IndexByte(content[i:], '\n')
+	if n < 0 {
+		return len(content)
+	}
+	return i + n + 1
+}
+
+// parseTXT reads the TXT records of zone file text, grouped by owner name
+func parseTXT(content []byte, file string) ([]provider.Record, error) {
+	records := make(map[string]provider.Record)
+	zp := miekg.NewZoneParser(bytes.NewReader(content), ".", file)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		txt, isTXT := rr.(*miekg.TXT)
+		if !isTXT {
+			continue
+		}
+		name := provider.Fqdn(txt.Hdr.Name)
+		record := records[name]
+		record.Name = name
+		record.TTL = int64(txt.Hdr.Ttl)
+		record.Values = append(record.Values, dns.JoinTXT(txt.Txt))
+		records[name] = record
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	return sortedRecords(records, dns.Naming{}, ""), nil
+}
+
+// sortedRecords orders records domain first, then the leaves naming gives it in numeric order, then any others by
+// reversed labels, so the same records always come out the same way
+func sortedRecords(records map[string]provider.Record, naming dns.Naming, domain string) []provider.Record {
+	var sorted []provider.Record
+	for _, record := range records {
+		sorted = append(sorted, record)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		ri, ni := recordOrder(sorted[i].Name, naming, domain)
+		rj, nj := recordOrder(sorted[j].Name, naming, domain)
+		if ri != rj {
+			return ri < rj
+		}
+		if ni != nj {
+			return ni < nj
+		}
+		return reversed(sorted[i].Name) < reversed(sorted[j].Name)
+	})
+	return sorted
+}
+
+// recordOrder ranks a name 0 for domain itself, 1 for its leaves along with the leaf's number, and 2 for any other
+func recordOrder(name string, naming dns.Naming, domain string) (int, int) {
+	if domain != "" && strings.EqualFold(provider.Fqdn(name), provider.Fqdn(domain)) {
+		return 0, 0
+	}
+	if num, ok := naming.LeafNumber(name, domain); ok {
+		return 1, num
+	}
+	return 2, 0
+}
+
+func reversed(name string) string {
+	labels := strings.Split(strings.TrimSuffix(name, "."), ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return strings.Join(labels, ".")
+}
+
+// writeFile replaces path atomically, keeping the mode of the file it replaces
+func writeFile(path string, content []byte) error {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(content)
+	if err == nil {
+		err = tmp.Chmod(mode)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *ZoneFileUpdater) logger() *slog.Logger {
+	return dns.LoggerOrDiscard(s.Logger)
+}
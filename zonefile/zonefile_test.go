@@ -0,0 +1,222 @@
+package zonefile
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	dns "github.com/searchspring.com/spf-flatten/dns"
+	"github.com/searchspring.com/spf-flatten/provider"
+	"github.com/searchspring.com/spf-flatten/provider/providertest"
+	"github.com/stretchr/testify/require"
+)
+
+const testZone = `$ORIGIN example.com.
+$TTL 3600
+@	IN	SOA	ns1.example.com. hostmaster.example.com. (
+		2024010101 ; serial
+		7200       ; refresh
+		3600       ; retry
+		1209600    ; expire
+		300 )      ; minimum
+	IN	NS	ns1.example.com.
+www	IN	A	192.0.2.10
+`
+
+var testNow = time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+
+// seed writes records straight into the file the way the updater would, inside the markers when patching
+func seed(t *testing.T, updater *ZoneFileUpdater) func(records ...provider.Record) {
+	return func(records ...provider.Record) {
+		existing, err := updater.existing()
+		require.Nil(t, err)
+		merged := make(map[string]provider.Record)
+		for _, record := range append(existing, records...) {
+			merged[record.Name] = record
+		}
+		content := []byte(Format(sortedRecords(merged, updater.Naming, updater.UpdateDomain)))
+		if updater.Patch {
+			current, err := os.ReadFile(updater.Path)
+			require.Nil(t, err)
+			before, _, after, found := splitSection(current)
+			if !found {
+				before, after = current, nil
+			}
+			content = []byte(string(before) + BeginMarker + "\n" + string(content) + EndMarker + "\n" + string(after))
+		}
+		require.Nil(t, os.WriteFile(updater.Path, content, 0644))
+	}
+}
+
+func records(t *testing.T, path string) func() []provider.Record {
+	return func() []provider.Record {
+		content, err := os.ReadFile(path)
+		require.Nil(t, err)
+		records, err := parseTXT(content, path)
+		require.Nil(t, err)
+		return records
+	}
+}
+
+func TestPublisherConformance(t *testing.T) {
+	t.Run("Include", func(t *testing.T) {
+		providertest.Run(t, func(t *testing.T) providertest.Harness {
+			path := filepath.Join(t.TempDir(), "spf.zone")
+			updater, err := New(ZoneFileUpdater{UpdateDomain: providertest.Domain, Path: path, Out: &bytes.Buffer{}})
+			require.Nil(t, err)
+			require.Nil(t, os.WriteFile(path, nil, 0644))
+			return providertest.Harness{Publisher: &updater, Seed: seed(t, &updater), Records: records(t, path)}
+		})
+	})
+	t.Run("Patch", func(t *testing.T) {
+		providertest.Run(t, func(t *testing.T) providertest.Harness {
+			path := filepath.Join(t.TempDir(), "example.com.zone")
+			require.Nil(t, os.WriteFile(path, []byte(testZone), 0644))
+			updater, err := New(ZoneFileUpdater{UpdateDomain: providertest.Domain, Path: path, Patch: true, Out: &bytes.Buffer{}})
+			require.Nil(t, err)
+			return providertest.Harness{Publisher: &updater, Seed: seed(t, &updater), Records: records(t, path)}
+		})
+	})
+}
+
+func TestFormat(t *testing.T) {
+	long := "v=spf1 " + strings.Repeat("ip4:192.0.2.1 ", 20) + "~all"
+	lines := Format([]provider.Record{
+		{Name: "example.com", TTL: 300, Values: []string{`say "hi"`, "v=spf1 include:_spf1.example.com ~all"}},
+		{Name: "_spf1.example.com.", TTL: 60, Values: []string{long}},
+	})
+	require.Equal(t, "example.com.\t300\tIN\tTXT\t\"say \\\"hi\\\"\"\n"+
+		"example.com.\t300\tIN\tTXT\t\"v=spf1 include:_spf1.example.com ~all\"\n"+
+		"_spf1.example.com.\t60\tIN\tTXT\t\""+long[:255]+"\" \""+long[255:]+"\"\n", lines)
+
+	parsed, err := parseTXT([]byte(lines), "test")
+	require.Nil(t, err)
+	require.Equal(t, []string{long}, parsed[1].Values)
+	require.Equal(t, []string{`say "hi"`, "v=spf1 include:_spf1.example.com ~all"}, parsed[0].Values)
+}
+
+func TestStdout(t *testing.T) {
+	var out bytes.Buffer
+	updater, err := New(ZoneFileUpdater{UpdateDomain: "example.com", Path: "-", Out: &out})
+	require.Nil(t, err)
+	diff, err := provider.Publish(context.TODO(), &updater, "example.com", map[string]string{
+		"example.com":        "v=spf1 include:_spf1.example.com include:_spf10.example.com ~all",
+		"_spf10.example.com": "v=spf1 ip4:192.0.2.10 ~all",
+		"_spf1.example.com":  "v=spf1 ip4:192.0.2.1 ~all",
+	}, provider.PlanOptions{})
+	require.Nil(t, err)
+	require.Len(t, diff.Added, 3)
+	require.Equal(t, "example.com.\t300\tIN\tTXT\t\"v=spf1 include:_spf1.example.com include:_spf10.example.com ~all\"\n"+
+		"_spf1.example.com.\t300\tIN\tTXT\t\"v=spf1 ip4:192.0.2.1 ~all\"\n"+
+		"_spf10.example.com.\t300\tIN\tTXT\t\"v=spf1 ip4:192.0.2.10 ~all\"\n", out.String())
+}
+
+func TestLeafNamingOrder(t *testing.T) {
+	var out bytes.Buffer
+	naming := dns.Naming{Pattern: "{n}._spf"}
+	updater, err := New(ZoneFileUpdater{UpdateDomain: "example.com", Path: "-", Out: &out, Naming: naming})
+	require.Nil(t, err)
+	_, err = provider.Publish(context.TODO(), &updater, "example.com", map[string]string{
+		"example.com":         "v=spf1 include:1._spf.example.com include:2._spf.example.com include:10._spf.example.com ~all",
+		"10._spf.example.com": "v=spf1 ip4:192.0.2.10 ~all",
+		"2._spf.example.com":  "v=spf1 ip4:192.0.2.2 ~all",
+		"1._spf.example.com":  "v=spf1 ip4:192.0.2.1 ~all",
+	}, provider.PlanOptions{Naming: naming})
+	require.Nil(t, err)
+	require.Equal(t, "example.com.\t300\tIN\tTXT\t\"v=spf1 include:1._spf.example.com include:2._spf.example.com include:10._spf.example.com ~all\"\n"+
+		"1._spf.example.com.\t300\tIN\tTXT\t\"v=spf1 ip4:192.0.2.1 ~all\"\n"+
+		"2._spf.example.com.\t300\tIN\tTXT\t\"v=spf1 ip4:192.0.2.2 ~all\"\n"+
+		"10._spf.example.com.\t300\tIN\tTXT\t\"v=spf1 ip4:192.0.2.10 ~all\"\n", out.String())
+}
+
+func TestSortedRecords(t *testing.T) {
+	records := map[string]provider.Record{}
+	for _, name := range []string{"_spf10.example.com.", "mail.example.com.", "example.com.", "_spf2.example.com.", "_dmarc.example.com.", "_spf1.example.com."} {
+		records[name] = provider.Record{Name: name}
+	}
+	// Map order differs run to run, the order given must not
+	for i := 0; i < 50; i++ {
+		var names []string
+		for _, record := range sortedRecords(records, dns.Naming{}, "example.com") {
+			names = append(names, record.Name)
+		}
+		require.Equal(t, []string{"example.com.", "_spf1.example.com.", "_spf2.example.com.", "_spf10.example.com.", "_dmarc.example.com.", "mail.example.com."}, names)
+	}
+}
+
+func TestPatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "example.com.zone")
+	require.Nil(t, os.WriteFile(path, []byte(testZone), 0640))
+	updater, err := New(ZoneFileUpdater{UpdateDomain: "example.com", Path: path, Patch: true, Out: &bytes.Buffer{}, Now: func() time.Time { return testNow }})
+	require.Nil(t, err)
+	txtRecs := map[string]string{
+		"example.com":       "v=spf1 include:_spf1.example.com ~all",
+		"_spf1.example.com": "v=spf1 ip4:192.0.2.1 ~all",
+	}
+
+	_, err = provider.Publish(context.TODO(), &updater, "example.com", txtRecs, provider.PlanOptions{})
+	require.Nil(t, err)
+	content, err := os.ReadFile(path)
+	require.Nil(t, err)
+	require.Equal(t, strings.Replace(testZone, "2024010101", "2026101800", 1)+BeginMarker+"\n"+
+		"example.com.\t300\tIN\tTXT\t\"v=spf1 include:_spf1.example.com ~all\"\n"+
+		"_spf1.example.com.\t300\tIN\tTXT\t\"v=spf1 ip4:192.0.2.1 ~all\"\n"+
+		EndMarker+"\n", string(content))
+	info, err := os.Stat(path)
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0640), info.Mode().Perm())
+
+	// Lines after the section stay put and an unchanged tree leaves the file alone
+	require.Nil(t, os.WriteFile(path, append(content, []byte("mail\tIN\tA\t192.0.2.25\n")...), 0640))
+	diff, err := provider.Publish(context.TODO(), &updater, "example.com", txtRecs, provider.PlanOptions{})
+	require.Nil(t, err)
+	require.False(t, diff.HasChanges())
+
+	txtRecs["_spf1.example.com"] = "v=spf1 ip4:192.0.2.2 ~all"
+	_, err = provider.Publish(context.TODO(), &updater, "example.com", txtRecs, provider.PlanOptions{})
+	require.Nil(t, err)
+	content, err = os.ReadFile(path)
+	require.Nil(t, err)
+	require.Contains(t, string(content), "2026101801 ; serial")
+	require.Contains(t, string(content), "ip4:192.0.2.2")
+	require.NotContains(t, string(content), "ip4:192.0.2.1 ")
+	require.True(t, strings.HasSuffix(string(content), EndMarker+"\nmail\tIN\tA\t192.0.2.25\n"))
+}
+
+func TestBumpSerial(t *testing.T) {
+	tests := []struct {
+		zone     string
+		expected string
+		err      string
+	}{
+		{zone: "@ IN SOA ns1 hostmaster 2024010101 7200 3600 1209600 300", expected: "@ IN SOA ns1 hostmaster 2026101800 7200 3600 1209600 300"},
+		{zone: "@ IN SOA ns1 hostmaster 2026101805 7200 3600 1209600 300", expected: "@ IN SOA ns1 hostmaster 2026101806 7200 3600 1209600 300"},
+		{zone: "@ IN SOA ns1 hostmaster 42 7200 3600 1209600 300", expected: "@ IN SOA ns1 hostmaster 43 7200 3600 1209600 300"},
+		{zone: "; the SOA below\n@ IN SOA ns1 host\"mas ter\" (\n 7 ; serial\n 1 2 3 4 )", expected: "; the SOA below\n@ IN SOA ns1 host\"mas ter\" (\n 8 ; serial\n 1 2 3 4 )"},
+		{zone: "@ IN SOA ns1 hostmaster 4294967295 7200 3600 1209600 300", err: "SOA serial 4294967295 cannot be increased"},
+		{zone: "www IN A 192.0.2.1", err: "no SOA record found to bump the serial of"},
+	}
+	for _, test := range tests {
+		bumped, err := BumpSerial([]byte(test.zone), testNow)
+		if test.err != "" {
+			require.EqualError(t, err, test.err)
+			continue
+		}
+		require.Nil(t, err)
+		require.Equal(t, test.expected, string(bumped))
+	}
+}
+
+func TestNew(t *testing.T) {
+	_, err := New(ZoneFileUpdater{Path: "-", Patch: true})
+	require.EqualError(t, err, "a zone file path is needed to patch it in place")
+
+	updater, err := New(ZoneFileUpdater{Path: "-"})
+	require.Nil(t, err)
+	require.Equal(t, "", updater.Path)
+	require.Equal(t, os.Stdout, updater.Out)
+}